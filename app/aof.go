@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// appendfsync policies
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+// aofRewriteItemsPerCmd is how many elements of a collection a command of a
+// rewritten AOF adds at most.
+const aofRewriteItemsPerCmd = 64
+
+func (srv *serverState) aofFilePath() string {
+	return filepath.Join(srv.config.dbDir, srv.config.appendFileName)
+}
+
+// loadAppendOnlyFile replays every command of the AOF. A command cut short at
+// the end of the file (e.g. after a crash mid-write) is truncated away.
+func (srv *serverState) loadAppendOnlyFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	loader := &client{id: -1}
+	validOffset, commands := 0, 0
+
+	for {
+		cmd, bytesRead, err := decodeStringArray(reader)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			fmt.Printf("!!! Warning: short read while loading the AOF file %s, truncating to %d bytes\n", path, validOffset)
+			file.Close()
+			if err := os.Truncate(path, int64(validOffset)); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file at offset %d: %w", validOffset, err)
+		}
+
+		response := srv.handleCommand(loader, cmd)
+		if strings.HasPrefix(response, "-") {
+			fmt.Printf("AOF command %q failed: %s", cmd, response)
+		}
+		validOffset += bytesRead
+		commands++
+	}
+
+	srv.mu.Lock()
+	srv.dirty = 0
+	srv.mu.Unlock()
+
+	fmt.Printf("AOF loaded: %d commands from %s\n", commands, path)
+	return nil
+}
+
+// openAppendOnlyFile must be called with srv.mu held or before serving clients.
+func (srv *serverState) openAppendOnlyFile() error {
+	file, err := os.OpenFile(srv.aofFilePath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	srv.aofFile = file
+	srv.aofLastFsync = time.Now()
+	return nil
+}
+
+// closeAppendOnlyFile must be called with srv.mu held.
+func (srv *serverState) closeAppendOnlyFile() {
+	if srv.aofFile == nil {
+		return
+	}
+	srv.aofFile.Sync()
+	srv.aofFile.Close()
+	srv.aofFile = nil
+}
+
+// feedAppendOnlyFile must be called with srv.mu held.
+func (srv *serverState) feedAppendOnlyFile(cmd []string) {
+	if srv.aofFile == nil && !srv.aofRewriteInProgress {
+		return
+	}
+
+	data := encodeStringArray(cmd)
+	if srv.aofRewriteInProgress {
+		srv.aofRewriteBuf = append(srv.aofRewriteBuf, data...)
+	}
+	if srv.aofFile == nil {
+		return
+	}
+
+	if _, err := srv.aofFile.WriteString(data); err != nil {
+		fmt.Println("Error writing to the AOF file:", err)
+		return
+	}
+	srv.aofPendingFsync = true
+	if srv.config.appendFsync == fsyncAlways {
+		srv.fsyncAppendOnlyFile()
+	}
+}
+
+// fsyncAppendOnlyFile must be called with srv.mu held.
+func (srv *serverState) fsyncAppendOnlyFile() {
+	if srv.aofFile == nil || !srv.aofPendingFsync {
+		return
+	}
+	if err := srv.aofFile.Sync(); err != nil {
+		fmt.Println("Error syncing the AOF file:", err)
+		return
+	}
+	srv.aofPendingFsync = false
+	srv.aofLastFsync = time.Now()
+}
+
+// checkAppendOnlyFsync runs from cron with srv.mu held.
+func (srv *serverState) checkAppendOnlyFsync() {
+	if srv.config.appendFsync == fsyncEverySec && time.Since(srv.aofLastFsync) >= time.Second {
+		srv.fsyncAppendOnlyFile()
+	}
+}
+
+// rewriteForPropagation turns a write command into one that has the same
+// effect when replayed later: relative expirations become absolute, keys that
+// expired right away are deleted and auto-generated stream IDs are replaced by
+// the ID actually assigned. It returns nil for commands that propagate their
+// effects themselves. It must be called with srv.mu held, right after the
+// command ran.
+func (srv *serverState) rewriteForPropagation(cmd []string) []string {
+	switch strings.ToLower(cmd[0]) {
+	case "set", "pexpireat":
+		key := cmd[1]
+		if !srv.keyExists(key) {
+			return []string{"DEL", key}
+		}
+		if strings.ToLower(cmd[0]) == "set" && len(cmd) > 3 {
+			if expiration, ok := srv.ttl[key]; ok {
+				return []string{"SET", key, cmd[2], "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10)}
+			}
+			return []string{"SET", key, cmd[2]}
+		}
+	case "restore", "restore-asking":
+		key := cmd[1]
+		if !srv.keyExists(key) {
+			return []string{"DEL", key}
+		}
+		if expiration, ok := srv.ttl[key]; ok {
+			return []string{"RESTORE", key, strconv.FormatInt(expiration.UnixMilli(), 10), cmd[3], "REPLACE", "ABSTTL"}
+		}
+		return []string{"RESTORE", key, "0", cmd[3], "REPLACE"}
+	case "migrate":
+		// only the keys that moved are gone
+		del := []string{"DEL"}
+		for _, key := range migrateKeys(cmd) {
+			if !srv.keyExists(key) {
+				del = append(del, key)
+			}
+		}
+		return del
+	case "xreadgroup", "xclaim", "xautoclaim":
+		// their handlers propagate what they did themselves
+		return nil
+	case "xadd", "xtrim":
+		return srv.rewriteStreamTrim(cmd)
+	}
+	return cmd
+}
+
+// writeAppendOnlyCommands writes the commands that rebuild the snapshot.
+func writeAppendOnlyCommands(w io.Writer, snap *snapshot) error {
+	bw := bufio.NewWriter(w)
+	for key, value := range snap.store {
+		cmd := []string{"SET", key, value}
+		if expiration, ok := snap.ttl[key]; ok {
+			cmd = append(cmd, "PXAT", strconv.FormatInt(expiration.UnixMilli(), 10))
+		}
+		bw.WriteString(encodeStringArray(cmd))
+	}
+	for key, s := range snap.streams {
+		if len(s.groups) > 0 || len(s.entries) == 0 || s.entriesAdded != len(s.entries) {
+			// there are no commands setting up pending entries, the IDs of
+			// removed entries or an empty stream as they were: restore the
+			// whole stream from its serialized form instead
+			bw.WriteString(encodeStringArray([]string{"RESTORE", key, "0", dumpValue(s), "REPLACE"}))
+			continue
+		}
+		for _, entry := range s.entries {
+			cmd := append([]string{"XADD", key, fmt.Sprintf("%d-%d", entry.id[0], entry.id[1])}, entry.store...)
+			bw.WriteString(encodeStringArray(cmd))
+		}
+	}
+	for key, list := range snap.lists {
+		writeBatched(bw, "RPUSH", key, list, 1)
+	}
+	for key, set := range snap.sets {
+		members := make([]string, 0, len(set))
+		for member := range set {
+			members = append(members, member)
+		}
+		writeBatched(bw, "SADD", key, members, 1)
+	}
+	for key, zset := range snap.zsets {
+		args := make([]string, 0, 2*len(zset))
+		for member, score := range zset {
+			args = append(args, formatScore(score), member)
+		}
+		writeBatched(bw, "ZADD", key, args, 2)
+	}
+	for key, hash := range snap.hashes {
+		args := make([]string, 0, 2*len(hash))
+		for field, value := range hash {
+			args = append(args, field, value)
+		}
+		writeBatched(bw, "HSET", key, args, 2)
+	}
+	// strings carry their expiration in SET, every other type needs its own command
+	for key, expiration := range snap.ttl {
+		if _, ok := snap.store[key]; !ok {
+			bw.WriteString(encodeStringArray([]string{"PEXPIREAT", key, strconv.FormatInt(expiration.UnixMilli(), 10)}))
+		}
+	}
+	return bw.Flush()
+}
+
+// writeBatched writes the command adding args to key, split in commands of
+// aofRewriteItemsPerCmd items of width arguments each, as Redis does, so a
+// large collection doesn't make a command longer than maxMultibulkLength.
+func writeBatched(bw *bufio.Writer, name, key string, args []string, width int) {
+	for len(args) > 0 {
+		n := min(len(args), aofRewriteItemsPerCmd*width)
+		bw.WriteString(encodeStringArray(append([]string{name, key}, args[:n]...)))
+		args = args[n:]
+	}
+}
+
+// rewriteAppendOnlyFile writes the snapshot as a fresh AOF to a temporary
+// file and returns it still open, so writes issued meanwhile can be appended
+// before it replaces the current AOF.
+func rewriteAppendOnlyFile(dir string, snap *snapshot) (*os.File, error) {
+	file, err := os.CreateTemp(dir, fmt.Sprintf("temp-rewriteaof-bg-%d-*.aof", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	err = writeAppendOnlyCommands(file, snap)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// startAppendOnlyRewrite must be called with srv.mu held.
+func (srv *serverState) startAppendOnlyRewrite() {
+	snap := srv.takeSnapshot()
+	dir := srv.config.dbDir
+
+	srv.aofRewriteInProgress = true
+	srv.aofRewriteBuf = nil
+
+	go func() {
+		file, err := rewriteAppendOnlyFile(dir, snap)
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		srv.aofRewriteInProgress = false
+		if err == nil {
+			err = srv.finishAppendOnlyRewrite(file)
+		}
+		srv.aofRewriteBuf = nil
+		srv.aofLastRewriteOK = err == nil
+		if err != nil {
+			fmt.Println("Background AOF rewrite error:", err)
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+}
+
+// finishAppendOnlyRewrite appends the writes buffered during the rewrite and
+// atomically swaps the new file in. Called with srv.mu held.
+func (srv *serverState) finishAppendOnlyRewrite(file *os.File) error {
+	_, err := file.Write(srv.aofRewriteBuf)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), srv.aofFilePath())
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if !srv.config.appendOnly {
+		return file.Close()
+	}
+	// the new file is positioned at its end, keep appending to it
+	if srv.aofFile != nil {
+		srv.aofFile.Close()
+	}
+	srv.aofFile = file
+	srv.aofPendingFsync = false
+	srv.aofLastFsync = time.Now()
+	return nil
+}
+
+func (srv *serverState) handleBgrewriteaof(c *client, cmd []string) string {
+	if srv.aofRewriteInProgress {
+		return encodeError(errors.New("Background append only file rewriting already in progress"))
+	}
+	srv.startAppendOnlyRewrite()
+	return encodeSimpleString("Background append only file rewriting started")
+}
+
+// applyAppendOnlyConfig reacts to CONFIG SET appendonly. Called with srv.mu held.
+func (srv *serverState) applyAppendOnlyConfig(wasEnabled bool) {
+	switch {
+	case srv.config.appendOnly && !wasEnabled:
+		// the rewrite creates the file from the current dataset and
+		// starts appending to it once done
+		if !srv.aofRewriteInProgress {
+			srv.startAppendOnlyRewrite()
+		}
+	case !srv.config.appendOnly && wasEnabled:
+		srv.closeAppendOnlyFile()
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAOFServer returns a test server appending its writes to an AOF with
+// the given appendfsync policy.
+func newTestAOFServer(t *testing.T, fsync string) *serverState {
+	t.Helper()
+	srv := newTestServer(t)
+	srv.config.appendOnly = true
+	srv.config.appendFsync = fsync
+	if err := srv.openAppendOnlyFile(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.mu.Lock()
+		srv.closeAppendOnlyFile()
+		srv.mu.Unlock()
+	})
+	return srv
+}
+
+// reloadAppendOnlyFile loads the AOF of srv into a new server.
+func reloadAppendOnlyFile(t *testing.T, srv *serverState) *serverState {
+	t.Helper()
+	reloaded := newTestServer(t)
+	reloaded.config.dbDir = srv.config.dbDir
+	if err := reloaded.loadAppendOnlyFile(srv.aofFilePath()); err != nil {
+		t.Fatal(err)
+	}
+	return reloaded
+}
+
+// describeStream sums up a stream and its groups, with times to the
+// millisecond as the AOF and RDB files keep them. The seen time of consumers
+// is left out: replaying a claim is an interaction of its own.
+func describeStream(s *stream) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "first %v last %v max deleted %v added %d\n", s.first, s.last, s.maxDeletedID, s.entriesAdded)
+	for _, entry := range s.entries {
+		fmt.Fprintf(&b, "%s %q\n", formatStreamID(entry.id), entry.store)
+	}
+	for _, name := range sortedKeys(s.groups) {
+		group := s.groups[name]
+		fmt.Fprintf(&b, "group %s last %v read %d consumers %q\n", name, group.lastID, group.entriesRead, sortedKeys(group.consumers))
+		for _, id := range sortedPendingIDs(group.pending) {
+			pending := group.pending[id]
+			fmt.Fprintf(&b, "pending %s %s %d %d\n", formatStreamID(id), pending.consumer.name,
+				pending.deliveryCount, pending.deliveryTime.UnixMilli())
+		}
+	}
+	return b.String()
+}
+
+// checkSameKeyspace compares the keyspace of got with the one of want.
+func checkSameKeyspace(t *testing.T, got, want *serverState) {
+	t.Helper()
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	want.mu.Lock()
+	defer want.mu.Unlock()
+	checkKeys(t, "strings", got.store, want.store)
+	checkKeys(t, "lists", got.lists, want.lists)
+	checkKeys(t, "sets", got.sets, want.sets)
+	checkKeys(t, "sorted sets", got.zsets, want.zsets)
+	checkKeys(t, "hashes", got.hashes, want.hashes)
+
+	ttl := func(srv *serverState) map[string]int64 {
+		ms := map[string]int64{}
+		for key, expiration := range srv.ttl {
+			ms[key] = expiration.UnixMilli()
+		}
+		return ms
+	}
+	checkKeys(t, "expiration times", ttl(got), ttl(want))
+
+	describe := func(srv *serverState) map[string]string {
+		streams := map[string]string{}
+		for key, s := range srv.streams {
+			streams[key] = describeStream(s)
+		}
+		return streams
+	}
+	checkKeys(t, "streams", describe(got), describe(want))
+}
+
+// readAppendOnlyCommands returns the commands of the AOF of srv.
+func readAppendOnlyCommands(t *testing.T, srv *serverState) [][]string {
+	t.Helper()
+	file, err := os.Open(srv.aofFilePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var commands [][]string
+	for {
+		cmd, _, err := decodeStringArray(reader)
+		if err != nil {
+			return commands
+		}
+		commands = append(commands, cmd)
+	}
+}
+
+// TestAppendOnlyRoundTrip writes to a server logging to its AOF, reloads it,
+// rewrites it with BGREWRITEAOF and reloads the result, comparing the
+// keyspace every time.
+func TestAppendOnlyRoundTrip(t *testing.T) {
+	srv := newTestAOFServer(t, fsyncEverySec)
+	srv.config.streamMaxDeliveries = 2
+	c := &client{id: 1}
+	for _, cmd := range [][]string{
+		{"SET", "string", "value"},
+		{"SET", "expiring", "value", "EX", "3600"},
+		{"SET", "deleted", "value"},
+		{"DEL", "deleted"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"LPOP", "list"},
+		{"SADD", "set", "x", "y"},
+		{"ZADD", "zset", "1.5", "m", "-2", "n"},
+		{"HSET", "hash", "f", "v", "g", "w"},
+		{"PEXPIREAT", "hash", fmt.Sprint(time.Now().Add(time.Hour).UnixMilli())},
+		{"XADD", "plain", "*", "f", "v"},
+		{"XADD", "plain", "*", "f", "w"},
+		{"XADD", "s", "1-1", "f", "a"},
+		{"XADD", "s", "1-2", "f", "b"},
+		{"XADD", "s", "1-3", "f", "c"},
+		{"XADD", "s", "MAXLEN", "3", "1-4", "f", "d"},
+		{"XGROUP", "CREATE", "s", "g", "0"},
+		{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">"},
+		{"XREADGROUP", "GROUP", "g", "bob", "NOACK", "STREAMS", "s", ">"},
+		{"XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "1"},
+		{"XAUTOCLAIM", "s", "g", "dave", "0", "0"},
+		{"XDEL", "s", "1-3"},
+		{"RESTORE", "restored", "0", dumpValue([]string{"p", "q"})},
+	} {
+		if reply, ok := call(t, srv, c, cmd...).(error); ok {
+			t.Fatalf("%q: %v", cmd, reply)
+		}
+	}
+	if len(srv.streams[deadLetterKey("s")].entries) != 1 {
+		t.Fatal("no entry was dead-lettered")
+	}
+	checkSameKeyspace(t, reloadAppendOnlyFile(t, srv), srv)
+
+	// writes issued during the rewrite are appended to the new file
+	if reply, ok := call(t, srv, c, "BGREWRITEAOF").(error); ok {
+		t.Fatalf("BGREWRITEAOF: %v", reply)
+	}
+	call(t, srv, c, "SET", "during", "rewrite")
+	waitFor(t, 5*time.Second, "the rewrite to finish", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return !srv.aofRewriteInProgress
+	})
+	if !srv.aofLastRewriteOK {
+		t.Fatal("the rewrite failed")
+	}
+	call(t, srv, c, "SET", "after", "rewrite")
+	checkSameKeyspace(t, reloadAppendOnlyFile(t, srv), srv)
+
+	// streams with groups or deleted entries can only be restored whole
+	restored := map[string]bool{}
+	for _, cmd := range readAppendOnlyCommands(t, srv) {
+		switch cmd[0] {
+		case "RESTORE":
+			restored[cmd[1]] = true
+		case "XREADGROUP", "XAUTOCLAIM", "XDEL", "LPOP":
+			t.Errorf("the rewritten AOF replays %q", cmd)
+		}
+	}
+	if !restored["s"] || restored["plain"] {
+		t.Errorf("keys restored by the rewritten AOF: %v, want s but not plain", restored)
+	}
+}
+
+// TestAppendOnlyTruncatedTail loads an AOF whose last command was cut short,
+// as after a crash in the middle of a write.
+func TestAppendOnlyTruncatedTail(t *testing.T) {
+	srv := newTestServer(t)
+	valid := encodeStringArray([]string{"SET", "a", "1"}) + encodeStringArray([]string{"RPUSH", "b", "x"})
+	path := srv.aofFilePath()
+	for _, tail := range []string{
+		"*3\r\n$3\r\nSET\r\n$1\r\nc",
+		"*3\r\n",
+		"*",
+	} {
+		if err := os.WriteFile(path, []byte(valid+tail), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reloaded := reloadAppendOnlyFile(t, srv)
+		if reloaded.store["a"] != "1" || len(reloaded.lists["b"]) != 1 || len(reloaded.store) != 1 {
+			t.Errorf("loading the AOF with tail %q: strings %v, lists %v", tail, reloaded.store, reloaded.lists)
+		}
+		if data, _ := os.ReadFile(path); string(data) != valid {
+			t.Errorf("the AOF with tail %q was truncated to %q", tail, data)
+		}
+	}
+
+	// a corrupt command is not a crash, the file is not truncated
+	corrupt := valid + "*1\r\n:1\r\n" + valid
+	if err := os.WriteFile(path, []byte(corrupt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestServer(t).loadAppendOnlyFile(path); err == nil {
+		t.Error("loading a corrupt AOF succeeded")
+	}
+	if data, _ := os.ReadFile(path); string(data) != corrupt {
+		t.Errorf("the corrupt AOF was truncated to %q", data)
+	}
+}
+
+// TestAppendOnlyFsync checks when writes are synced to the disk under each
+// appendfsync policy.
+func TestAppendOnlyFsync(t *testing.T) {
+	for _, check := range []struct {
+		policy               string
+		afterWrite, afterSec bool // a sync is still pending
+	}{
+		{fsyncAlways, false, false},
+		{fsyncEverySec, true, false},
+		{fsyncNo, true, true},
+	} {
+		srv := newTestAOFServer(t, check.policy)
+		call(t, srv, &client{id: 1}, "SET", "key", "value")
+		srv.mu.Lock()
+		afterWrite := srv.aofPendingFsync
+		srv.checkAppendOnlyFsync()
+		beforeSec := srv.aofPendingFsync
+		// a second later, as the cron sees it
+		srv.aofLastFsync = srv.aofLastFsync.Add(-time.Second)
+		srv.checkAppendOnlyFsync()
+		afterSec := srv.aofPendingFsync
+		srv.mu.Unlock()
+		if afterWrite != check.afterWrite || beforeSec != check.afterWrite || afterSec != check.afterSec {
+			t.Errorf("appendfsync %s: pending fsync after the write %v, a second later %v; want %v, %v",
+				check.policy, afterWrite, afterSec, check.afterWrite, check.afterSec)
+		}
+	}
+}
+
+// TestAppendOnlyRewriteLargeCollections rewrites collections too large for a
+// single command, and a stream left empty, and reloads the result.
+func TestAppendOnlyRewriteLargeCollections(t *testing.T) {
+	srv := newTestAOFServer(t, fsyncEverySec)
+	c := &client{id: 1}
+	const n = 3*aofRewriteItemsPerCmd + 5
+	for i := range n {
+		member := strconv.Itoa(i)
+		for _, cmd := range [][]string{
+			{"RPUSH", "list", member},
+			{"SADD", "set", member},
+			{"ZADD", "zset", member, member},
+			{"HSET", "hash", member, member},
+		} {
+			call(t, srv, c, cmd...)
+		}
+	}
+	// an empty stream outlives its last group
+	call(t, srv, c, "XGROUP", "CREATE", "empty", "g", "$", "MKSTREAM")
+	call(t, srv, c, "XGROUP", "DESTROY", "empty", "g")
+
+	srv.mu.Lock()
+	srv.startAppendOnlyRewrite()
+	srv.mu.Unlock()
+	waitFor(t, 5*time.Second, "the rewrite to finish", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return !srv.aofRewriteInProgress
+	})
+	if !srv.aofLastRewriteOK {
+		t.Fatal("the rewrite failed")
+	}
+
+	commands := map[string]int{}
+	for _, cmd := range readAppendOnlyCommands(t, srv) {
+		commands[cmd[0]+" "+cmd[1]]++
+		if width := map[string]int{"ZADD": 2, "HSET": 2}[cmd[0]]; len(cmd) > 2+aofRewriteItemsPerCmd*max(width, 1) {
+			t.Errorf("%s %s adds %d arguments at once", cmd[0], cmd[1], len(cmd)-2)
+		}
+	}
+	for _, cmd := range []string{"RPUSH list", "SADD set", "ZADD zset", "HSET hash"} {
+		if commands[cmd] != 4 {
+			t.Errorf("the rewritten AOF has %d %s commands, want 4", commands[cmd], cmd)
+		}
+	}
+	if commands["RESTORE empty"] != 1 {
+		t.Error("the rewritten AOF doesn't restore the empty stream")
+	}
+
+	reloaded := reloadAppendOnlyFile(t, srv)
+	checkSameKeyspace(t, reloaded, srv)
+	if len(reloaded.lists["list"]) != n || reloaded.streams["empty"] == nil {
+		t.Errorf("reloaded %d list elements and stream %v", len(reloaded.lists["list"]), reloaded.streams["empty"])
+	}
+}
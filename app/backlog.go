@@ -0,0 +1,55 @@
+package main
+
+// replicationBacklog is a circular buffer holding the tail of the replication
+// stream, so a replica that reconnects can continue from its offset with
+// PSYNC instead of going through a full resynchronization.
+type replicationBacklog struct {
+	buf     []byte
+	idx     int // where the next byte goes
+	histlen int // number of bytes of history held
+}
+
+func newReplicationBacklog(size int) *replicationBacklog {
+	return &replicationBacklog{buf: make([]byte, size)}
+}
+
+func (b *replicationBacklog) feed(data []byte) {
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		data = data[n:]
+	}
+}
+
+// tail returns the last n bytes of history.
+func (b *replicationBacklog) tail(n int) []byte {
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	if start+n <= len(b.buf) {
+		return append([]byte{}, b.buf[start:start+n]...)
+	}
+	return append(append([]byte{}, b.buf[start:]...), b.buf[:b.idx]...)
+}
+
+// firstOffset is the replication offset of the oldest byte held, given the
+// offset of the newest one.
+func (b *replicationBacklog) firstOffset(masterOffset int) int {
+	return masterOffset - b.histlen + 1
+}
+
+// since returns the stream from replication offset from onwards, reporting
+// false when part of it is no longer held.
+func (b *replicationBacklog) since(from, masterOffset int) ([]byte, bool) {
+	missing := masterOffset - from + 1
+	if missing < 0 || missing > b.histlen {
+		return nil, false
+	}
+	return b.tail(missing), true
+}
+
+// resize keeps as much of the most recent history as fits the new size.
+func (b *replicationBacklog) resize(size int) {
+	history := b.tail(min(b.histlen, size))
+	*b = replicationBacklog{buf: make([]byte, size)}
+	b.feed(history)
+}
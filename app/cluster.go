@@ -0,0 +1,959 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// In cluster mode the keyspace is split into 16384 hash slots, each served by
+// one node; commands on keys of a slot served elsewhere are redirected with
+// -MOVED. Nodes talk to each other over the cluster bus, on the client port
+// plus 10000, exchanging PING/PONG messages that carry the slots of the
+// sender and gossip about a few other nodes, so that every node eventually
+// knows the whole cluster. Bus messages are RESP arrays:
+//
+//	type id ip port busport current-epoch config-epoch flags slots
+//	[id ip port busport flags]...
+//
+// where type is MEET, PING or PONG, slots lists ranges like "0-5460,5462"
+// and the trailing groups are the gossip entries.
+
+const (
+	clusterSlots          = 16384
+	clusterBusPortOffset  = 10000
+	clusterPingPeriod     = time.Second
+	clusterConnectRetry   = time.Second
+	clusterGossipCount    = 3
+	clusterMsgHeaderCount = 9
+	clusterGossipFields   = 5
+	clusterLinkQueue      = 16
+)
+
+type clusterNode struct {
+	id          string
+	host        string
+	port        int
+	busPort     int
+	configEpoch int
+	myself      bool
+	handshake   bool // met with CLUSTER MEET, its ID is not known yet
+	created     time.Time
+
+	// failure detection: pfail when it did not answer a PING within the
+	// node timeout, fail once a majority of masters agrees
+	pfail       bool
+	fail        bool
+	failReports map[string]time.Time // reporting node ID -> time of report
+
+	// outbound bus connection, used for PING/MEET
+	link         *clusterLink
+	connecting   bool
+	connectTry   time.Time
+	pingSent     time.Time // zero when no PING is pending
+	pongReceived time.Time
+}
+
+// clusterLink is a bus connection. Messages are queued with srv.mu held and
+// written by a goroutine of the link, so that a peer that stops reading only
+// delays its own messages, never the commands of our clients.
+type clusterLink struct {
+	conn    net.Conn
+	out     chan []byte
+	closed  bool
+	created time.Time
+}
+
+func newClusterLink(conn net.Conn, timeout time.Duration) *clusterLink {
+	link := &clusterLink{conn: conn, out: make(chan []byte, clusterLinkQueue), created: time.Now()}
+	go link.writeMessages(timeout)
+	return link
+}
+
+// writeMessages writes the queued messages until the link is closed. A write
+// that fails or takes longer than timeout closes the connection, which ends
+// serveClusterBus.
+func (link *clusterLink) writeMessages(timeout time.Duration) {
+	for data := range link.out {
+		link.conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := link.conn.Write(data); err != nil {
+			link.conn.Close()
+			return
+		}
+	}
+}
+
+// send queues data. When the queue is full the peer has not been reading for
+// a while: the message is dropped, the missing PONG gets the link closed.
+// Called with srv.mu held.
+func (link *clusterLink) send(data []byte) {
+	if link.closed {
+		return
+	}
+	select {
+	case link.out <- data:
+	default:
+	}
+}
+
+// close must be called with srv.mu held.
+func (link *clusterLink) close() {
+	if !link.closed {
+		link.closed = true
+		close(link.out)
+		link.conn.Close()
+	}
+}
+
+type clusterState struct {
+	myself *clusterNode
+	nodes  map[string]*clusterNode // by ID
+	slots  [clusterSlots]*clusterNode
+	// live resharding, see CLUSTER SETSLOT: the slots we serve that are
+	// moving to another node, and those moving here from another node
+	migratingTo   [clusterSlots]*clusterNode
+	importingFrom [clusterSlots]*clusterNode
+	currentEpoch  int
+	nodeTimeout   time.Duration
+}
+
+// crc16 is CRC-16/XMODEM, the checksum Redis maps keys to slots with.
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// keyHashSlot maps key to its slot. When the key contains a non-empty
+// {hashtag}, only the tag is hashed, so related keys can share a slot.
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (clusterSlots - 1))
+}
+
+func newClusterNode(id, host string, port, busPort int) *clusterNode {
+	return &clusterNode{
+		id:          id,
+		host:        host,
+		port:        port,
+		busPort:     busPort,
+		created:     time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func newClusterState(port int, nodeTimeout time.Duration) *clusterState {
+	myself := newClusterNode(randNodeID(), "", port, port+clusterBusPortOffset)
+	myself.myself = true
+	return &clusterState{
+		myself:      myself,
+		nodes:       map[string]*clusterNode{myself.id: myself},
+		nodeTimeout: nodeTimeout,
+	}
+}
+
+func randNodeID() string {
+	const hex = "0123456789abcdef"
+	id := make([]byte, 40)
+	for i := range id {
+		id[i] = hex[rand.Intn(len(hex))]
+	}
+	return string(id)
+}
+
+func (node *clusterNode) addr() string {
+	return net.JoinHostPort(node.host, strconv.Itoa(node.port))
+}
+
+func (node *clusterNode) flags() string {
+	flags := []string{}
+	if node.myself {
+		flags = append(flags, "myself")
+	}
+	flags = append(flags, "master")
+	switch {
+	case node.fail:
+		flags = append(flags, "fail")
+	case node.pfail:
+		flags = append(flags, "fail?")
+	}
+	if node.handshake {
+		flags = append(flags, "handshake")
+	}
+	return strings.Join(flags, ",")
+}
+
+// slotRanges returns the [start, end] ranges of the slots served by node.
+func (cluster *clusterState) slotRanges(node *clusterNode) [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < clusterSlots; slot++ {
+		if cluster.slots[slot] != node {
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1] == slot-1 {
+			ranges[n-1][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+func formatSlotRanges(ranges [][2]int) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(r[0])
+		if r[1] != r[0] {
+			parts[i] += "-" + strconv.Itoa(r[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseSlotRanges(value string) (*[clusterSlots]bool, error) {
+	var claimed [clusterSlots]bool
+	if value == "" {
+		return &claimed, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+		start, err1 := strconv.Atoi(from)
+		end, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || start < 0 || end >= clusterSlots || start > end {
+			return nil, fmt.Errorf("invalid slot range %q", part)
+		}
+		for slot := start; slot <= end; slot++ {
+			claimed[slot] = true
+		}
+	}
+	return &claimed, nil
+}
+
+// clusterMasterCount counts the masters serving slots, the ones whose votes
+// count to flag a node as failing. Called with srv.mu held.
+func (cluster *clusterState) masterCount() int {
+	owners := map[*clusterNode]bool{}
+	for _, node := range cluster.slots {
+		if node != nil {
+			owners[node] = true
+		}
+	}
+	return len(owners)
+}
+
+func (cluster *clusterState) servesSlots(node *clusterNode) bool {
+	return slices.Contains(cluster.slots[:], node)
+}
+
+// startCluster listens on the cluster bus.
+func (srv *serverState) startCluster() {
+	busPort := srv.cluster.myself.busPort
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", busPort))
+	if err != nil {
+		fmt.Printf("Failed to bind the cluster bus to port %d\n", busPort)
+		return
+	}
+	fmt.Printf("Cluster node %s, bus listening on: %s\n", srv.cluster.myself.id, listener.Addr().String())
+	go srv.acceptClusterBus(listener)
+}
+
+// acceptClusterBus serves the bus connections of other nodes until listener
+// is closed.
+func (srv *serverState) acceptClusterBus(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting cluster bus connection: ", err.Error())
+			return
+		}
+		go srv.serveClusterBus(newClusterLink(conn, srv.cluster.nodeTimeout), nil)
+	}
+}
+
+// serveClusterBus processes the messages received on a bus connection, the
+// inbound ones replying to PING and MEET, until it breaks. node is the node
+// an outbound connection was opened to.
+func (srv *serverState) serveClusterBus(link *clusterLink, node *clusterNode) {
+	reader := bufio.NewReader(link.conn)
+	for {
+		msg, _, err := decodeStringArray(reader)
+		if err == nil && len(msg) < clusterMsgHeaderCount {
+			err = errors.New("short cluster bus message")
+		}
+		if err != nil {
+			break
+		}
+		srv.mu.Lock()
+		if srv.processClusterMessage(link.conn, node, msg) {
+			srv.sendClusterMessage(link, "PONG")
+		}
+		srv.mu.Unlock()
+	}
+
+	srv.mu.Lock()
+	link.close()
+	if node != nil && node.link == link {
+		node.link = nil
+	}
+	srv.mu.Unlock()
+}
+
+// connectClusterNode opens the outbound bus connection to node and greets it
+// with MEET during the handshake, PING otherwise.
+func (srv *serverState) connectClusterNode(node *clusterNode, addr string) {
+	conn, err := net.DialTimeout("tcp", addr, srv.cluster.nodeTimeout)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	node.connecting = false
+	if err != nil {
+		return
+	}
+	if srv.cluster.nodes[node.id] != node || node.link != nil {
+		conn.Close()
+		return
+	}
+	node.link = newClusterLink(conn, srv.cluster.nodeTimeout)
+	msgType := "PING"
+	if node.handshake {
+		msgType = "MEET"
+	}
+	srv.sendClusterMessage(node.link, msgType)
+	// a PING left unanswered on the previous link still counts, or a node
+	// that accepts connections but never replies would never be flagged
+	if node.pingSent.IsZero() {
+		node.pingSent = time.Now()
+	}
+	go srv.serveClusterBus(node.link, node)
+}
+
+// sendClusterMessage queues a message describing the current state of the
+// cluster on link. Called with srv.mu held.
+func (srv *serverState) sendClusterMessage(link *clusterLink, msgType string) {
+	cluster := srv.cluster
+	myself := cluster.myself
+	msg := []string{msgType, myself.id, myself.host, strconv.Itoa(myself.port), strconv.Itoa(myself.busPort),
+		strconv.Itoa(cluster.currentEpoch), strconv.Itoa(myself.configEpoch), myself.flags(),
+		formatSlotRanges(cluster.slotRanges(myself))}
+
+	// gossip about a few random nodes, the failing ones first so that
+	// failure reports spread quickly
+	var gossip []*clusterNode
+	for _, node := range cluster.nodes {
+		if !node.myself && !node.handshake {
+			gossip = append(gossip, node)
+		}
+	}
+	rand.Shuffle(len(gossip), func(i, j int) { gossip[i], gossip[j] = gossip[j], gossip[i] })
+	slices.SortStableFunc(gossip, func(a, b *clusterNode) int { return boolToInt(b.pfail) - boolToInt(a.pfail) })
+	for _, node := range gossip[:min(len(gossip), clusterGossipCount)] {
+		msg = append(msg, node.id, node.host, strconv.Itoa(node.port), strconv.Itoa(node.busPort), node.flags())
+	}
+
+	link.send([]byte(encodeStringArray(msg)))
+}
+
+// processClusterMessage applies what a bus message tells about its sender
+// and the nodes it gossips about, and reports whether a PONG is due. node is
+// the node an outbound connection was opened to, nil for inbound ones. Called
+// with srv.mu held.
+func (srv *serverState) processClusterMessage(conn net.Conn, node *clusterNode, msg []string) bool {
+	cluster := srv.cluster
+	msgType, id, host := msg[0], msg[1], msg[2]
+	port, err1 := strconv.Atoi(msg[3])
+	busPort, err2 := strconv.Atoi(msg[4])
+	currentEpoch, err3 := strconv.Atoi(msg[5])
+	configEpoch, err4 := strconv.Atoi(msg[6])
+	claimed, err5 := parseSlotRanges(msg[8])
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil || (len(msg)-clusterMsgHeaderCount)%clusterGossipFields != 0 {
+		fmt.Println("Invalid cluster bus message:", msg)
+		return false
+	}
+	if host == "" {
+		host, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	if cluster.myself.host == "" {
+		// the address others reach us at
+		cluster.myself.host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	if currentEpoch > cluster.currentEpoch {
+		cluster.currentEpoch = currentEpoch
+	}
+
+	sender := cluster.nodes[id]
+	if node != nil && node.handshake && msgType == "PONG" {
+		// the node we met tells us its ID
+		delete(cluster.nodes, node.id)
+		if sender != nil {
+			node.link.close()
+			return false
+		}
+		node.id, node.handshake = id, false
+		cluster.nodes[id] = node
+		sender = node
+		fmt.Printf("Cluster handshake with %s completed\n", id)
+	}
+	if sender == nil {
+		if msgType != "MEET" {
+			return false
+		}
+		sender = newClusterNode(id, host, port, busPort)
+		cluster.nodes[id] = sender
+		fmt.Printf("Cluster node %s met us from %s\n", id, net.JoinHostPort(host, msg[3]))
+	}
+	if sender.myself {
+		return false
+	}
+
+	sender.host, sender.port, sender.busPort = host, port, busPort
+	if msgType == "PONG" {
+		sender.pongReceived, sender.pingSent = time.Now(), time.Time{}
+		if sender.pfail || sender.fail {
+			fmt.Printf("Cluster node %s is reachable again\n", sender.id)
+		}
+		sender.pfail, sender.fail = false, false
+		clear(sender.failReports)
+	}
+	sender.configEpoch = configEpoch
+	srv.updateClusterSlots(sender, claimed)
+
+	// two masters with the same config epoch: the one with the greater ID
+	// moves to a new epoch, so that slot conflicts always have a winner
+	if configEpoch == cluster.myself.configEpoch && id < cluster.myself.id {
+		cluster.currentEpoch++
+		cluster.myself.configEpoch = cluster.currentEpoch
+	}
+
+	for i := clusterMsgHeaderCount; i < len(msg); i += clusterGossipFields {
+		srv.processClusterGossip(sender, msg[i:i+clusterGossipFields])
+	}
+	return msgType == "PING" || msgType == "MEET"
+}
+
+// updateClusterSlots gives sender the slots it claims unless a node with a
+// newer configuration serves them, and frees those it no longer claims.
+// Called with srv.mu held.
+func (srv *serverState) updateClusterSlots(sender *clusterNode, claimed *[clusterSlots]bool) {
+	cluster := srv.cluster
+	for slot := range clusterSlots {
+		owner := cluster.slots[slot]
+		switch {
+		case claimed[slot] && owner != sender && (owner == nil || owner.configEpoch < sender.configEpoch):
+			if owner == cluster.myself {
+				fmt.Printf("Slot %d is now served by %s\n", slot, sender.id)
+				cluster.migratingTo[slot] = nil
+			}
+			cluster.slots[slot] = sender
+		case !claimed[slot] && owner == sender:
+			cluster.slots[slot] = nil
+		}
+	}
+}
+
+// processClusterGossip learns about nodes we did not know, and records the
+// failure reports of sender. Called with srv.mu held.
+func (srv *serverState) processClusterGossip(sender *clusterNode, entry []string) {
+	cluster := srv.cluster
+	id, host, flags := entry[0], entry[1], strings.Split(entry[4], ",")
+	port, err1 := strconv.Atoi(entry[2])
+	busPort, err2 := strconv.Atoi(entry[3])
+	if err1 != nil || err2 != nil || host == "" {
+		return
+	}
+
+	node := cluster.nodes[id]
+	if node == nil {
+		node = newClusterNode(id, host, port, busPort)
+		cluster.nodes[id] = node
+		fmt.Printf("Cluster node %s learned from %s\n", id, sender.id)
+		return
+	}
+	if node.myself || !cluster.servesSlots(sender) {
+		return
+	}
+	switch {
+	case slices.Contains(flags, "fail"):
+		if !node.fail {
+			fmt.Printf("Cluster node %s failing according to %s\n", id, sender.id)
+		}
+		node.pfail, node.fail = true, true
+	case slices.Contains(flags, "fail?"):
+		node.failReports[sender.id] = time.Now()
+	default:
+		delete(node.failReports, sender.id)
+	}
+}
+
+// clusterCron keeps a bus connection to every node, pings them and updates
+// their failure state. Called with srv.mu held.
+func (srv *serverState) clusterCron() {
+	cluster := srv.cluster
+	now := time.Now()
+	for _, node := range cluster.nodes {
+		if node.myself {
+			continue
+		}
+		if node.handshake && now.Sub(node.created) > cluster.nodeTimeout {
+			fmt.Printf("Cluster handshake with %s timed out\n", net.JoinHostPort(node.host, strconv.Itoa(node.busPort)))
+			delete(cluster.nodes, node.id)
+			continue
+		}
+
+		if node.link == nil && !node.connecting && now.Sub(node.connectTry) >= clusterConnectRetry {
+			node.connecting, node.connectTry = true, now
+			go srv.connectClusterNode(node, net.JoinHostPort(node.host, strconv.Itoa(node.busPort)))
+		}
+		if node.link != nil && node.pingSent.IsZero() && now.Sub(node.pongReceived) >= clusterPingPeriod {
+			srv.sendClusterMessage(node.link, "PING")
+			node.pingSent = now
+		}
+
+		// no PONG for half the timeout: try with a fresh connection, once
+		// this one had as long to get it
+		if node.link != nil && !node.pingSent.IsZero() && now.Sub(node.pingSent) > cluster.nodeTimeout/2 &&
+			now.Sub(node.link.created) > cluster.nodeTimeout/2 {
+			node.link.close()
+			node.link = nil
+		}
+		waiting := node.pingSent
+		if waiting.IsZero() && node.link == nil {
+			waiting = node.pongReceived
+		}
+		if !node.pfail && !node.handshake && !waiting.IsZero() && now.Sub(waiting) > cluster.nodeTimeout {
+			fmt.Printf("Cluster node %s possibly failing\n", node.id)
+			node.pfail = true
+		}
+		srv.checkClusterNodeFailure(node)
+	}
+}
+
+// checkClusterNodeFailure flags a possibly failing node as failing once a
+// majority of the masters serving slots reported it recently. Called with
+// srv.mu held.
+func (srv *serverState) checkClusterNodeFailure(node *clusterNode) {
+	cluster := srv.cluster
+	if !node.pfail || node.fail {
+		return
+	}
+	reports := 0
+	for reporter, at := range node.failReports {
+		if time.Since(at) > 2*cluster.nodeTimeout {
+			delete(node.failReports, reporter)
+			continue
+		}
+		reports++
+	}
+	if cluster.servesSlots(cluster.myself) {
+		reports++
+	}
+	if reports >= cluster.masterCount()/2+1 {
+		fmt.Printf("Cluster node %s marked as failing (%d reports)\n", node.id, reports)
+		node.fail = true
+	}
+}
+
+var (
+	errClusterDisabled = errors.New("This instance has cluster support disabled")
+	errCrossSlot       = codedError{"CROSSSLOT", "Keys in request don't hash to the same slot"}
+	errClusterDown     = codedError{"CLUSTERDOWN", "Hash slot not served"}
+	errInvalidSlot     = errors.New("Invalid or out of range slot")
+	errTryAgain        = codedError{"TRYAGAIN", "Multiple keys request during rehashing of slot"}
+)
+
+// checkClusterSlot redirects a command whose keys are in a slot served by
+// another node. While a slot migrates, the keys already moved are asked for
+// on the target with -ASK, which serves them after an ASKING. Called with
+// srv.mu held.
+func (srv *serverState) checkClusterSlot(c *client, command *command, cmd []string) error {
+	cluster := srv.cluster
+	asking := c.asking || command.flags&flagAsking != 0
+	if command.name != "asking" {
+		c.asking = false
+	}
+
+	slot, existing, missing := -1, 0, 0
+	for _, key := range command.keys(cmd) {
+		keySlot := keyHashSlot(key)
+		if slot >= 0 && keySlot != slot {
+			return errCrossSlot
+		}
+		slot = keySlot
+		if srv.keyExists(key) && !srv.isExpired(key) {
+			existing++
+		} else {
+			missing++
+		}
+	}
+	if slot < 0 {
+		return nil
+	}
+
+	owner := cluster.slots[slot]
+	migrating := owner == cluster.myself && cluster.migratingTo[slot] != nil
+	importing := cluster.importingFrom[slot] != nil
+	switch {
+	case owner == nil && !importing:
+		return errClusterDown
+	case command.name == "migrate" && (migrating || importing):
+		return nil
+	case migrating && missing > 0:
+		if existing > 0 {
+			return errTryAgain
+		}
+		return codedError{"ASK", fmt.Sprintf("%d %s", slot, cluster.migratingTo[slot].addr())}
+	case importing && asking:
+		if existing > 0 && missing > 0 {
+			return errTryAgain
+		}
+		return nil
+	case owner == nil:
+		return errClusterDown
+	case !owner.myself:
+		return codedError{"MOVED", fmt.Sprintf("%d %s", slot, owner.addr())}
+	}
+	return nil
+}
+
+// keysInSlot returns up to count keys of slot, all of them when count is
+// negative.
+func (srv *serverState) keysInSlot(slot, count int) []string {
+	keys := []string{}
+	for _, key := range srv.allKeys() {
+		if count >= 0 && len(keys) == count {
+			break
+		}
+		if keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// broadcastClusterPong tells every node about a configuration change now
+// rather than in reply to their next PING. Called with srv.mu held.
+func (srv *serverState) broadcastClusterPong() {
+	for _, node := range srv.cluster.nodes {
+		if node.link != nil && !node.handshake {
+			srv.sendClusterMessage(node.link, "PONG")
+		}
+	}
+}
+
+func (srv *serverState) handleAsking(c *client, cmd []string) string {
+	if srv.cluster == nil {
+		return encodeError(errClusterDisabled)
+	}
+	c.asking = true
+	return "+OK\r\n"
+}
+
+func (srv *serverState) infoCluster() string {
+	return fmt.Sprintf("# Cluster\r\ncluster_enabled:%d\r\n", boolToInt(srv.cluster != nil))
+}
+
+func parseSlot(value string) (int, error) {
+	slot, err := strconv.Atoi(value)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, errInvalidSlot
+	}
+	return slot, nil
+}
+
+func (srv *serverState) handleCluster(c *client, cmd []string) string {
+	cluster := srv.cluster
+	if cluster == nil {
+		return encodeError(errClusterDisabled)
+	}
+
+	switch sub := strings.ToUpper(cmd[1]); sub {
+	case "MYID":
+		return encodeBulkString(cluster.myself.id)
+
+	case "KEYSLOT":
+		if len(cmd) != 3 {
+			return encodeError(errWrongArgs("cluster|keyslot"))
+		}
+		return encodeInteger(keyHashSlot(cmd[2]))
+
+	case "COUNTKEYSINSLOT":
+		if len(cmd) != 3 {
+			return encodeError(errWrongArgs("cluster|countkeysinslot"))
+		}
+		slot, err := parseSlot(cmd[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		return encodeInteger(len(srv.keysInSlot(slot, -1)))
+
+	case "GETKEYSINSLOT":
+		if len(cmd) != 4 {
+			return encodeError(errWrongArgs("cluster|getkeysinslot"))
+		}
+		slot, err := parseSlot(cmd[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		count, err := strconv.Atoi(cmd[3])
+		if err != nil || count < 0 {
+			return encodeError(errors.New("Invalid number of keys"))
+		}
+		return encodeStringArray(srv.keysInSlot(slot, count))
+
+	case "SETSLOT":
+		if len(cmd) < 4 {
+			return encodeError(errWrongArgs("cluster|setslot"))
+		}
+		slot, err := parseSlot(cmd[2])
+		if err != nil {
+			return encodeError(err)
+		}
+		action := strings.ToUpper(cmd[3])
+		if action == "STABLE" {
+			cluster.migratingTo[slot], cluster.importingFrom[slot] = nil, nil
+			return "+OK\r\n"
+		}
+		if len(cmd) != 5 {
+			return encodeError(errSyntax)
+		}
+		node := cluster.nodes[cmd[4]]
+		if node == nil || node.handshake {
+			return encodeError(fmt.Errorf("I don't know about node %s", cmd[4]))
+		}
+		switch action {
+		case "MIGRATING":
+			if cluster.slots[slot] != cluster.myself {
+				return encodeError(fmt.Errorf("I'm not the owner of hash slot %d", slot))
+			}
+			if node.myself {
+				return encodeError(errors.New("Can't MIGRATE to myself"))
+			}
+			cluster.migratingTo[slot] = node
+		case "IMPORTING":
+			if cluster.slots[slot] == cluster.myself {
+				return encodeError(fmt.Errorf("I'm already the owner of hash slot %d", slot))
+			}
+			if node.myself {
+				return encodeError(errors.New("Can't IMPORT from myself"))
+			}
+			cluster.importingFrom[slot] = node
+		case "NODE":
+			if cluster.slots[slot] == cluster.myself && !node.myself && len(srv.keysInSlot(slot, 1)) > 0 {
+				return encodeError(fmt.Errorf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			}
+			if !node.myself {
+				cluster.migratingTo[slot] = nil
+			}
+			if node.myself && cluster.importingFrom[slot] != nil {
+				// the import is complete: claim the slot with a new config
+				// epoch so that our claim beats the one of the former owner
+				cluster.importingFrom[slot] = nil
+				cluster.currentEpoch++
+				cluster.myself.configEpoch = cluster.currentEpoch
+				fmt.Printf("Slot %d imported, config epoch is now %d\n", slot, cluster.myself.configEpoch)
+			}
+			cluster.slots[slot] = node
+			srv.broadcastClusterPong()
+		default:
+			return encodeError(errSyntax)
+		}
+		return "+OK\r\n"
+
+	case "ADDSLOTS", "ADDSLOTSRANGE", "DELSLOTS", "DELSLOTSRANGE":
+		ranged := strings.HasSuffix(sub, "RANGE")
+		if len(cmd) < 3 || (ranged && len(cmd)%2 != 0) {
+			return encodeError(errWrongArgs("cluster|" + strings.ToLower(sub)))
+		}
+		var slots []int
+		for i := 2; i < len(cmd); i++ {
+			start, err := parseSlot(cmd[i])
+			if err != nil {
+				return encodeError(err)
+			}
+			end := start
+			if ranged {
+				i++
+				if end, err = parseSlot(cmd[i]); err != nil {
+					return encodeError(err)
+				}
+				if end < start {
+					return encodeError(fmt.Errorf("start slot number %d is greater than end slot number %d", start, end))
+				}
+			}
+			for slot := start; slot <= end; slot++ {
+				slots = append(slots, slot)
+			}
+		}
+		adding := strings.HasPrefix(sub, "ADD")
+		for _, slot := range slots {
+			switch owner := cluster.slots[slot]; {
+			case adding && owner != nil:
+				return encodeError(fmt.Errorf("Slot %d is already busy", slot))
+			case !adding && owner == nil:
+				return encodeError(fmt.Errorf("Slot %d is already unassigned", slot))
+			}
+		}
+		for _, slot := range slots {
+			if adding {
+				cluster.slots[slot] = cluster.myself
+			} else {
+				cluster.slots[slot] = nil
+			}
+		}
+		return "+OK\r\n"
+
+	case "MEET":
+		if len(cmd) != 4 && len(cmd) != 5 {
+			return encodeError(errWrongArgs("cluster|meet"))
+		}
+		port, err := strconv.Atoi(cmd[3])
+		busPort := port + clusterBusPortOffset
+		if err == nil && len(cmd) == 5 {
+			busPort, err = strconv.Atoi(cmd[4])
+		}
+		if err != nil || port < 1 || port > 65535 || busPort < 1 || busPort > 65535 || net.ParseIP(cmd[2]) == nil {
+			return encodeError(fmt.Errorf("Invalid node address specified: %s:%s", cmd[2], cmd[3]))
+		}
+		// the node gets its real ID once it answers, see processClusterMessage
+		node := newClusterNode(randNodeID(), cmd[2], port, busPort)
+		node.handshake = true
+		cluster.nodes[node.id] = node
+		return "+OK\r\n"
+
+	case "NODES":
+		ids := make([]string, 0, len(cluster.nodes))
+		for id := range cluster.nodes {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		var lines strings.Builder
+		for _, id := range ids {
+			node := cluster.nodes[id]
+			linkState := "disconnected"
+			if node.myself || node.link != nil {
+				linkState = "connected"
+			}
+			fmt.Fprintf(&lines, "%s %s@%d %s - %d %d %d %s", node.id, node.addr(), node.busPort, node.flags(),
+				unixMilliOrZero(node.pingSent), unixMilliOrZero(node.pongReceived), node.configEpoch, linkState)
+			if ranges := formatSlotRanges(cluster.slotRanges(node)); ranges != "" {
+				lines.WriteString(" " + strings.ReplaceAll(ranges, ",", " "))
+			}
+			if node.myself {
+				for slot := range clusterSlots {
+					if to := cluster.migratingTo[slot]; to != nil {
+						fmt.Fprintf(&lines, " [%d->-%s]", slot, to.id)
+					}
+					if from := cluster.importingFrom[slot]; from != nil {
+						fmt.Fprintf(&lines, " [%d-<-%s]", slot, from.id)
+					}
+				}
+			}
+			lines.WriteString("\n")
+		}
+		return encodeBulkString(lines.String())
+
+	case "SLOTS":
+		var entries []string
+		for slot := 0; slot < clusterSlots; {
+			owner := cluster.slots[slot]
+			end := slot
+			for end+1 < clusterSlots && cluster.slots[end+1] == owner {
+				end++
+			}
+			if owner != nil {
+				entries = append(entries, encodeArray([]string{
+					encodeInteger(slot),
+					encodeInteger(end),
+					encodeArray([]string{encodeBulkString(owner.host), encodeInteger(owner.port), encodeBulkString(owner.id)}),
+				}))
+			}
+			slot = end + 1
+		}
+		return encodeArray(entries)
+
+	case "SHARDS":
+		var shards []string
+		for _, node := range cluster.nodes {
+			if node.handshake {
+				continue
+			}
+			var slots []string
+			for _, r := range cluster.slotRanges(node) {
+				slots = append(slots, encodeInteger(r[0]), encodeInteger(r[1]))
+			}
+			health := "online"
+			if node.fail || node.pfail {
+				health = "fail"
+			}
+			// the bus doesn't carry replication offsets, so only ours is known
+			offset := 0
+			if node.myself {
+				offset = srv.config.replOffset
+			}
+			shards = append(shards, encodeArray([]string{
+				encodeBulkString("slots"), encodeArray(slots),
+				encodeBulkString("nodes"), encodeArray([]string{encodeArray([]string{
+					encodeBulkString("id"), encodeBulkString(node.id),
+					encodeBulkString("port"), encodeInteger(node.port),
+					encodeBulkString("ip"), encodeBulkString(node.host),
+					encodeBulkString("endpoint"), encodeBulkString(node.host),
+					encodeBulkString("role"), encodeBulkString("master"),
+					encodeBulkString("replication-offset"), encodeInteger(offset),
+					encodeBulkString("health"), encodeBulkString(health),
+				})}),
+			}))
+		}
+		return encodeArray(shards)
+
+	case "INFO":
+		assigned := 0
+		for _, owner := range cluster.slots {
+			if owner != nil {
+				assigned++
+			}
+		}
+		state := "ok"
+		if assigned < clusterSlots {
+			state = "fail"
+		}
+		return encodeBulkString(fmt.Sprintf("cluster_enabled:1\r\ncluster_state:%s\r\ncluster_slots_assigned:%d\r\ncluster_known_nodes:%d\r\ncluster_size:%d\r\ncluster_current_epoch:%d\r\ncluster_my_epoch:%d\r\n",
+			state, assigned, len(cluster.nodes), cluster.masterCount(), cluster.currentEpoch, cluster.myself.configEpoch))
+	}
+	return encodeError(fmt.Errorf("unknown subcommand '%s'. Try CLUSTER HELP.", cmd[1]))
+}
+
+func unixMilliOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClusterNode serves a cluster node on random ports of the loopback
+// interface, running clusterCron as the server would, until the test ends.
+func newTestClusterNode(t *testing.T, nodeTimeout time.Duration) *serverState {
+	t.Helper()
+	srv := newTestServer(t)
+	port, _ := serveTestServer(t, srv)
+	bus := listenLoopback(t)
+	srv.cluster = newClusterState(port, nodeTimeout)
+	srv.cluster.myself.busPort = bus.Addr().(*net.TCPAddr).Port
+	go srv.acceptClusterBus(bus)
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				srv.mu.Lock()
+				srv.clusterCron()
+				srv.mu.Unlock()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		bus.Close()
+		srv.mu.Lock()
+		for _, node := range srv.cluster.nodes {
+			if node.link != nil {
+				node.link.close()
+			}
+		}
+		srv.mu.Unlock()
+	})
+	return srv
+}
+
+// clusterNodeFlags returns the flags of every node srv knows, by ID, as
+// CLUSTER NODES lists them.
+func clusterNodeFlags(t *testing.T, srv *serverState) map[string]string {
+	t.Helper()
+	nodes, _ := call(t, srv, &client{id: 1}, "CLUSTER", "NODES").(string)
+	flags := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(nodes), "\n") {
+		if fields := strings.Fields(line); len(fields) > 2 {
+			flags[fields[0]] = fields[2]
+		}
+	}
+	return flags
+}
+
+// startTestCluster runs three nodes serving a third of the slots each. The
+// first one meets the others, which learn about each other from its gossip.
+func startTestCluster(t *testing.T, nodeTimeout time.Duration) []*serverState {
+	t.Helper()
+	nodes := []*serverState{
+		newTestClusterNode(t, nodeTimeout),
+		newTestClusterNode(t, nodeTimeout),
+		newTestClusterNode(t, nodeTimeout),
+	}
+	c := &client{id: 1}
+	for i, srv := range nodes {
+		first, last := i*clusterSlots/3, (i+1)*clusterSlots/3-1
+		if reply := call(t, srv, c, "CLUSTER", "ADDSLOTSRANGE", strconv.Itoa(first), strconv.Itoa(last)); reply != "OK" {
+			t.Fatalf("CLUSTER ADDSLOTSRANGE on node %d: %v", i, reply)
+		}
+	}
+	for _, other := range nodes[1:] {
+		myself := other.cluster.myself
+		if reply := call(t, nodes[0], c, "CLUSTER", "MEET", "127.0.0.1", strconv.Itoa(myself.port), strconv.Itoa(myself.busPort)); reply != "OK" {
+			t.Fatalf("CLUSTER MEET: %v", reply)
+		}
+	}
+
+	for _, srv := range nodes {
+		waitFor(t, 10*time.Second, "every node to know the others", func() bool {
+			flags := clusterNodeFlags(t, srv)
+			for _, other := range nodes {
+				if f, ok := flags[other.cluster.myself.id]; !ok || strings.Contains(f, "handshake") {
+					return false
+				}
+			}
+			return len(flags) == len(nodes)
+		})
+		waitFor(t, 10*time.Second, "every node to know the slots of the others", func() bool {
+			info, _ := call(t, srv, c, "CLUSTER", "INFO").(string)
+			return strings.Contains(info, "cluster_state:ok\r\n")
+		})
+	}
+	return nodes
+}
+
+// TestClusterMeet builds a cluster with CLUSTER MEET and checks that every
+// node redirects the keys served by the others.
+func TestClusterMeet(t *testing.T) {
+	nodes := startTestCluster(t, 5*time.Second)
+	c := &client{id: 1}
+	key := "key"
+	slot := keyHashSlot(key)
+	owner := nodes[slot*3/clusterSlots]
+	ownerAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(owner.cluster.myself.port))
+
+	for i, srv := range nodes {
+		if srv == owner {
+			if reply := call(t, srv, c, "SET", key, "value"); reply != "OK" {
+				t.Errorf("SET on the owner of slot %d = %v", slot, reply)
+			}
+			continue
+		}
+		want := "MOVED " + strconv.Itoa(slot) + " " + ownerAddr
+		if reply, _ := call(t, srv, c, "GET", key).(error); reply == nil || reply.Error() != want {
+			t.Errorf("GET on node %d = %v, want %s", i, reply, want)
+		}
+	}
+}
+
+// TestClusterFailureDetection hangs a node and checks that the others,
+// exchanging their failure reports, agree that it is failing.
+func TestClusterFailureDetection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes a few seconds of cluster timers")
+	}
+	nodes := startTestCluster(t, 500*time.Millisecond)
+	hung := nodes[2]
+	hungID := hung.cluster.myself.id
+
+	// holding the lock, the node can't answer any message
+	hung.mu.Lock()
+	t.Cleanup(hung.mu.Unlock)
+	for _, srv := range nodes[:2] {
+		waitFor(t, 10*time.Second, "the hung node to be flagged as failing", func() bool {
+			return strings.HasSuffix(clusterNodeFlags(t, srv)[hungID], ",fail")
+		})
+	}
+}
+
+// TestClusterShards checks that CLUSTER SHARDS lists every node with its
+// slots, and its replication offset only for the node answering.
+func TestClusterShards(t *testing.T) {
+	nodes := startTestCluster(t, 5*time.Second)
+	srv := nodes[0]
+	srv.mu.Lock()
+	srv.config.replOffset = 42
+	srv.mu.Unlock()
+
+	shards, _ := call(t, srv, &client{id: 1}, "CLUSTER", "SHARDS").([]any)
+	if len(shards) != len(nodes) {
+		t.Fatalf("CLUSTER SHARDS = %v, want %d shards", shards, len(nodes))
+	}
+	offsets := make(map[string]any)
+	for _, shard := range shards {
+		fields, _ := shard.([]any)
+		shardNodes, _ := fields[3].([]any)
+		for _, node := range shardNodes {
+			info := make(map[string]any)
+			pairs, _ := node.([]any)
+			for i := 0; i+1 < len(pairs); i += 2 {
+				info[pairs[i].(string)] = pairs[i+1]
+			}
+			offsets[info["id"].(string)] = info["replication-offset"]
+		}
+	}
+	for i, other := range nodes {
+		want := 0
+		if other == srv {
+			want = 42
+		}
+		if got := offsets[other.cluster.myself.id]; got != want {
+			t.Errorf("replication-offset of node %d = %v, want %d", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Lists, sets, sorted sets and hashes. Only the basic commands are provided,
+// enough to restore and inspect datasets loaded from RDB files.
+
+// normalizeRange converts a start/stop pair that may count from the end into
+// absolute indexes, reporting false when the range is empty.
+func normalizeRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	return start, stop, start <= stop
+}
+
+func parseRange(cmd []string) (start, stop int, err error) {
+	if start, err = strconv.Atoi(cmd[2]); err != nil {
+		return 0, 0, errNotInteger
+	}
+	if stop, err = strconv.Atoi(cmd[3]); err != nil {
+		return 0, 0, errNotInteger
+	}
+	return
+}
+
+// lookupList returns the list at key, reporting false if the key holds
+// another type.
+func (srv *serverState) lookupList(key string) ([]string, bool) {
+	if srv.expireIfNeeded(key) {
+		return nil, true
+	}
+	list, ok := srv.lists[key]
+	return list, ok || !srv.keyExists(key)
+}
+
+func (srv *serverState) handlePush(c *client, cmd []string) string {
+	key := cmd[1]
+	list, ok := srv.lookupList(key)
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	left := strings.ToLower(cmd[0]) == "lpush"
+	for _, element := range cmd[2:] {
+		if left {
+			list = append([]string{element}, list...)
+		} else {
+			list = append(list, element)
+		}
+	}
+	srv.lists[key] = list
+	srv.dirty++
+	return encodeInteger(len(list))
+}
+
+func (srv *serverState) handlePop(c *client, cmd []string) string {
+	key := cmd[1]
+	list, ok := srv.lookupList(key)
+	if !ok {
+		return encodeError(errWrongType)
+	}
+
+	count := 1
+	if len(cmd) == 3 {
+		var err error
+		if count, err = strconv.Atoi(cmd[2]); err != nil || count < 0 {
+			return encodeError(errNotInteger)
+		}
+	}
+	if len(list) == 0 {
+		if len(cmd) == 3 {
+			return encodeNullArray()
+		}
+		return encodeNullBulkString()
+	}
+
+	count = min(count, len(list))
+	var popped []string
+	if strings.ToLower(cmd[0]) == "lpop" {
+		popped = slices.Clone(list[:count])
+		list = list[count:]
+	} else {
+		popped = slices.Clone(list[len(list)-count:])
+		slices.Reverse(popped)
+		list = list[:len(list)-count]
+	}
+	if len(list) == 0 {
+		delete(srv.lists, key)
+		delete(srv.ttl, key)
+	} else {
+		srv.lists[key] = list
+	}
+	srv.dirty++
+
+	if len(cmd) == 3 {
+		return encodeStringArray(popped)
+	}
+	return encodeBulkString(popped[0])
+}
+
+func (srv *serverState) handleLrange(c *client, cmd []string) string {
+	list, ok := srv.lookupList(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	start, stop, err := parseRange(cmd)
+	if err != nil {
+		return encodeError(err)
+	}
+	start, stop, ok = normalizeRange(start, stop, len(list))
+	if !ok {
+		return encodeStringArray(nil)
+	}
+	return encodeStringArray(list[start : stop+1])
+}
+
+func (srv *serverState) handleLlen(c *client, cmd []string) string {
+	list, ok := srv.lookupList(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	return encodeInteger(len(list))
+}
+
+func (srv *serverState) lookupSet(key string) (map[string]struct{}, bool) {
+	if srv.expireIfNeeded(key) {
+		return nil, true
+	}
+	set, ok := srv.sets[key]
+	return set, ok || !srv.keyExists(key)
+}
+
+func (srv *serverState) handleSadd(c *client, cmd []string) string {
+	key := cmd[1]
+	set, ok := srv.lookupSet(key)
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	if set == nil {
+		set = make(map[string]struct{})
+		srv.sets[key] = set
+	}
+	added := 0
+	for _, member := range cmd[2:] {
+		if _, exists := set[member]; !exists {
+			set[member] = struct{}{}
+			added++
+		}
+	}
+	srv.dirty += added
+	return encodeInteger(added)
+}
+
+func (srv *serverState) handleSmembers(c *client, cmd []string) string {
+	set, ok := srv.lookupSet(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	slices.Sort(members)
+	return encodeStringArray(members)
+}
+
+func (srv *serverState) lookupZset(key string) (map[string]float64, bool) {
+	if srv.expireIfNeeded(key) {
+		return nil, true
+	}
+	zset, ok := srv.zsets[key]
+	return zset, ok || !srv.keyExists(key)
+}
+
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func (srv *serverState) handleZadd(c *client, cmd []string) string {
+	key := cmd[1]
+	if len(cmd)%2 != 0 {
+		return encodeError(errSyntax)
+	}
+	zset, ok := srv.lookupZset(key)
+	if !ok {
+		return encodeError(errWrongType)
+	}
+
+	scores := make([]float64, 0, len(cmd)/2-1)
+	for i := 2; i < len(cmd); i += 2 {
+		score, err := strconv.ParseFloat(cmd[i], 64)
+		if err != nil || math.IsNaN(score) {
+			return encodeError(errNotFloat)
+		}
+		scores = append(scores, score)
+	}
+
+	if zset == nil {
+		zset = make(map[string]float64)
+		srv.zsets[key] = zset
+	}
+	added := 0
+	for i, score := range scores {
+		member := cmd[3+2*i]
+		old, exists := zset[member]
+		if !exists {
+			added++
+		}
+		if !exists || old != score {
+			zset[member] = score
+			srv.dirty++
+		}
+	}
+	return encodeInteger(added)
+}
+
+// sortedMembers orders the members of a sorted set by score, then member.
+func sortedMembers(zset map[string]float64) []string {
+	members := make([]string, 0, len(zset))
+	for member := range zset {
+		members = append(members, member)
+	}
+	slices.SortFunc(members, func(a, b string) int {
+		if c := cmp.Compare(zset[a], zset[b]); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return members
+}
+
+func (srv *serverState) handleZrange(c *client, cmd []string) string {
+	withScores := false
+	if len(cmd) == 5 {
+		if strings.ToUpper(cmd[4]) != "WITHSCORES" {
+			return encodeError(errSyntax)
+		}
+		withScores = true
+	}
+	zset, ok := srv.lookupZset(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	start, stop, err := parseRange(cmd)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	members := sortedMembers(zset)
+	result := []string{}
+	if start, stop, ok := normalizeRange(start, stop, len(members)); ok {
+		for _, member := range members[start : stop+1] {
+			result = append(result, member)
+			if withScores {
+				result = append(result, formatScore(zset[member]))
+			}
+		}
+	}
+	return encodeStringArray(result)
+}
+
+func (srv *serverState) handleZscore(c *client, cmd []string) string {
+	zset, ok := srv.lookupZset(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	score, exists := zset[cmd[2]]
+	if !exists {
+		return encodeNullBulkString()
+	}
+	return encodeBulkString(formatScore(score))
+}
+
+func (srv *serverState) lookupHash(key string) (map[string]string, bool) {
+	if srv.expireIfNeeded(key) {
+		return nil, true
+	}
+	hash, ok := srv.hashes[key]
+	return hash, ok || !srv.keyExists(key)
+}
+
+func (srv *serverState) handleHset(c *client, cmd []string) string {
+	key := cmd[1]
+	if len(cmd)%2 != 0 {
+		return encodeError(errWrongArgs(cmd[0]))
+	}
+	hash, ok := srv.lookupHash(key)
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	if hash == nil {
+		hash = make(map[string]string)
+		srv.hashes[key] = hash
+	}
+	added := 0
+	for i := 2; i < len(cmd); i += 2 {
+		if _, exists := hash[cmd[i]]; !exists {
+			added++
+		}
+		hash[cmd[i]] = cmd[i+1]
+	}
+	srv.dirty++
+	return encodeInteger(added)
+}
+
+func (srv *serverState) handleHget(c *client, cmd []string) string {
+	hash, ok := srv.lookupHash(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	value, exists := hash[cmd[2]]
+	if !exists {
+		return encodeNullBulkString()
+	}
+	return encodeBulkString(value)
+}
+
+func (srv *serverState) handleHgetall(c *client, cmd []string) string {
+	hash, ok := srv.lookupHash(cmd[1])
+	if !ok {
+		return encodeError(errWrongType)
+	}
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	result := make([]string, 0, 2*len(hash))
+	for _, field := range fields {
+		result = append(result, field, hash[field])
+	}
+	return encodeStringArray(result)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type commandFlag int
+
+const (
+	flagWrite commandFlag = 1 << iota
+	flagReadonly
+	flagAdmin
+	flagBlocking
+	flagFast
+	flagMovableKeys
+	flagAsking
+)
+
+var commandFlagNames = []struct {
+	flag commandFlag
+	name string
+}{
+	{flagWrite, "write"},
+	{flagReadonly, "readonly"},
+	{flagAdmin, "admin"},
+	{flagBlocking, "blocking"},
+	{flagFast, "fast"},
+	{flagMovableKeys, "movablekeys"},
+	{flagAsking, "asking"},
+}
+
+type commandHandler func(srv *serverState, c *client, cmd []string) string
+
+// command describes an entry of the command table. Arity counts the command
+// name itself; a negative arity means "at least -arity arguments". The key
+// positions follow the COMMAND reply: firstKey, lastKey (negative counts from
+// the end) and the step between keys, all zero for commands without keys.
+type command struct {
+	name     string
+	arity    int
+	flags    commandFlag
+	firstKey int
+	lastKey  int
+	step     int
+	handler  commandHandler
+}
+
+var (
+	errSyntax     = errors.New("syntax error")
+	errNotInteger = errors.New("value is not an integer or out of range")
+	errNotFloat   = errors.New("value is not a valid float")
+	errNoSuchKey  = errors.New("no such key")
+	errWrongType  = codedError{"WRONGTYPE", "Operation against a key holding the wrong kind of value"}
+)
+
+var commandTable map[string]*command
+
+// populated in init since COMMAND itself reads the table
+func init() {
+	commands := []*command{
+		{"ping", -1, flagFast, 0, 0, 0, (*serverState).handlePing},
+		{"echo", 2, flagFast, 0, 0, 0, (*serverState).handleEcho},
+		{"info", -1, 0, 0, 0, 0, (*serverState).handleInfo},
+		{"command", -1, 0, 0, 0, 0, (*serverState).handleCommandInfo},
+		{"config", -2, flagAdmin, 0, 0, 0, (*serverState).handleConfig},
+		{"save", 1, flagAdmin, 0, 0, 0, (*serverState).handleSave},
+		{"bgsave", -1, flagAdmin, 0, 0, 0, (*serverState).handleBgsave},
+		{"bgrewriteaof", 1, flagAdmin, 0, 0, 0, (*serverState).handleBgrewriteaof},
+		{"lastsave", 1, flagFast, 0, 0, 0, (*serverState).handleLastsave},
+		{"set", -3, flagWrite, 1, 1, 1, (*serverState).handleSet},
+		{"del", -2, flagWrite, 1, -1, 1, (*serverState).handleDel},
+		{"unlink", -2, flagWrite | flagFast, 1, -1, 1, (*serverState).handleDel},
+		{"get", 2, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleGet},
+		{"keys", 2, flagReadonly, 0, 0, 0, (*serverState).handleKeys},
+		{"type", 2, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleType},
+		{"pexpireat", 3, flagWrite | flagFast, 1, 1, 1, (*serverState).handlePexpireat},
+		{"lpush", -3, flagWrite | flagFast, 1, 1, 1, (*serverState).handlePush},
+		{"rpush", -3, flagWrite | flagFast, 1, 1, 1, (*serverState).handlePush},
+		{"lpop", -2, flagWrite | flagFast, 1, 1, 1, (*serverState).handlePop},
+		{"rpop", -2, flagWrite | flagFast, 1, 1, 1, (*serverState).handlePop},
+		{"lrange", 4, flagReadonly, 1, 1, 1, (*serverState).handleLrange},
+		{"llen", 2, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleLlen},
+		{"sadd", -3, flagWrite | flagFast, 1, 1, 1, (*serverState).handleSadd},
+		{"smembers", 2, flagReadonly, 1, 1, 1, (*serverState).handleSmembers},
+		{"zadd", -4, flagWrite | flagFast, 1, 1, 1, (*serverState).handleZadd},
+		{"zrange", -4, flagReadonly, 1, 1, 1, (*serverState).handleZrange},
+		{"zscore", 3, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleZscore},
+		{"hset", -4, flagWrite | flagFast, 1, 1, 1, (*serverState).handleHset},
+		{"hget", 3, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleHget},
+		{"hgetall", 2, flagReadonly, 1, 1, 1, (*serverState).handleHgetall},
+		{"xadd", -5, flagWrite | flagFast, 1, 1, 1, (*serverState).handleStreamAdd},
+		{"xtrim", -4, flagWrite, 1, 1, 1, (*serverState).handleStreamTrim},
+		{"xdel", -3, flagWrite | flagFast, 1, 1, 1, (*serverState).handleStreamDelete},
+		{"xlen", 2, flagReadonly | flagFast, 1, 1, 1, (*serverState).handleStreamLen},
+		{"xrange", -4, flagReadonly, 1, 1, 1, (*serverState).handleStreamRange},
+		{"xrevrange", -4, flagReadonly, 1, 1, 1, (*serverState).handleStreamRange},
+		{"xread", -4, flagReadonly | flagBlocking | flagMovableKeys, 0, 0, 0, (*serverState).handleStreamRead},
+		{"xgroup", -2, flagWrite, 2, 2, 1, (*serverState).handleStreamGroup},
+		{"xreadgroup", -7, flagWrite | flagBlocking | flagMovableKeys, 0, 0, 0, (*serverState).handleStreamReadGroup},
+		{"xack", -4, flagWrite | flagFast, 1, 1, 1, (*serverState).handleStreamAck},
+		{"xpending", -3, flagReadonly, 1, 1, 1, (*serverState).handleStreamPending},
+		{"xinfo", -3, flagReadonly, 2, 2, 1, (*serverState).handleStreamInfo},
+		{"xclaim", -6, flagWrite | flagFast, 1, 1, 1, (*serverState).handleStreamClaim},
+		{"xautoclaim", -6, flagWrite | flagFast, 1, 1, 1, (*serverState).handleStreamAutoClaim},
+		{"replconf", -2, flagAdmin, 0, 0, 0, (*serverState).handleReplconf},
+		{"psync", -3, flagAdmin, 0, 0, 0, (*serverState).handlePsync},
+		{"wait", 3, flagBlocking, 0, 0, 0, (*serverState).handleWait},
+		{"replicaof", 3, flagAdmin, 0, 0, 0, (*serverState).handleReplicaof},
+		{"slaveof", 3, flagAdmin, 0, 0, 0, (*serverState).handleReplicaof},
+		{"failover", -1, flagAdmin, 0, 0, 0, (*serverState).handleFailover},
+		{"cluster", -2, flagAdmin, 0, 0, 0, (*serverState).handleCluster},
+		{"asking", 1, flagFast, 0, 0, 0, (*serverState).handleAsking},
+		{"dump", 2, flagReadonly, 1, 1, 1, (*serverState).handleDump},
+		{"restore", -4, flagWrite, 1, 1, 1, (*serverState).handleRestore},
+		{"restore-asking", -4, flagWrite | flagAsking, 1, 1, 1, (*serverState).handleRestore},
+		{"migrate", -6, flagWrite | flagMovableKeys, 3, 3, 1, (*serverState).handleMigrate},
+	}
+
+	commandTable = make(map[string]*command, len(commands))
+	for _, command := range commands {
+		commandTable[command.name] = command
+	}
+}
+
+func (command *command) checkArity(argc int) bool {
+	if command.arity < 0 {
+		return argc >= -command.arity
+	}
+	return argc == command.arity
+}
+
+// keys returns the key arguments of cmd, from the key positions or, for the
+// commands with movable keys, by parsing the arguments.
+func (command *command) keys(cmd []string) []string {
+	switch command.name {
+	case "xread", "xreadgroup":
+		return streamReadKeys(cmd)
+	case "migrate":
+		return migrateKeys(cmd)
+	}
+	if command.firstKey == 0 {
+		return nil
+	}
+	last := command.lastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+	var keys []string
+	for i := command.firstKey; i <= last && i < len(cmd); i += command.step {
+		keys = append(keys, cmd[i])
+	}
+	return keys
+}
+
+func errWrongArgs(name string) error {
+	return fmt.Errorf("wrong number of arguments for '%s' command", strings.ToLower(name))
+}
+
+func unknownCommandError(cmd []string) error {
+	var args strings.Builder
+	for _, arg := range cmd[1:] {
+		if args.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&args, "'%s' ", arg)
+	}
+	return fmt.Errorf("unknown command '%s', with args beginning with: %s", cmd[0], args.String())
+}
+
+// encodeCommandInfo renders a command the way COMMAND and COMMAND INFO do.
+func encodeCommandInfo(command *command) string {
+	flags := []string{}
+	for _, f := range commandFlagNames {
+		if command.flags&f.flag != 0 {
+			flags = append(flags, encodeSimpleString(f.name))
+		}
+	}
+	return encodeArray([]string{
+		encodeBulkString(command.name),
+		encodeInteger(command.arity),
+		encodeArray(flags),
+		encodeInteger(command.firstKey),
+		encodeInteger(command.lastKey),
+		encodeInteger(command.step),
+	})
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (srv *serverState) handleCommandInfo(c *client, cmd []string) string {
+	if len(cmd) == 1 {
+		var infos []string
+		for _, name := range sortedCommandNames() {
+			infos = append(infos, encodeCommandInfo(commandTable[name]))
+		}
+		return encodeArray(infos)
+	}
+
+	switch strings.ToUpper(cmd[1]) {
+	case "COUNT":
+		return encodeInteger(len(commandTable))
+	case "LIST":
+		return encodeStringArray(sortedCommandNames())
+	case "INFO":
+		names := cmd[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		var infos []string
+		for _, name := range names {
+			if command, ok := commandTable[strings.ToLower(name)]; ok {
+				infos = append(infos, encodeCommandInfo(command))
+			} else {
+				infos = append(infos, encodeNullArray())
+			}
+		}
+		return encodeArray(infos)
+	}
+	return encodeError(fmt.Errorf("unknown subcommand '%s'. Try COMMAND HELP.", cmd[1]))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configParam is a parameter reachable through CONFIG GET / CONFIG SET. A nil
+// set marks the parameter as immutable at runtime.
+type configParam struct {
+	name string
+	get  func(cfg *serverConfig) string
+	set  func(cfg *serverConfig, value string) error
+}
+
+var configParams = []configParam{
+	{
+		name: "port",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.port) },
+	},
+	{
+		name: "dir",
+		get:  func(cfg *serverConfig) string { return cfg.dbDir },
+		set: func(cfg *serverConfig, value string) error {
+			info, err := os.Stat(value)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", value)
+			}
+			cfg.dbDir = value
+			return nil
+		},
+	},
+	{
+		name: "dbfilename",
+		get:  func(cfg *serverConfig) string { return cfg.dbFileName },
+		set: func(cfg *serverConfig, value string) error {
+			if strings.ContainsRune(value, os.PathSeparator) {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			cfg.dbFileName = value
+			return nil
+		},
+	},
+	{
+		name: "save",
+		get:  func(cfg *serverConfig) string { return formatSavePoints(cfg.savePoints) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.savePoints, err = parseSavePoints(value)
+			return
+		},
+	},
+	{
+		name: "appendonly",
+		get:  func(cfg *serverConfig) string { return formatYesNo(cfg.appendOnly) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.appendOnly, err = parseYesNo(value)
+			return
+		},
+	},
+	{
+		name: "appendfsync",
+		get:  func(cfg *serverConfig) string { return cfg.appendFsync },
+		set: func(cfg *serverConfig, value string) error {
+			if err := checkFsyncPolicy(value); err != nil {
+				return err
+			}
+			cfg.appendFsync = strings.ToLower(value)
+			return nil
+		},
+	},
+	{
+		name: "appendfilename",
+		get:  func(cfg *serverConfig) string { return cfg.appendFileName },
+	},
+	{
+		name: "repl-backlog-size",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.replBacklogSize) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replBacklogSize, err = parseMemory(value)
+			return
+		},
+	},
+	{
+		name: "repl-ping-replica-period",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.replPingReplicaPeriod) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replPingReplicaPeriod, err = parsePositive(value)
+			return
+		},
+	},
+	{
+		name: "repl-timeout",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.replTimeout) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replTimeout, err = parsePositive(value)
+			return
+		},
+	},
+	{
+		name: "repl-diskless-sync",
+		get:  func(cfg *serverConfig) string { return formatYesNo(cfg.replDisklessSync) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replDisklessSync, err = parseYesNo(value)
+			return
+		},
+	},
+	{
+		name: "repl-diskless-sync-delay",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.replDisklessSyncDelay) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replDisklessSyncDelay, err = parseNonNegative(value)
+			return
+		},
+	},
+	{
+		name: "replica-read-only",
+		get:  func(cfg *serverConfig) string { return formatYesNo(cfg.replicaReadOnly) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.replicaReadOnly, err = parseYesNo(value)
+			return
+		},
+	},
+	{
+		name: "min-replicas-to-write",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.minReplicasToWrite) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.minReplicasToWrite, err = parseNonNegative(value)
+			return
+		},
+	},
+	{
+		name: "min-replicas-max-lag",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.minReplicasMaxLag) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.minReplicasMaxLag, err = parseNonNegative(value)
+			return
+		},
+	},
+	{
+		name: "stream-max-deliveries",
+		get:  func(cfg *serverConfig) string { return strconv.Itoa(cfg.streamMaxDeliveries) },
+		set: func(cfg *serverConfig, value string) (err error) {
+			cfg.streamMaxDeliveries, err = parseNonNegative(value)
+			return
+		},
+	},
+}
+
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseNonNegative(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("argument couldn't be parsed into an integer")
+	}
+	return n, nil
+}
+
+func parsePositive(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("argument must be a positive integer")
+	}
+	return n, nil
+}
+
+// parseMemory parses a positive size in bytes with an optional unit: k, m
+// and g are powers of 1000, kb, mb and gb powers of 1024.
+func parseMemory(value string) (int, error) {
+	units := []struct {
+		suffix     string
+		multiplier int
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	lower, multiplier := strings.ToLower(value), 1
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, multiplier = strings.TrimSuffix(lower, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("argument must be a memory value")
+	}
+	return n * multiplier, nil
+}
+
+func checkFsyncPolicy(value string) error {
+	switch strings.ToLower(value) {
+	case fsyncAlways, fsyncEverySec, fsyncNo:
+		return nil
+	}
+	return fmt.Errorf("argument must be one of always, everysec or no")
+}
+
+func lookupConfigParam(name string) *configParam {
+	for i := range configParams {
+		if configParams[i].name == strings.ToLower(name) {
+			return &configParams[i]
+		}
+	}
+	return nil
+}
+
+func (srv *serverState) handleConfig(c *client, cmd []string) string {
+	switch strings.ToUpper(cmd[1]) {
+	case "GET":
+		if len(cmd) < 3 {
+			return encodeError(errWrongArgs("config|get"))
+		}
+		result := []string{}
+		for _, param := range configParams {
+			for _, pattern := range cmd[2:] {
+				if matchPattern(strings.ToLower(pattern), param.name) {
+					result = append(result, param.name, param.get(&srv.config))
+					break
+				}
+			}
+		}
+		return encodeStringArray(result)
+
+	case "SET":
+		if len(cmd) < 4 || len(cmd)%2 != 0 {
+			return encodeError(errWrongArgs("config|set"))
+		}
+		// validate everything before applying anything
+		updated := srv.config
+		for i := 2; i < len(cmd); i += 2 {
+			param := lookupConfigParam(cmd[i])
+			if param == nil {
+				return encodeError(fmt.Errorf("Unknown option or number of arguments for CONFIG SET - '%s'", cmd[i]))
+			}
+			if param.set == nil {
+				return encodeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - can't set immutable config", param.name))
+			}
+			if err := param.set(&updated, cmd[i+1]); err != nil {
+				return encodeError(fmt.Errorf("CONFIG SET failed (possibly related to argument '%s') - %v", param.name, err))
+			}
+		}
+		wasAppendOnly := srv.config.appendOnly
+		srv.config = updated
+		srv.applyAppendOnlyConfig(wasAppendOnly)
+		if srv.backlog != nil {
+			srv.backlog.resize(srv.config.replBacklogSize)
+		}
+		return "+OK\r\n"
+
+	case "RESETSTAT", "REWRITE":
+		return "+OK\r\n"
+	}
+	return encodeError(fmt.Errorf("unknown subcommand '%s'. Try CONFIG HELP.", cmd[1]))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"hash/crc64"
+	"io"
+)
+
+// Redis checksums RDB payloads with the reflected CRC-64 "Jones" polynomial
+// (0xad93d23594c935a9), without the initial and final inversion that the
+// standard library applies, hence the hand rolled update loop.
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Jones(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64JonesTable[byte(crc)^b] ^ crc>>8
+	}
+	return crc
+}
+
+// crc64Writer checksums everything written through it.
+type crc64Writer struct {
+	w   io.Writer
+	crc uint64
+}
+
+func (cw *crc64Writer) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.crc = crc64Jones(cw.crc, p[:n])
+	return n, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failoverRequest is a FAILOVER in progress: writes are paused while the
+// target replica catches up, then it is promoted and this master becomes its
+// replica.
+type failoverRequest struct {
+	host     string
+	port     int
+	deadline time.Time // zero for no timeout
+}
+
+// how often the target is asked whether it caught up
+const failoverRetryDelay = 100 * time.Millisecond
+
+func (srv *serverState) handleFailover(c *client, cmd []string) string {
+	var host string
+	port, timeout, abort := 0, 0, false
+	for i := 1; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "TO":
+			if i+2 >= len(cmd) || host != "" {
+				return encodeError(errSyntax)
+			}
+			var err error
+			if port, err = strconv.Atoi(cmd[i+2]); err != nil {
+				return encodeError(errNotInteger)
+			}
+			host = cmd[i+1]
+			i += 2
+		case "TIMEOUT":
+			if i+1 >= len(cmd) || timeout != 0 {
+				return encodeError(errSyntax)
+			}
+			var err error
+			if timeout, err = strconv.Atoi(cmd[i+1]); err != nil {
+				return encodeError(errNotInteger)
+			}
+			if timeout <= 0 {
+				return encodeError(errors.New("FAILOVER timeout must be greater than 0"))
+			}
+			i++
+		case "ABORT":
+			abort = true
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	if abort {
+		if len(cmd) != 2 {
+			return encodeError(errSyntax)
+		}
+		if srv.failover == nil {
+			return encodeError(errors.New("No failover in progress."))
+		}
+		srv.endFailover()
+		fmt.Println("FAILOVER aborted by user")
+		return "+OK\r\n"
+	}
+
+	if srv.config.role != "master" {
+		return encodeError(errors.New("FAILOVER is not valid when server is a replica."))
+	}
+	if srv.failover != nil {
+		return encodeError(errors.New("FAILOVER already in progress."))
+	}
+
+	var target *replica
+	for i := range srv.replicas {
+		r := &srv.replicas[i]
+		if r.online && (host == "" || r.host == host && r.port == port) {
+			target = r
+			break
+		}
+	}
+	if target == nil {
+		if host != "" {
+			return encodeError(errors.New("FAILOVER target HOST and PORT is not a replica."))
+		}
+		return encodeError(errors.New("FAILOVER requires connected replicas."))
+	}
+
+	failover := &failoverRequest{host: target.host, port: target.port}
+	if timeout > 0 {
+		failover.deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	srv.failover = failover
+	srv.writesPaused = make(chan struct{})
+	fmt.Printf("FAILOVER requested to %s:%d\n", failover.host, failover.port)
+
+	go srv.runFailover(failover)
+	return "+OK\r\n"
+}
+
+// endFailover resumes writes. Called with srv.mu held.
+func (srv *serverState) endFailover() {
+	srv.failover = nil
+	close(srv.writesPaused)
+	srv.writesPaused = nil
+}
+
+// runFailover asks the target to take over until it has caught up with the
+// paused master, then turns this server into its replica.
+func (srv *serverState) runFailover(failover *failoverRequest) {
+	for {
+		srv.mu.Lock()
+		if srv.failover != failover {
+			srv.mu.Unlock()
+			return
+		}
+		replid, offset := srv.config.replid, srv.config.replOffset
+		timeout := time.Duration(srv.config.replTimeout) * time.Second
+		srv.mu.Unlock()
+
+		err := requestFailover(failover.host, failover.port, replid, offset, timeout)
+
+		srv.mu.Lock()
+		if srv.failover != failover {
+			srv.mu.Unlock()
+			return
+		}
+		if err == nil {
+			srv.endFailover()
+			srv.replicaOf(failover.host, failover.port)
+			srv.mu.Unlock()
+			fmt.Printf("FAILOVER to %s:%d succeeded\n", failover.host, failover.port)
+			return
+		}
+		if !failover.deadline.IsZero() && time.Now().After(failover.deadline) {
+			srv.endFailover()
+			srv.mu.Unlock()
+			fmt.Printf("FAILOVER to %s:%d aborted, timed out: %v\n", failover.host, failover.port, err)
+			return
+		}
+		srv.mu.Unlock()
+		time.Sleep(failoverRetryDelay)
+	}
+}
+
+// requestFailover sends PSYNC FAILOVER to the target, which is promoted only
+// once it has processed the whole replication stream up to offset.
+func requestFailover(host string, port int, replid string, offset int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = sendHandshakeCommand(conn, bufio.NewReader(conn), "PSYNC", replid, strconv.Itoa(offset+1), "FAILOVER")
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addLaggingReplica registers an online replica whose server never takes
+// over: it answers PSYNC FAILOVER with an error, as a replica that hasn't
+// caught up does.
+func addLaggingReplica(t *testing.T, srv *serverState) {
+	t.Helper()
+	listener := listenLoopback(t)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte("-ERR PSYNC FAILOVER offset must match my offset 1.\r\n"))
+			conn.Close()
+		}
+	}()
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	srv.mu.Lock()
+	srv.replicas = append(srv.replicas, replica{
+		conn:    conn,
+		host:    "127.0.0.1",
+		port:    listener.Addr().(*net.TCPAddr).Port,
+		online:  true,
+		out:     make(chan []byte, replicaOutputQueue),
+		lastAck: time.Now(),
+	})
+	srv.mu.Unlock()
+}
+
+// pausedWrite runs a SET on srv, which FAILOVER is expected to hold, and
+// returns the channel its reply is sent to.
+func pausedWrite(t *testing.T, srv *serverState) <-chan any {
+	t.Helper()
+	done := make(chan any, 1)
+	go func() { done <- call(t, srv, &client{id: 2}, "SET", "paused", "write") }()
+	select {
+	case reply := <-done:
+		t.Fatalf("SET during the failover = %v, want it paused", reply)
+	case <-time.After(100 * time.Millisecond):
+	}
+	return done
+}
+
+// released waits for the reply of a paused write.
+func released(t *testing.T, done <-chan any) any {
+	t.Helper()
+	select {
+	case reply := <-done:
+		return reply
+	case <-time.After(5 * time.Second):
+		t.Fatal("the paused write was never released")
+		return nil
+	}
+}
+
+func role(t *testing.T, srv *serverState) string {
+	t.Helper()
+	info, _ := call(t, srv, &client{id: 1}, "INFO", "replication").(string)
+	return parseInfoFields(info)["role"]
+}
+
+// TestFailover hands the master role over to a replica, then checks that the
+// former master replicates it and that the write it paused meanwhile is
+// refused as on any read only replica.
+func TestFailover(t *testing.T) {
+	master := newTestServer(t)
+	serveTestServer(t, master)
+	replica := startTestReplica(t, master)
+	c := &client{id: 1}
+	call(t, master, c, "CONFIG", "SET", "replica-read-only", "yes")
+	call(t, master, c, "SET", "key", "before")
+
+	// the busy replica can't take over before the write is paused
+	replica.mu.Lock()
+	unlock := sync.OnceFunc(replica.mu.Unlock)
+	t.Cleanup(unlock)
+	if reply := call(t, master, c, "FAILOVER"); reply != "OK" {
+		t.Fatalf("FAILOVER = %v", reply)
+	}
+	t.Cleanup(func() { stopReplication(t, master) })
+	if reply, _ := call(t, master, c, "FAILOVER").(error); reply == nil || reply.Error() != "ERR FAILOVER already in progress." {
+		t.Errorf("a second FAILOVER = %v", reply)
+	}
+	done := pausedWrite(t, master)
+	unlock()
+
+	waitFor(t, 5*time.Second, "the replica to take over", func() bool {
+		return role(t, replica) == "master" && role(t, master) == "slave"
+	})
+	if reply, _ := released(t, done).(error); reply == nil || reply.Error() != errReadOnlyReplica.Error() {
+		t.Errorf("the paused SET = %v, want a READONLY error", reply)
+	}
+	if reply := call(t, replica, c, "GET", "key"); reply != "before" {
+		t.Errorf("GET key on the new master = %v", reply)
+	}
+
+	waitReplState(t, master, replStateConnected)
+	call(t, replica, c, "SET", "key", "after")
+	waitFor(t, 5*time.Second, "the former master to replicate the new one", func() bool {
+		return call(t, master, c, "GET", "key") == "after"
+	})
+}
+
+// TestFailoverTimeout checks that a failover to a replica that never catches
+// up ends with its TIMEOUT, releasing the paused writes on the master.
+func TestFailoverTimeout(t *testing.T) {
+	master := newTestServer(t)
+	addLaggingReplica(t, master)
+	c := &client{id: 1}
+
+	start := time.Now()
+	if reply := call(t, master, c, "FAILOVER", "TIMEOUT", "300"); reply != "OK" {
+		t.Fatalf("FAILOVER TIMEOUT 300 = %v", reply)
+	}
+	done := pausedWrite(t, master)
+	if reply := released(t, done); reply != "OK" {
+		t.Errorf("the paused SET = %v", reply)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("the write was released after %v, before the timeout", elapsed)
+	}
+	if r := role(t, master); r != "master" {
+		t.Errorf("role after the failover timed out = %s", r)
+	}
+	if reply, _ := call(t, master, c, "FAILOVER", "ABORT").(error); reply == nil || reply.Error() != "ERR No failover in progress." {
+		t.Errorf("FAILOVER ABORT after the timeout = %v", reply)
+	}
+}
+
+// TestFailoverAbort checks that FAILOVER ABORT ends a failover that would
+// wait for the replica forever, releasing the paused writes.
+func TestFailoverAbort(t *testing.T) {
+	master := newTestServer(t)
+	addLaggingReplica(t, master)
+	c := &client{id: 1}
+
+	if reply := call(t, master, c, "FAILOVER"); reply != "OK" {
+		t.Fatalf("FAILOVER = %v", reply)
+	}
+	done := pausedWrite(t, master)
+	if reply := call(t, master, c, "FAILOVER", "ABORT"); reply != "OK" {
+		t.Fatalf("FAILOVER ABORT = %v", reply)
+	}
+	if reply := released(t, done); reply != "OK" {
+		t.Errorf("the paused SET = %v", reply)
+	}
+	if r := role(t, master); r != "master" {
+		t.Errorf("role after FAILOVER ABORT = %s", r)
+	}
+	if reply := call(t, master, c, "GET", "paused"); reply != "write" {
+		t.Errorf("GET paused = %v", reply)
+	}
+
+	// a target that isn't a replica
+	if reply, _ := call(t, master, c, "FAILOVER", "TO", "127.0.0.1", "1").(error); reply == nil || reply.Error() != "ERR FAILOVER target HOST and PORT is not a replica." {
+		t.Errorf("FAILOVER TO an unknown replica = %v", reply)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A full resynch payload is either sent with its length, from an RDB file
+// written first (disk-backed), or streamed straight from the snapshot and
+// terminated by a random mark announced as "$EOF:<mark>" (diskless).
+const rdbEOFMarkLength = 40
+
+var errDisklessSyncCancelled = errors.New("diskless sync cancelled")
+
+// disklessSync gathers the replicas asking for a full resynch within
+// repl-diskless-sync-delay, so a single snapshot is streamed to all of them.
+type disklessSync struct {
+	clients []*client
+	started chan struct{} // closed once the fields below are set
+	snap    *snapshot     // nil when the sync was cancelled
+	replid  string
+	offset  int
+}
+
+// queueDisklessSync adds c to the diskless sync waiting to start, creating
+// one if needed. The +FULLRESYNC reply is deferred until the snapshot is
+// taken. Called with srv.mu held.
+func (srv *serverState) queueDisklessSync(c *client) {
+	if srv.disklessSync == nil {
+		sync := &disklessSync{started: make(chan struct{})}
+		srv.disklessSync = sync
+		delay := time.Duration(srv.config.replDisklessSyncDelay) * time.Second
+		time.AfterFunc(delay, func() { srv.startDisklessSync(sync) })
+	}
+	srv.disklessSync.clients = append(srv.disklessSync.clients, c)
+	c.disklessSync = srv.disklessSync
+}
+
+// startDisklessSync takes the snapshot for a batch of replicas and registers
+// them, so the commands propagated from now on are buffered until the
+// snapshot is streamed.
+func (srv *serverState) startDisklessSync(sync *disklessSync) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	defer close(sync.started)
+	if srv.disklessSync != sync {
+		// cancelled by disconnectReplicas
+		return
+	}
+	srv.disklessSync = nil
+
+	sync.snap = srv.takeSnapshot()
+	sync.replid, sync.offset = srv.config.replid, srv.config.replOffset
+	for _, c := range sync.clients {
+		srv.addReplica(c)
+	}
+	fmt.Printf("Starting diskless sync for %d replicas\n", len(sync.clients))
+}
+
+// cancelDisklessSync drops the replicas waiting for a diskless sync. Called
+// with srv.mu held.
+func (srv *serverState) cancelDisklessSync() {
+	if srv.disklessSync == nil {
+		return
+	}
+	for _, c := range srv.disklessSync.clients {
+		c.conn.Close()
+	}
+	srv.disklessSync = nil
+}
+
+// sendDisklessResynch waits for the diskless sync of c to start, then
+// streams the snapshot as an EOF-marked payload.
+func (srv *serverState) sendDisklessResynch(c *client) error {
+	sync := c.disklessSync
+	c.disklessSync = nil
+	<-sync.started
+	if sync.snap == nil {
+		return errDisklessSyncCancelled
+	}
+
+	mark := randReplid()
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "+FULLRESYNC %s %d\r\n$EOF:%s\r\n", sync.replid, sync.offset, mark)
+	if err := writeRDB(w, sync.snap); err != nil {
+		return err
+	}
+	w.WriteString(mark)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("[#%d] full resynch streamed\n", c.id)
+	return nil
+}
+
+// sendDiskResynch writes the snapshot of c to an RDB file under dir, then
+// sends the file with its length.
+func sendDiskResynch(c *client, dir string) error {
+	path := filepath.Join(dir, fmt.Sprintf("temp-resync-%d-%d.rdb", os.Getpid(), c.id))
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer file.Close()
+
+	if err := writeRDB(file, c.resynch); err != nil {
+		return err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.conn, "$%d\r\n", size); err != nil {
+		return err
+	}
+	if _, err := io.Copy(c.conn, file); err != nil {
+		return err
+	}
+	fmt.Printf("[#%d] full resynch sent: %d\n", c.id, size)
+	return nil
+}
+
+// readResynchPayload reads the RDB payload following a +FULLRESYNC reply, in
+// either format.
+func readResynchPayload(reader *bufio.Reader) ([]byte, error) {
+	response, err := reader.ReadString('\n')
+	if err != nil || response[0] != '$' {
+		return nil, fmt.Errorf("invalid response %q", response)
+	}
+	header := strings.TrimSpace(response[1:])
+
+	if mark, ok := strings.CutPrefix(header, "EOF:"); ok {
+		if len(mark) != rdbEOFMarkLength {
+			return nil, fmt.Errorf("invalid EOF mark %q", response)
+		}
+		// the stream of commands follows the mark right away, so consume
+		// what is buffered only up to it
+		var payload []byte
+		for {
+			if _, err := reader.Peek(1); err != nil {
+				return nil, err
+			}
+			chunk, _ := reader.Peek(reader.Buffered())
+			from := max(0, len(payload)-len(mark)+1)
+			payload = append(payload, chunk...)
+			if i := bytes.Index(payload[from:], []byte(mark)); i >= 0 {
+				end := from + i + len(mark)
+				reader.Discard(len(chunk) - (len(payload) - end))
+				return payload[:end-len(mark)], nil
+			}
+			reader.Discard(len(chunk))
+		}
+	}
+
+	rdbSize, err := strconv.Atoi(header)
+	if err != nil || rdbSize < 0 {
+		return nil, fmt.Errorf("invalid RDB size %q", response)
+	}
+	payload := make([]byte, rdbSize)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Every key lives in exactly one of the per-type maps of serverState; the
+// helpers below look across all of them. They must be called with srv.mu held.
+
+func (srv *serverState) keyType(key string) string {
+	if _, ok := srv.store[key]; ok {
+		return "string"
+	}
+	if _, ok := srv.streams[key]; ok {
+		return "stream"
+	}
+	if _, ok := srv.lists[key]; ok {
+		return "list"
+	}
+	if _, ok := srv.sets[key]; ok {
+		return "set"
+	}
+	if _, ok := srv.zsets[key]; ok {
+		return "zset"
+	}
+	if _, ok := srv.hashes[key]; ok {
+		return "hash"
+	}
+	return "none"
+}
+
+func (srv *serverState) keyExists(key string) bool {
+	return srv.keyType(key) != "none"
+}
+
+func (srv *serverState) deleteKey(key string) bool {
+	exists := srv.keyExists(key)
+	delete(srv.store, key)
+	if _, ok := srv.streams[key]; ok {
+		delete(srv.streams, key)
+		srv.wakeStreamWaiters(key)
+	}
+	delete(srv.lists, key)
+	delete(srv.sets, key)
+	delete(srv.zsets, key)
+	delete(srv.hashes, key)
+	delete(srv.ttl, key)
+	return exists
+}
+
+// flushKeyspace drops every key, e.g. before loading a full resync payload.
+func (srv *serverState) flushKeyspace() {
+	srv.store = make(map[string]string)
+	srv.streams = make(map[string]*stream)
+	srv.lists = make(map[string][]string)
+	srv.sets = make(map[string]map[string]struct{})
+	srv.zsets = make(map[string]map[string]float64)
+	srv.hashes = make(map[string]map[string]string)
+	srv.ttl = make(map[string]time.Time)
+	for key := range srv.streamWaiters {
+		srv.wakeStreamWaiters(key)
+	}
+}
+
+func (srv *serverState) allKeys() []string {
+	keys := make([]string, 0, len(srv.store))
+	keys = appendKeys(keys, srv.store)
+	keys = appendKeys(keys, srv.streams)
+	keys = appendKeys(keys, srv.lists)
+	keys = appendKeys(keys, srv.sets)
+	keys = appendKeys(keys, srv.zsets)
+	keys = appendKeys(keys, srv.hashes)
+	return keys
+}
+
+func appendKeys[V any](keys []string, m map[string]V) []string {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := appendKeys(make([]string, 0, len(m)), m)
+	slices.Sort(keys)
+	return keys
+}
+
+func (srv *serverState) isExpired(key string) bool {
+	expiration, ok := srv.ttl[key]
+	return ok && !expiration.After(time.Now())
+}
+
+// expireIfNeeded reports whether the TTL of key has passed, in which case the
+// caller must treat it as missing. A master deletes it and propagates a DEL.
+// A replica never deletes keys on its own: it keeps them for the commands of
+// its master until the master's DEL arrives, and only hides them from its
+// other clients.
+func (srv *serverState) expireIfNeeded(key string) bool {
+	if !srv.isExpired(key) {
+		return false
+	}
+	if srv.config.role != "master" {
+		return !srv.obeying
+	}
+	srv.deleteKey(key)
+	srv.dirty++
+	// This runs while a command is executed, so the DEL is propagated ahead
+	// of that command. That is the order replicas need: the command saw the
+	// key as missing, and so does its replay once the DEL removed it.
+	srv.propagate([]string{"DEL", key})
+	return true
+}
+
+func (srv *serverState) handleDel(c *client, cmd []string) string {
+	deleted := 0
+	for _, key := range cmd[1:] {
+		if !srv.expireIfNeeded(key) && srv.deleteKey(key) {
+			deleted++
+		}
+	}
+	srv.dirty += deleted
+	return encodeInteger(deleted)
+}
+
+func (srv *serverState) handlePexpireat(c *client, cmd []string) string {
+	key := cmd[1]
+	ms, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	if srv.expireIfNeeded(key) || !srv.keyExists(key) {
+		return encodeInteger(0)
+	}
+	srv.ttl[key] = time.UnixMilli(ms)
+	srv.dirty++
+	if srv.isExpired(key) {
+		srv.deleteKey(key)
+	}
+	return encodeInteger(1)
+}
+
+// getValue returns the value of key in the form setValue takes, nil when the
+// key does not exist.
+func (srv *serverState) getValue(key string) any {
+	if v, ok := srv.store[key]; ok {
+		return v
+	}
+	if v, ok := srv.streams[key]; ok {
+		return v
+	}
+	if v, ok := srv.lists[key]; ok {
+		return v
+	}
+	if v, ok := srv.sets[key]; ok {
+		return v
+	}
+	if v, ok := srv.zsets[key]; ok {
+		return v
+	}
+	if v, ok := srv.hashes[key]; ok {
+		return v
+	}
+	return nil
+}
+
+// setValue stores a value decoded from an RDB payload under key.
+func (srv *serverState) setValue(key string, value any) {
+	srv.deleteKey(key)
+	switch v := value.(type) {
+	case string:
+		srv.store[key] = v
+	case *stream:
+		srv.streams[key] = v
+		srv.wakeStreamWaiters(key)
+	case []string:
+		srv.lists[key] = v
+	case map[string]struct{}:
+		srv.sets[key] = v
+	case map[string]float64:
+		srv.zsets[key] = v
+	case map[string]string:
+		srv.hashes[key] = v
+	}
+}
+
+// snapshot is a point-in-time copy of the keyspace that can be serialized
+// without holding srv.mu.
+type snapshot struct {
+	store   map[string]string
+	ttl     map[string]time.Time
+	streams map[string]*stream
+	lists   map[string][]string
+	sets    map[string]map[string]struct{}
+	zsets   map[string]map[string]float64
+	hashes  map[string]map[string]string
+}
+
+func (snap *snapshot) size() int {
+	return len(snap.store) + len(snap.streams) + len(snap.lists) + len(snap.sets) + len(snap.zsets) + len(snap.hashes)
+}
+
+// takeSnapshot must be called with srv.mu held. Stream entries are never
+// modified once added, so copying the entry slices is enough; collections
+// are modified in place and are copied entirely.
+func (srv *serverState) takeSnapshot() *snapshot {
+	snap := &snapshot{
+		store:   maps.Clone(srv.store),
+		ttl:     maps.Clone(srv.ttl),
+		streams: make(map[string]*stream, len(srv.streams)),
+		lists:   make(map[string][]string, len(srv.lists)),
+		sets:    make(map[string]map[string]struct{}, len(srv.sets)),
+		zsets:   make(map[string]map[string]float64, len(srv.zsets)),
+		hashes:  make(map[string]map[string]string, len(srv.hashes)),
+	}
+	for key, s := range srv.streams {
+		snap.streams[key] = &stream{first: s.first, last: s.last, maxDeletedID: s.maxDeletedID, entriesAdded: s.entriesAdded,
+			entries: slices.Clone(s.entries), groups: s.cloneGroups()}
+	}
+	for key, list := range srv.lists {
+		snap.lists[key] = slices.Clone(list)
+	}
+	for key, set := range srv.sets {
+		snap.sets[key] = maps.Clone(set)
+	}
+	for key, zset := range srv.zsets {
+		snap.zsets[key] = maps.Clone(zset)
+	}
+	for key, hash := range srv.hashes {
+		snap.hashes[key] = maps.Clone(hash)
+	}
+	return snap
+}
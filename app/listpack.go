@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Listpacks are the compact serialization Redis uses for stream nodes and
+// small aggregates: a 6 byte header (total bytes, element count), the
+// elements, and a 0xFF terminator. Every element is an encoding byte, its
+// data and a variable length "backlen" that allows walking it backwards.
+
+var errInvalidListpack = errors.New("invalid listpack")
+
+func encodeListpack(elements []string) []byte {
+	buf := make([]byte, 6, 64)
+	for _, element := range elements {
+		start := len(buf)
+		buf = appendListpackElement(buf, element)
+		buf = appendListpackBacklen(buf, len(buf)-start)
+	}
+	buf = append(buf, 0xFF)
+
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	count := min(len(elements), 65535)
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(count))
+	return buf
+}
+
+func appendListpackElement(buf []byte, element string) []byte {
+	if v, err := strconv.ParseInt(element, 10, 64); err == nil && strconv.FormatInt(v, 10) == element {
+		switch {
+		case v >= 0 && v <= 127:
+			return append(buf, byte(v))
+		case v >= -4096 && v <= 4095:
+			u := uint64(v) & 0x1FFF
+			return append(buf, 0xC0|byte(u>>8), byte(u))
+		case v >= -32768 && v <= 32767:
+			return binary.LittleEndian.AppendUint16(append(buf, 0xF1), uint16(v))
+		case v >= -8388608 && v <= 8388607:
+			u := uint32(v)
+			return append(buf, 0xF2, byte(u), byte(u>>8), byte(u>>16))
+		case v >= -2147483648 && v <= 2147483647:
+			return binary.LittleEndian.AppendUint32(append(buf, 0xF3), uint32(v))
+		default:
+			return binary.LittleEndian.AppendUint64(append(buf, 0xF4), uint64(v))
+		}
+	}
+
+	size := len(element)
+	switch {
+	case size < 64:
+		buf = append(buf, 0x80|byte(size))
+	case size < 4096:
+		buf = append(buf, 0xE0|byte(size>>8), byte(size))
+	default:
+		buf = binary.LittleEndian.AppendUint32(append(buf, 0xF0), uint32(size))
+	}
+	return append(buf, element...)
+}
+
+func appendListpackBacklen(buf []byte, l int) []byte {
+	switch {
+	case l <= 127:
+		return append(buf, byte(l))
+	case l < 16383:
+		return append(buf, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		return append(buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		return append(buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		return append(buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+}
+
+func listpackBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// decodeListpack returns every element as a string, integers included.
+func decodeListpack(data []byte) ([]string, error) {
+	if len(data) < 7 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errInvalidListpack
+	}
+
+	var elements []string
+	for pos := 6; ; {
+		if pos >= len(data) {
+			return nil, errInvalidListpack
+		}
+		b0 := data[pos]
+		if b0 == 0xFF {
+			break
+		}
+
+		var value string
+		var headerSize, dataSize int
+		switch {
+		case b0&0x80 == 0:
+			headerSize, value = 1, strconv.Itoa(int(b0))
+		case b0&0xC0 == 0x80:
+			headerSize, dataSize = 1, int(b0&0x3F)
+		case b0&0xE0 == 0xC0:
+			if pos+2 > len(data) {
+				return nil, errInvalidListpack
+			}
+			v := int64(b0&0x1F)<<8 | int64(data[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			headerSize, value = 2, strconv.FormatInt(v, 10)
+		case b0&0xF0 == 0xE0:
+			if pos+2 > len(data) {
+				return nil, errInvalidListpack
+			}
+			headerSize, dataSize = 2, int(b0&0x0F)<<8|int(data[pos+1])
+		case b0 == 0xF0:
+			if pos+5 > len(data) {
+				return nil, errInvalidListpack
+			}
+			headerSize, dataSize = 5, int(binary.LittleEndian.Uint32(data[pos+1:]))
+		case b0 >= 0xF1 && b0 <= 0xF4:
+			size := [...]int{2, 3, 4, 8}[b0-0xF1]
+			if pos+1+size > len(data) {
+				return nil, errInvalidListpack
+			}
+			var u uint64
+			for i := size - 1; i >= 0; i-- {
+				u = u<<8 | uint64(data[pos+1+i])
+			}
+			// sign extend from the encoded width
+			shift := 64 - 8*size
+			headerSize, value = 1+size, strconv.FormatInt(int64(u<<shift)>>shift, 10)
+		default:
+			return nil, errInvalidListpack
+		}
+
+		if dataSize > 0 {
+			if pos+headerSize+dataSize > len(data) {
+				return nil, errInvalidListpack
+			}
+			value = string(data[pos+headerSize : pos+headerSize+dataSize])
+		}
+
+		elements = append(elements, value)
+		entrySize := headerSize + dataSize
+		pos += entrySize + listpackBacklenSize(entrySize)
+	}
+	return elements, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import "errors"
+
+var errInvalidLZF = errors.New("invalid LZF compressed string")
+
+// lzfDecompress expands data compressed with LZF, the algorithm Redis uses
+// for long strings in RDB files. Every control byte starts either a literal
+// run (ctrl < 32, ctrl+1 bytes follow) or a back reference whose length is
+// in the top 3 bits (7 meaning "add the next byte") and whose offset spans
+// the low 5 bits and the following byte.
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	// every input byte expands to at most 264 output bytes
+	out := make([]byte, 0, min(length, 264*len(in)))
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, errInvalidLZF
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+
+		refLen := ctrl >> 5
+		if refLen == 7 {
+			if i >= len(in) {
+				return nil, errInvalidLZF
+			}
+			refLen += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errInvalidLZF
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errInvalidLZF
+		}
+		// copy byte by byte, the reference may overlap the bytes being written
+		for j := 0; j < refLen+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errInvalidLZF
+	}
+	return out, nil
+}
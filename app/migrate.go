@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A DUMP payload is the RDB encoding of a value, its type byte followed by
+// the value, then the RDB version on 2 bytes and the CRC64 of everything
+// before it on 8 bytes, both little endian.
+
+// dumpRDBVersion is the version of the RDB encoding writeRDB produces.
+const dumpRDBVersion = 11
+
+var (
+	errBadDumpPayload = errors.New("DUMP payload version or checksum are wrong")
+	errBusyKey        = codedError{"BUSYKEY", "Target key name already exists."}
+)
+
+func dumpValue(value any) string {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	bw.WriteByte(rdbValueType(value))
+	writeRDBValue(bw, value)
+	binary.Write(bw, binary.LittleEndian, uint16(dumpRDBVersion))
+	bw.Flush()
+	binary.Write(&buf, binary.LittleEndian, crc64Jones(0, buf.Bytes()))
+	return buf.String()
+}
+
+func restoreValue(payload string) (any, error) {
+	if len(payload) < 11 {
+		return nil, errBadDumpPayload
+	}
+	footer := []byte(payload[len(payload)-10:])
+	version := binary.LittleEndian.Uint16(footer[:2])
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if version > rdbVersion || checksum != crc64Jones(0, []byte(payload[:len(payload)-8])) {
+		return nil, errBadDumpPayload
+	}
+
+	reader := newRDBReader(strings.NewReader(payload[:len(payload)-10]))
+	valueType, _ := reader.ReadByte()
+	value, err := readRDBValue(reader, valueType)
+	if err == nil {
+		if _, err = reader.ReadByte(); err == io.EOF {
+			return value, nil
+		}
+	}
+	return nil, errors.New("Bad data format")
+}
+
+func (srv *serverState) handleDump(c *client, cmd []string) string {
+	key := cmd[1]
+	if srv.expireIfNeeded(key) {
+		return encodeNullBulkString()
+	}
+	value := srv.getValue(key)
+	if value == nil {
+		return encodeNullBulkString()
+	}
+	return encodeBulkString(dumpValue(value))
+}
+
+// handleRestore implements RESTORE and RESTORE-ASKING, the variant MIGRATE
+// sends so that it is served by a cluster node still importing the slot.
+func (srv *serverState) handleRestore(c *client, cmd []string) string {
+	key, payload := cmd[1], cmd[3]
+	ttl, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	if ttl < 0 {
+		return encodeError(errors.New("Invalid TTL value, must be >= 0"))
+	}
+	replace, absTTL := false, false
+	for i := 4; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			// eviction hints, there is no eviction to use them for
+			if i+1 == len(cmd) {
+				return encodeError(errSyntax)
+			}
+			i++
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	expired := srv.expireIfNeeded(key)
+	if !replace && !expired && srv.keyExists(key) {
+		return encodeError(errBusyKey)
+	}
+	value, err := restoreValue(payload)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	var expiration time.Time
+	switch {
+	case ttl > 0 && absTTL:
+		expiration = time.UnixMilli(ttl)
+	case ttl > 0:
+		expiration = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	if !expiration.IsZero() && !expiration.After(time.Now()) {
+		// already expired, only the key it replaces goes away
+		if srv.deleteKey(key) {
+			srv.dirty++
+		}
+		return "+OK\r\n"
+	}
+	srv.setValue(key, value)
+	if !expiration.IsZero() {
+		srv.ttl[key] = expiration
+	}
+	srv.dirty++
+	return "+OK\r\n"
+}
+
+type migrateOptions struct {
+	copy    bool
+	replace bool
+	auth    []string // the AUTH command to send first
+	keys    []string
+}
+
+// parseMigrateOptions parses MIGRATE host port key|"" db timeout [COPY]
+// [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key...].
+func parseMigrateOptions(cmd []string) (opts migrateOptions, err error) {
+	if cmd[3] != "" {
+		opts.keys = []string{cmd[3]}
+	}
+	for i := 6; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "COPY":
+			opts.copy = true
+		case "REPLACE":
+			opts.replace = true
+		case "AUTH":
+			if i+1 >= len(cmd) {
+				return opts, errSyntax
+			}
+			opts.auth = []string{"AUTH", cmd[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(cmd) {
+				return opts, errSyntax
+			}
+			opts.auth = []string{"AUTH", cmd[i+1], cmd[i+2]}
+			i += 2
+		case "KEYS":
+			if cmd[3] != "" {
+				return opts, errors.New("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			opts.keys = cmd[i+1:]
+			return opts, nil
+		default:
+			return opts, errSyntax
+		}
+	}
+	return opts, nil
+}
+
+// migrateKeys returns the keys of a MIGRATE, see command.keys.
+func migrateKeys(cmd []string) []string {
+	opts, _ := parseMigrateOptions(cmd)
+	return opts.keys
+}
+
+// handleMigrate moves keys to another instance with RESTORE-ASKING and
+// deletes them once the target acknowledged them, unless COPY is given. As
+// in Redis the transfer is atomic: it runs with srv.mu held, blocking the
+// server for at most timeout milliseconds.
+func (srv *serverState) handleMigrate(c *client, cmd []string) string {
+	db, err := strconv.Atoi(cmd[4])
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	timeout, err := strconv.Atoi(cmd[5])
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	if db != 0 {
+		return encodeError(errors.New("only database 0 is supported"))
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	opts, err := parseMigrateOptions(cmd)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	var request strings.Builder
+	if opts.auth != nil {
+		request.WriteString(encodeStringArray(opts.auth))
+	}
+	var keys []string
+	for _, key := range opts.keys {
+		if srv.expireIfNeeded(key) {
+			continue
+		}
+		value := srv.getValue(key)
+		if value == nil {
+			continue
+		}
+		ttl := int64(0)
+		if expiration, ok := srv.ttl[key]; ok {
+			ttl = max(time.Until(expiration).Milliseconds(), 1)
+		}
+		restore := []string{"RESTORE-ASKING", key, strconv.FormatInt(ttl, 10), dumpValue(value)}
+		if opts.replace {
+			restore = append(restore, "REPLACE")
+		}
+		request.WriteString(encodeStringArray(restore))
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return encodeSimpleString("NOKEY")
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cmd[1], cmd[2]), time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return encodeError(codedError{"IOERR", "error or timeout connecting to the client"})
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Millisecond))
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		return encodeError(codedError{"IOERR", "error or timeout writing to target instance"})
+	}
+
+	reader := bufio.NewReader(conn)
+	if opts.auth != nil {
+		reply, err := decodeReply(reader)
+		if err != nil {
+			return encodeError(codedError{"IOERR", "error or timeout reading to target instance"})
+		}
+		if replyErr, ok := reply.(error); ok {
+			return encodeError(fmt.Errorf("Target instance replied with error: %v", replyErr))
+		}
+	}
+	var replyErr error
+	for _, key := range keys {
+		reply, err := decodeReply(reader)
+		if err != nil {
+			return encodeError(codedError{"IOERR", "error or timeout reading to target instance"})
+		}
+		if e, ok := reply.(error); ok {
+			if replyErr == nil {
+				replyErr = e
+			}
+			continue
+		}
+		if !opts.copy {
+			srv.deleteKey(key)
+			srv.dirty++
+		}
+	}
+	if replyErr != nil {
+		return encodeError(fmt.Errorf("Target instance replied with error: %v", replyErr))
+	}
+	return "+OK\r\n"
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dumpPayload appends the RDB version and checksum of a DUMP payload to the
+// RDB encoding of a value.
+func dumpPayload(value []byte) string {
+	payload := binary.LittleEndian.AppendUint16(value, dumpRDBVersion)
+	return string(binary.LittleEndian.AppendUint64(payload, crc64Jones(0, payload)))
+}
+
+// TestDumpRestore restores the DUMP of a value of every type under a new key
+// and checks that it dumps the same again.
+func TestDumpRestore(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, cmd := range [][]string{
+		{"SET", "string", "value"},
+		{"RPUSH", "list", "a", "b", "-3000"},
+		{"SADD", "set", "x"},
+		{"ZADD", "zset", "1.5", "m"},
+		{"HSET", "hash", "f", "v"},
+		{"XADD", "stream", "1-1", "f", "v"},
+		{"XGROUP", "CREATE", "stream", "g", "0"},
+		{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "stream", ">"},
+	} {
+		if reply, ok := call(t, srv, c, cmd...).(error); ok {
+			t.Fatalf("%q: %v", cmd, reply)
+		}
+	}
+
+	for _, key := range []string{"string", "list", "set", "zset", "hash", "stream"} {
+		dump, ok := call(t, srv, c, "DUMP", key).(string)
+		if !ok {
+			t.Fatalf("DUMP %s is not a string", key)
+		}
+		if reply := call(t, srv, c, "RESTORE", key+":copy", "0", dump); reply != "OK" {
+			t.Fatalf("RESTORE %s:copy = %v", key, reply)
+		}
+		if again := call(t, srv, c, "DUMP", key+":copy"); again != dump {
+			t.Errorf("DUMP %s:copy = %q, want %q", key, again, dump)
+		}
+	}
+	if info := call(t, srv, c, "XINFO", "STREAM", "stream:copy", "FULL"); !strings.Contains(fmtReply(info), "alice") {
+		t.Errorf("the consumers of the stream were not restored: %v", info)
+	}
+	if reply := call(t, srv, c, "DUMP", "missing"); reply != nil {
+		t.Errorf("DUMP missing = %v", reply)
+	}
+}
+
+// keyTTL returns the time key has left to live, 0 when it doesn't expire.
+func keyTTL(srv *serverState, key string) time.Duration {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if expiration, ok := srv.ttl[key]; ok {
+		return time.Until(expiration)
+	}
+	return 0
+}
+
+// fmtReply flattens a decoded reply into a string to search.
+func fmtReply(reply any) string {
+	var b strings.Builder
+	var walk func(any)
+	walk = func(reply any) {
+		switch reply := reply.(type) {
+		case []any:
+			for _, element := range reply {
+				walk(element)
+			}
+		case string:
+			b.WriteString(reply + " ")
+		}
+	}
+	walk(reply)
+	return b.String()
+}
+
+func TestRestoreOptions(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "SET", "key", "old")
+	dump := call(t, srv, c, "DUMP", "key").(string)
+	call(t, srv, c, "SET", "key", "new")
+
+	if reply, _ := call(t, srv, c, "RESTORE", "key", "0", dump).(error); reply == nil || !strings.HasPrefix(reply.Error(), "BUSYKEY") {
+		t.Errorf("RESTORE over an existing key = %v", reply)
+	}
+	if reply := call(t, srv, c, "RESTORE", "key", "60000", dump, "REPLACE", "IDLETIME", "10"); reply != "OK" {
+		t.Fatalf("RESTORE REPLACE = %v", reply)
+	}
+	if got := call(t, srv, c, "GET", "key"); got != "old" {
+		t.Errorf("GET key = %v after RESTORE REPLACE", got)
+	}
+	if ttl := keyTTL(srv, "key"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("the TTL of key is %v after RESTORE with one", ttl)
+	}
+
+	// an absolute expiration time in the past replaces the key by nothing
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10)
+	if reply := call(t, srv, c, "RESTORE", "key", past, dump, "REPLACE", "ABSTTL"); reply != "OK" {
+		t.Fatalf("RESTORE ABSTTL = %v", reply)
+	}
+	if got := call(t, srv, c, "TYPE", "key"); got != "none" {
+		t.Errorf("TYPE key = %v after restoring it already expired", got)
+	}
+
+	for _, cmd := range [][]string{
+		{"RESTORE", "key", "-1", dump},
+		{"RESTORE", "key", "ten", dump},
+		{"RESTORE", "key", "0", dump, "IDLETIME"},
+		{"RESTORE", "key", "0", dump, "NOSUCHOPTION"},
+	} {
+		if _, ok := call(t, srv, c, cmd...).(error); !ok {
+			t.Errorf("%q succeeded", cmd)
+		}
+	}
+}
+
+// TestRestoreMalformedPayload restores payloads with a valid checksum but a
+// value that doesn't decode: each must be refused, never crash the server
+// nor leave a key behind.
+func TestRestoreMalformedPayload(t *testing.T) {
+	var stream bytes.Buffer
+	bw := bufio.NewWriter(&stream)
+	bw.WriteByte(rdbTypeStreamListpacks)
+	writeRDBLength(bw, 1)
+	writeRDBString(bw, string(make([]byte, 16)))
+	// entry count, deleted count and a negative master field count
+	writeRDBString(bw, string(encodeListpack([]string{"1", "0", "-1", "0"})))
+	bw.Flush()
+
+	valid := dumpValue("value")
+	corrupt := []byte(valid)
+	corrupt[2] ^= 0xFF
+
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for name, payload := range map[string]string{
+		"negative stream field count": dumpPayload(stream.Bytes()),
+		"unknown type":                dumpPayload([]byte{0xEE, 1, 'a'}),
+		"truncated string":            dumpPayload([]byte{rdbTypeString, 10, 'a'}),
+		"trailing bytes":              dumpPayload([]byte{rdbTypeString, 1, 'a', 'b'}),
+		"huge set":                    dumpPayload([]byte{rdbTypeSet, 0x80, 0x7F, 0xFF, 0xFF, 0xFF, 1, 'a'}),
+		"wrong checksum":              string(corrupt),
+		"too short":                   valid[:5],
+	} {
+		reply, ok := call(t, srv, c, "RESTORE", "key", "0", payload).(error)
+		if !ok {
+			t.Errorf("restoring a payload with %s: %v", name, reply)
+		}
+		if got := call(t, srv, c, "TYPE", "key"); got != "none" {
+			t.Errorf("restoring a payload with %s left the key behind", name)
+		}
+	}
+}
+
+// TestMigrate moves keys to a second server over the network.
+func TestMigrate(t *testing.T) {
+	source, target := newTestServer(t), newTestServer(t)
+	port, _ := serveTestServer(t, target)
+	targetPort := strconv.Itoa(port)
+	c := &client{id: 1}
+	call(t, source, c, "SET", "a", "1", "PX", "60000")
+	call(t, source, c, "RPUSH", "b", "x", "y")
+	call(t, source, c, "SET", "c", "3")
+
+	if reply := call(t, source, c, "MIGRATE", "127.0.0.1", targetPort, "a", "0", "1000"); reply != "OK" {
+		t.Fatalf("MIGRATE a = %v", reply)
+	}
+	if reply := call(t, source, c, "MIGRATE", "127.0.0.1", targetPort, "", "0", "1000", "COPY", "KEYS", "b", "missing"); reply != "OK" {
+		t.Fatalf("MIGRATE COPY KEYS = %v", reply)
+	}
+	for _, check := range []struct {
+		srv       *serverState
+		name, key string
+		want      string
+	}{
+		{source, "source", "a", "none"},
+		{target, "target", "a", "string"},
+		{source, "source", "b", "list"},
+		{target, "target", "b", "list"},
+		{target, "target", "missing", "none"},
+	} {
+		if got := call(t, check.srv, c, "TYPE", check.key); got != check.want {
+			t.Errorf("TYPE %s = %v on the %s, want %s", check.key, got, check.name, check.want)
+		}
+	}
+	if ttl := keyTTL(target, "a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("the TTL of a is %v on the target", ttl)
+	}
+	if got := call(t, target, c, "LRANGE", "b", "0", "-1"); fmtReply(got) != "x y " {
+		t.Errorf("LRANGE b = %v on the target", got)
+	}
+
+	// the key exists on the target: an error unless REPLACE, and the
+	// source keeps it
+	call(t, target, c, "SET", "c", "other")
+	if reply, ok := call(t, source, c, "MIGRATE", "127.0.0.1", targetPort, "c", "0", "1000").(error); !ok || !strings.Contains(reply.Error(), "BUSYKEY") {
+		t.Errorf("MIGRATE over an existing key = %v", reply)
+	}
+	if got := call(t, source, c, "TYPE", "c"); got != "string" {
+		t.Error("the source deleted a key the target refused")
+	}
+	if reply := call(t, source, c, "MIGRATE", "127.0.0.1", targetPort, "c", "0", "1000", "REPLACE"); reply != "OK" {
+		t.Fatalf("MIGRATE REPLACE = %v", reply)
+	}
+	if got := call(t, target, c, "GET", "c"); got != "3" {
+		t.Errorf("GET c = %v on the target after MIGRATE REPLACE", got)
+	}
+
+	if reply := call(t, source, c, "MIGRATE", "127.0.0.1", targetPort, "missing", "0", "1000"); reply != "NOKEY" {
+		t.Errorf("MIGRATE of a missing key = %v", reply)
+	}
+	call(t, source, c, "SET", "d", "4")
+	if reply, ok := call(t, source, c, "MIGRATE", "127.0.0.1", "1", "d", "0", "100").(error); !ok || !strings.HasPrefix(reply.Error(), "IOERR") {
+		t.Errorf("MIGRATE to a closed port = %v", reply)
+	}
+}
+
+// TestCheckClusterSlot checks the redirections of a node serving a slot that
+// migrates to another node and of one importing it, for the slot of {a}.
+func TestCheckClusterSlot(t *testing.T) {
+	newNode := func() (*serverState, *clusterNode) {
+		srv := newTestServer(t)
+		srv.cluster = newClusterState(6379, time.Second)
+		other := newClusterNode(randNodeID(), "127.0.0.1", 7000, 17000)
+		srv.cluster.nodes[other.id] = other
+		return srv, other
+	}
+	slot := strconv.Itoa(keyHashSlot("{a}"))
+	c := &client{id: 1}
+	check := func(srv *serverState, want string, cmd ...string) {
+		t.Helper()
+		reply := call(t, srv, c, cmd...)
+		got := "OK"
+		if err, ok := reply.(error); ok {
+			got = err.Error()
+		}
+		if !strings.HasPrefix(got, want) {
+			t.Errorf("%q = %v, want %s", cmd, reply, want)
+		}
+	}
+
+	source, target := newNode()
+	check(source, "CLUSTERDOWN", "GET", "{a}1")
+	check(source, "OK", "CLUSTER", "ADDSLOTS", slot)
+	check(source, "OK", "SET", "{a}1", "1")
+	check(source, "CROSSSLOT", "DEL", "{a}1", "{b}1")
+	check(source, "OK", "CLUSTER", "SETSLOT", slot, "MIGRATING", target.id)
+	// keys still here are served, those gone are asked for on the target
+	check(source, "OK", "GET", "{a}1")
+	check(source, "ASK "+slot+" 127.0.0.1:7000", "GET", "{a}2")
+	check(source, "TRYAGAIN", "DEL", "{a}1", "{a}2")
+	check(source, "OK", "MIGRATE", "127.0.0.1", "1", "", "0", "100", "KEYS", "{a}2")
+
+	dest, owner := newNode()
+	dest.cluster.slots[keyHashSlot("{a}")] = owner
+	check(dest, "OK", "CLUSTER", "SETSLOT", slot, "IMPORTING", owner.id)
+	check(dest, "MOVED "+slot+" 127.0.0.1:7000", "GET", "{a}1")
+	// ASKING serves the next command only
+	check(dest, "OK", "ASKING")
+	check(dest, "OK", "SET", "{a}1", "1")
+	check(dest, "MOVED", "GET", "{a}1")
+	check(dest, "OK", "ASKING")
+	check(dest, "TRYAGAIN", "DEL", "{a}1", "{a}2")
+	check(dest, "OK", "RESTORE-ASKING", "{a}2", "0", dumpValue("2"))
+	check(dest, "OK", "CLUSTER", "SETSLOT", slot, "NODE", dest.cluster.myself.id)
+	check(dest, "OK", "DEL", "{a}1", "{a}2")
+
+	// a slot served by nobody
+	delete(dest.cluster.nodes, owner.id)
+	check(dest, "OK", "CLUSTER", "DELSLOTS", slot)
+	check(dest, "CLUSTERDOWN", "GET", "{a}1")
+}
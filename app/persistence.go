@@ -2,196 +2,1314 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func readKeyFromRDBFile(rdbPath string, store map[string]string, ttl map[string]time.Time) error {
+func (srv *serverState) rdbFilePath() string {
+	return filepath.Join(srv.config.dbDir, srv.config.dbFileName)
+}
+
+func (srv *serverState) readRDBFile(rdbPath string) error {
 	file, err := os.Open(rdbPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
+	return srv.readRDB(file)
+}
+
+// rdbReader keeps the checksum of the bytes consumed so far. Checksumming the
+// underlying reader instead would include whatever bufio read ahead.
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func newRDBReader(r io.Reader) *rdbReader {
+	return &rdbReader{r: bufio.NewReader(r)}
+}
+
+func (reader *rdbReader) ReadByte() (byte, error) {
+	b, err := reader.r.ReadByte()
+	if err == nil {
+		reader.crc = crc64Jones(reader.crc, []byte{b})
+	}
+	return b, err
+}
+
+// Read fills p entirely, a short read is an error.
+func (reader *rdbReader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(reader.r, p)
+	reader.crc = crc64Jones(reader.crc, p[:n])
+	return n, err
+}
+
+func (reader *rdbReader) Discard(n int) error {
+	_, err := io.CopyN(io.Discard, reader, int64(n))
+	return err
+}
+
+// the newest RDB format version the loader understands
+const rdbVersion = 12
+
+// rdbMaxPrealloc caps what a length read from a payload may preallocate,
+// elements or bytes: larger values grow as their data is actually read.
+const rdbMaxPrealloc = 4096
+
+// RDB opcodes, the bytes that introduce everything but key/value pairs
+const (
+	rdbOpcodeSlotInfo     = 0xF4
+	rdbOpcodeFunction2    = 0xF5
+	rdbOpcodeFunctionPre  = 0xF6
+	rdbOpcodeModuleAux    = 0xF7
+	rdbOpcodeIdle         = 0xF8
+	rdbOpcodeFreq         = 0xF9
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+)
+
+// readRDB loads an RDB payload into the keyspace. The server has a single
+// database: a payload with keys in any other database is refused rather than
+// loaded in part.
+func (srv *serverState) readRDB(r io.Reader) error {
+	reader := newRDBReader(r)
 
 	header := make([]byte, 9)
-	reader.Read(header)
-	if slices.Compare(header[:5], []byte("REDIS")) != 0 {
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return fmt.Errorf("reading the RDB header: %w", err)
+	}
+	if string(header[:5]) != "REDIS" {
 		return errors.New("not a RDB file")
 	}
-
-	version, _ := strconv.Atoi(string(header[5:]))
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		return fmt.Errorf("can't handle RDB format version %q", header[5:])
+	}
 	fmt.Printf("File version: %d\n", version)
 
-	for eof := false; !eof; {
+	db := 0
+	now := time.Now()
+	// expiration and eviction hints apply to the key/value pair that follows
+	var expiration time.Time
 
-		startDataRead := false
+	for {
 		opCode, err := reader.ReadByte()
-
 		if err != nil {
 			if err == io.EOF {
-				break
+				err = io.ErrUnexpectedEOF
 			}
 			return err
 		}
 
-		// TODO: handle errors properly
 		switch opCode {
-		case 0xFA: // Auxiliary fields
-			key, _ := readEncodedString(reader)
-			switch key {
-			case "redis-ver":
-				value, _ := readEncodedString(reader)
-				fmt.Printf("Aux: %s = %v\n", key, value)
-			case "redis-bits":
-				bits, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v\n", key, bits)
-			case "ctime":
-				ctime, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v (%v)\n", key, ctime, time.Unix(int64(ctime), 0))
-			case "used-mem":
-				usedmem, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v\n", key, usedmem)
-			case "aof-preamble":
-				size, _ := readEncodedInt(reader)
-				// preamble := make([]byte, size)
-				// reader.Read(preamble)
-				fmt.Printf("Aux: %s = %d\n", key, size)
-			default:
-				return fmt.Errorf("unknown auxiliary field: %q", key)
+		case rdbOpcodeAux:
+			key, err := readEncodedString(reader)
+			if err != nil {
+				return err
+			}
+			value, err := readEncodedString(reader)
+			if err != nil {
+				return err
 			}
+			fmt.Printf("Aux: %s = %q\n", key, value)
 
-		case 0xFB: // Hash table sizes for the main keyspace and expires
-			keyspace, _ := readEncodedInt(reader)
-			expires, _ := readEncodedInt(reader)
+		case rdbOpcodeResizeDB:
+			keyspace, err := readEncodedInt(reader)
+			if err != nil {
+				return err
+			}
+			expires, err := readEncodedInt(reader)
+			if err != nil {
+				return err
+			}
 			fmt.Printf("Hash table sizes: keyspace = %d, expires = %d\n", keyspace, expires)
-			startDataRead = true
 
-		case 0xFE: // Database Selector
-			db, _ := readEncodedInt(reader)
+		case rdbOpcodeSlotInfo:
+			// slot id, slot size and expires slot size
+			for i := 0; i < 3; i++ {
+				if _, err := readEncodedInt(reader); err != nil {
+					return err
+				}
+			}
+
+		case rdbOpcodeSelectDB:
+			if db, err = readEncodedInt(reader); err != nil {
+				return err
+			}
 			fmt.Printf("Database Selector = %d\n", db)
 
-		case 0xFF: // End of the RDB file
-			// TODO: implement CRC?
-			eof = true
+		case rdbOpcodeExpireTime:
+			var seconds int32
+			if err := binary.Read(reader, binary.LittleEndian, &seconds); err != nil {
+				return err
+			}
+			expiration = time.Unix(int64(seconds), 0)
+
+		case rdbOpcodeExpireTimeMs:
+			var milliseconds int64
+			if err := binary.Read(reader, binary.LittleEndian, &milliseconds); err != nil {
+				return err
+			}
+			expiration = time.UnixMilli(milliseconds)
+
+		case rdbOpcodeIdle:
+			if _, err := readEncodedInt(reader); err != nil {
+				return err
+			}
+
+		case rdbOpcodeFreq:
+			if _, err := reader.ReadByte(); err != nil {
+				return err
+			}
+
+		case rdbOpcodeFunction2, rdbOpcodeFunctionPre:
+			if _, err := readEncodedString(reader); err != nil {
+				return err
+			}
+			fmt.Println("Skipping function library")
+
+		case rdbOpcodeModuleAux:
+			return errors.New("module auxiliary data is not supported")
+
+		case rdbOpcodeEOF:
+			return verifyRDBChecksum(reader, version)
 
 		default:
-			return fmt.Errorf("unknown op code: %x", opCode)
-		}
+			key, err := readEncodedString(reader)
+			if err != nil {
+				return err
+			}
+			if db != 0 {
+				return fmt.Errorf("key %q is in database %d, only database 0 is supported", key, db)
+			}
+			value, err := readRDBValue(reader, opCode)
+			if err != nil {
+				return fmt.Errorf("reading key %q: %w", key, err)
+			}
 
-		if startDataRead {
-			for {
-				valueType, err := reader.ReadByte()
-				if err != nil {
-					return err
+			// a replica keeps expired keys, the master's DEL removes them
+			// (see expireIfNeeded): its full resynch payload may hold keys
+			// the master hasn't expired yet
+			if expiration.IsZero() || expiration.After(now) || srv.config.role != "master" {
+				srv.setValue(key, value)
+				if !expiration.IsZero() {
+					srv.ttl[key] = expiration
 				}
+			}
+			expiration = time.Time{}
+		}
+	}
+}
 
-				var expiration time.Time
-				if valueType == 0xFD {
-					bytes := make([]byte, 4)
-					reader.Read(bytes)
-					expiration = time.Unix(int64(bytes[0])|int64(bytes[1])<<8|int64(bytes[2])<<16|int64(bytes[3])<<24, 0)
-					valueType, err = reader.ReadByte()
-				} else if valueType == 0xFC {
-					bytes := make([]byte, 8)
-					reader.Read(bytes)
-					expiration = time.UnixMilli(int64(bytes[0]) | int64(bytes[1])<<8 | int64(bytes[2])<<16 | int64(bytes[3])<<24 |
-						int64(bytes[4])<<32 | int64(bytes[5])<<40 | int64(bytes[6])<<48 | int64(bytes[7])<<56)
-					valueType, err = reader.ReadByte()
-				} else if valueType == 0xFF {
-					startDataRead = false
-					reader.UnreadByte()
-					break
-				}
+// verifyRDBChecksum compares the checksum trailing the payload (since
+// version 5) with the one of the bytes read. Zero means checksumming was
+// disabled when the file was written.
+func verifyRDBChecksum(reader *rdbReader, version int) error {
+	if version < 5 {
+		return nil
+	}
+	expected := reader.crc
+	var checksum uint64
+	if err := binary.Read(reader, binary.LittleEndian, &checksum); err != nil {
+		return err
+	}
+	if checksum == 0 {
+		fmt.Println("RDB file was saved with checksum disabled: no check performed")
+		return nil
+	}
+	if checksum != expected {
+		return fmt.Errorf("wrong RDB checksum, expected %016x but got %016x", expected, checksum)
+	}
+	return nil
+}
 
-				if err != nil {
-					return err
-				}
+// RDB value types
+const (
+	rdbTypeString            = 0
+	rdbTypeList              = 1
+	rdbTypeSet               = 2
+	rdbTypeZset              = 3
+	rdbTypeHash              = 4
+	rdbTypeZset2             = 5
+	rdbTypeModule            = 6
+	rdbTypeModule2           = 7
+	rdbTypeHashZipmap        = 9
+	rdbTypeListZiplist       = 10
+	rdbTypeSetIntset         = 11
+	rdbTypeZsetZiplist       = 12
+	rdbTypeHashZiplist       = 13
+	rdbTypeListQuicklist     = 14
+	rdbTypeStreamListpacks   = 15
+	rdbTypeHashListpack      = 16
+	rdbTypeZsetListpack      = 17
+	rdbTypeListQuicklist2    = 18
+	rdbTypeStreamListpacks2  = 19
+	rdbTypeSetListpack       = 20
+	rdbTypeStreamListpacks3  = 21
+	rdbQuicklistNodePlain    = 1
+	rdbQuicklistNodePacked   = 2
+	rdbEncodingInt8          = 0
+	rdbEncodingInt16         = 1
+	rdbEncodingInt32         = 2
+	rdbEncodingLZF           = 3
+	rdbSpecialEncodingPrefix = 0b11000000
+)
 
-				if valueType != 0 {
-					return fmt.Errorf("value type not implemented: %x", valueType)
-				}
+// stream listpack entry flags
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// maximum number of entries per stream listpack node
+const streamNodeMaxEntries = 100
+
+// readRDBValue decodes a value of the given type into its in-memory form:
+// string, *stream, []string (list), map[string]struct{} (set),
+// map[string]float64 (sorted set) or map[string]string (hash).
+func readRDBValue(reader *rdbReader, valueType byte) (any, error) {
+	switch valueType {
+	case rdbTypeString:
+		return readEncodedString(reader)
+
+	case rdbTypeList:
+		return readRDBStrings(reader, 1)
+
+	case rdbTypeSet:
+		members, err := readRDBStrings(reader, 1)
+		if err != nil {
+			return nil, err
+		}
+		return toSet(members), nil
+
+	case rdbTypeZset, rdbTypeZset2:
+		size, err := readEncodedInt(reader)
+		if err != nil {
+			return nil, err
+		}
+		zset := make(map[string]float64, min(size, rdbMaxPrealloc))
+		for ; size > 0; size-- {
+			member, err := readEncodedString(reader)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if valueType == rdbTypeZset2 {
+				err = binary.Read(reader, binary.LittleEndian, &score)
+			} else {
+				score, err = readRDBStringDouble(reader)
+			}
+			if err != nil {
+				return nil, err
+			}
+			zset[member] = score
+		}
+		return zset, nil
 
-				key, _ := readEncodedString(reader)
-				value, _ := readEncodedString(reader)
-				fmt.Printf("Reading key/value: %q => %q Expiration: (%v)\n", key, value, expiration)
+	case rdbTypeHash:
+		fields, err := readRDBStrings(reader, 2)
+		if err != nil {
+			return nil, err
+		}
+		return toHash(fields), nil
 
-				now := time.Now()
+	case rdbTypeHashZipmap:
+		blob, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := decodeZipmap([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return toHash(fields), nil
 
-				if expiration.IsZero() || expiration.After(now) {
-					if expiration.After(now) {
-						ttl[key] = expiration
-					}
-					store[key] = value
+	case rdbTypeListZiplist, rdbTypeZsetZiplist, rdbTypeHashZiplist:
+		blob, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements, err := decodeZiplist([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return fromFlatElements(valueType, elements)
+
+	case rdbTypeHashListpack, rdbTypeZsetListpack, rdbTypeSetListpack:
+		blob, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements, err := decodeListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return fromFlatElements(valueType, elements)
+
+	case rdbTypeSetIntset:
+		blob, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		members, err := decodeIntset([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		return toSet(members), nil
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		nodes, err := readEncodedInt(reader)
+		if err != nil {
+			return nil, err
+		}
+		list := []string{}
+		for ; nodes > 0; nodes-- {
+			container := rdbQuicklistNodePacked
+			if valueType == rdbTypeListQuicklist2 {
+				if container, err = readEncodedInt(reader); err != nil {
+					return nil, err
 				}
 			}
+			blob, err := readEncodedString(reader)
+			if err != nil {
+				return nil, err
+			}
+			var elements []string
+			switch {
+			case container == rdbQuicklistNodePlain:
+				elements = []string{blob}
+			case valueType == rdbTypeListQuicklist:
+				elements, err = decodeZiplist([]byte(blob))
+			default:
+				elements, err = decodeListpack([]byte(blob))
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elements...)
 		}
+		return list, nil
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return readRDBStream(reader, valueType)
+
+	case rdbTypeModule, rdbTypeModule2:
+		return nil, errors.New("module value types are not supported")
 	}
+	return nil, fmt.Errorf("value type not implemented: %x", valueType)
+}
 
-	return nil
+// readRDBStrings reads a length prefixed sequence of strings, where the length
+// counts groups of n strings.
+func readRDBStrings(reader *rdbReader, n int) ([]string, error) {
+	size, err := readEncodedInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	// the length is not trusted to size anything before the strings are read
+	strs := make([]string, 0, min(size*n, rdbMaxPrealloc))
+	for i := 0; i < size*n; i++ {
+		s, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
 }
 
-func readEncodedInt(reader *bufio.Reader) (int, error) {
-	mask := byte(0b11000000)
-	b0, err := reader.ReadByte()
+// readRDBStringDouble reads a score of the original zset encoding: a length
+// byte (253 NaN, 254 +inf, 255 -inf) followed by the number as text.
+func readRDBStringDouble(reader *rdbReader) (float64, error) {
+	size, err := reader.ReadByte()
 	if err != nil {
 		return 0, err
 	}
-	if b0&mask == 0b00000000 {
-		return int(b0), nil
-	} else if b0&mask == 0b01000000 {
-		b1, err := reader.ReadByte()
+	switch size {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(data), 64)
+}
+
+func toSet(members []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return set
+}
+
+func toHash(fields []string) map[string]string {
+	hash := make(map[string]string, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		hash[fields[i]] = fields[i+1]
+	}
+	return hash
+}
+
+// fromFlatElements builds the value of a ziplist or listpack encoded type,
+// where hashes store field/value pairs and sorted sets member/score pairs.
+func fromFlatElements(valueType byte, elements []string) (any, error) {
+	switch valueType {
+	case rdbTypeListZiplist:
+		return elements, nil
+	case rdbTypeSetListpack:
+		return toSet(elements), nil
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		if len(elements)%2 != 0 {
+			return nil, errors.New("odd number of hash elements")
+		}
+		return toHash(elements), nil
+	}
+
+	if len(elements)%2 != 0 {
+		return nil, errors.New("odd number of sorted set elements")
+	}
+	zset := make(map[string]float64, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		return int(b1)<<6 | int(b0&mask), nil
-	} else if b0&mask == 0b10000000 {
-		b1, _ := reader.ReadByte()
-		b2, _ := reader.ReadByte()
-		b3, _ := reader.ReadByte()
-		b4, err := reader.ReadByte()
+		zset[elements[i]] = score
+	}
+	return zset, nil
+}
+
+func readRDBStream(reader *rdbReader, valueType byte) (*stream, error) {
+	s := newStream()
+
+	nodes, err := readEncodedInt(reader)
+	if err != nil {
+		return nil, err
+	}
+	for ; nodes > 0; nodes-- {
+		masterID, err := readEncodedString(reader)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		// TODO: check endianness!
-		return int(b1)<<24 | int(b2)<<16 | int(b3)<<8 | int(b4), nil
-	} else if b0 >= 0b11000000 && b0 <= 0b11000010 { // Special format: Integers as String
-		var b1, b2, b3, b4 byte
-		b1, err = reader.ReadByte()
-		if b0 >= 0b11000001 {
-			b2, err = reader.ReadByte()
+		if len(masterID) != 16 {
+			return nil, errors.New("invalid stream node key")
 		}
-		if b0 == 0b11000010 {
-			b3, _ = reader.ReadByte()
-			b4, err = reader.ReadByte()
+		blob, err := readEncodedString(reader)
+		if err != nil {
+			return nil, err
+		}
+		elements, err := decodeListpack([]byte(blob))
+		if err != nil {
+			return nil, err
 		}
+		entries, err := parseStreamNode(elements,
+			binary.BigEndian.Uint64([]byte(masterID[:8])), binary.BigEndian.Uint64([]byte(masterID[8:])))
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		return int(b1) | int(b2)<<8 | int(b3)<<16 | int(b4)<<24, nil
-	} else {
-		return 0, errors.New("not implemented")
+		s.entries = append(s.entries, entries...)
+	}
+
+	// length and last id, then since v2 first id, max deleted id and entries added
+	count := 3
+	if valueType >= rdbTypeStreamListpacks2 {
+		count = 8
+	}
+	fields := make([]uint64, count)
+	for i := range fields {
+		if fields[i], err = readRDBUint(reader); err != nil {
+			return nil, err
+		}
+	}
+	s.last = [2]uint64{fields[1], fields[2]}
+	if len(s.entries) > 0 {
+		s.first = s.entries[0].id
+	}
+	s.entriesAdded = len(s.entries)
+	if valueType >= rdbTypeStreamListpacks2 {
+		s.maxDeletedID = [2]uint64{fields[5], fields[6]}
+		s.entriesAdded = int(fields[7])
 	}
+
+	if err := readRDBStreamGroups(reader, valueType, s); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func readEncodedString(reader *bufio.Reader) (string, error) {
+// readRDBStreamGroups reads the consumer groups of a stream: for each its
+// name, last delivered ID, entries read (since v2), PEL and consumers, whose
+// own PELs refer to the entries of the group PEL by ID.
+func readRDBStreamGroups(reader *rdbReader, valueType byte, s *stream) error {
+	groups, err := readEncodedInt(reader)
+	if err != nil {
+		return err
+	}
+	for ; groups > 0; groups-- {
+		name, err := readEncodedString(reader)
+		if err != nil {
+			return err
+		}
+		var lastID [2]uint64
+		for i := range lastID {
+			if lastID[i], err = readRDBUint(reader); err != nil {
+				return err
+			}
+		}
+		entriesRead := uint64(math.MaxUint64) // unknown before v2
+		if valueType >= rdbTypeStreamListpacks2 {
+			if entriesRead, err = readRDBUint(reader); err != nil {
+				return err
+			}
+		}
+		group := newStreamGroup(name, lastID, int(entriesRead))
+
+		pending, err := readEncodedInt(reader)
+		if err != nil {
+			return err
+		}
+		for ; pending > 0; pending-- {
+			id, err := readRDBStreamID(reader)
+			if err != nil {
+				return err
+			}
+			var deliveryTime int64
+			if err := binary.Read(reader, binary.LittleEndian, &deliveryTime); err != nil {
+				return err
+			}
+			deliveryCount, err := readRDBUint(reader)
+			if err != nil {
+				return err
+			}
+			group.pending[id] = &pendingEntry{id: id, deliveryTime: time.UnixMilli(deliveryTime), deliveryCount: int(deliveryCount)}
+		}
+
+		consumers, err := readEncodedInt(reader)
+		if err != nil {
+			return err
+		}
+		for ; consumers > 0; consumers-- {
+			consumerName, err := readEncodedString(reader)
+			if err != nil {
+				return err
+			}
+			consumer := group.createConsumer(consumerName)
+			var seenTime int64
+			if err := binary.Read(reader, binary.LittleEndian, &seenTime); err != nil {
+				return err
+			}
+			consumer.seenTime = rdbTime(seenTime)
+			consumer.activeTime = consumer.seenTime
+			if valueType >= rdbTypeStreamListpacks3 {
+				var activeTime int64
+				if err := binary.Read(reader, binary.LittleEndian, &activeTime); err != nil {
+					return err
+				}
+				consumer.activeTime = rdbTime(activeTime)
+			}
+			pending, err := readEncodedInt(reader)
+			if err != nil {
+				return err
+			}
+			for ; pending > 0; pending-- {
+				id, err := readRDBStreamID(reader)
+				if err != nil {
+					return err
+				}
+				entry := group.pending[id]
+				if entry == nil || entry.consumer != nil {
+					return fmt.Errorf("consumer %q of group %q has an invalid pending entry", consumerName, name)
+				}
+				entry.consumer = consumer
+				consumer.pending[id] = entry
+			}
+		}
+		for id, entry := range group.pending {
+			if entry.consumer == nil {
+				return fmt.Errorf("pending entry %s of group %q has no consumer", formatStreamID(id), name)
+			}
+		}
+		s.groups[name] = group
+	}
+	return nil
+}
+
+// readRDBStreamID reads an ID stored raw, as two big endian numbers.
+func readRDBStreamID(reader *rdbReader) ([2]uint64, error) {
+	raw := make([]byte, 16)
+	if _, err := io.ReadFull(reader, raw); err != nil {
+		return [2]uint64{}, err
+	}
+	return [2]uint64{binary.BigEndian.Uint64(raw[:8]), binary.BigEndian.Uint64(raw[8:])}, nil
+}
+
+// parseStreamNode decodes the entries of a stream listpack node: a master
+// entry (count, deleted, master fields) followed by entries whose IDs are
+// stored relative to the node's master ID.
+func parseStreamNode(elements []string, masterMs, masterSeq uint64) ([]*streamEntry, error) {
+	pos := 0
+	next := func() (int64, error) {
+		if pos >= len(elements) {
+			return 0, errInvalidListpack
+		}
+		pos++
+		return strconv.ParseInt(elements[pos-1], 10, 64)
+	}
+	nextString := func() (string, error) {
+		if pos >= len(elements) {
+			return "", errInvalidListpack
+		}
+		pos++
+		return elements[pos-1], nil
+	}
+
+	// remaining checks a count read from the node against the elements left,
+	// every one of the items counted taking at least size elements
+	remaining := func(n int64, size int) bool {
+		return n >= 0 && n <= int64((len(elements)-pos)/size)
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := next()
+	if err != nil {
+		return nil, err
+	}
+	numMasterFields, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if !remaining(numMasterFields, 1) {
+		return nil, errInvalidListpack
+	}
+	masterFields := make([]string, numMasterFields)
+	for i := range masterFields {
+		if masterFields[i], err = nextString(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := next(); err != nil { // master entry terminator
+		return nil, err
+	}
+	// an entry takes at least its flags, the two parts of its ID and lp-count
+	if !remaining(count, 4) || !remaining(deleted, 4) || !remaining(count+deleted, 4) {
+		return nil, errInvalidListpack
+	}
+
+	var entries []*streamEntry
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := next()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &streamEntry{id: [2]uint64{masterMs + uint64(msDiff), masterSeq + uint64(seqDiff)}}
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := nextString()
+				if err != nil {
+					return nil, err
+				}
+				entry.store = append(entry.store, field, value)
+			}
+		} else {
+			numFields, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if !remaining(numFields, 2) {
+				return nil, errInvalidListpack
+			}
+			for j := int64(0); j < 2*numFields; j++ {
+				kv, err := nextString()
+				if err != nil {
+					return nil, err
+				}
+				entry.store = append(entry.store, kv)
+			}
+		}
+		if _, err := next(); err != nil { // lp-count
+			return nil, err
+		}
+
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// readRDBUint reads a length: the top two bits of the first byte select 6
+// bits, 14 bits, or a 32 or 64 bit big endian number in the next bytes.
+func readRDBUint(reader *rdbReader) (uint64, error) {
+	b0, err := reader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b0>>6 == 0b00:
+		return uint64(b0), nil
+	case b0>>6 == 0b01:
+		b1, err := reader.ReadByte()
+		return uint64(b0&0x3F)<<8 | uint64(b1), err
+	case b0 == 0b10000000:
+		var v uint32
+		err := binary.Read(reader, binary.BigEndian, &v)
+		return uint64(v), err
+	case b0 == 0b10000001:
+		var v uint64
+		err := binary.Read(reader, binary.BigEndian, &v)
+		return v, err
+	}
+	return 0, fmt.Errorf("unknown length encoding: %x", b0)
+}
+
+// readEncodedInt reads a length used as a count or a size.
+func readEncodedInt(reader *rdbReader) (int, error) {
+	n, err := readRDBUint(reader)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("length out of range: %d", n)
+	}
+	return int(n), nil
+}
+
+func readEncodedString(reader *rdbReader) (string, error) {
+	prefix, err := reader.r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if prefix[0]&rdbSpecialEncodingPrefix == rdbSpecialEncodingPrefix {
+		b0, _ := reader.ReadByte()
+		switch b0 &^ rdbSpecialEncodingPrefix {
+		case rdbEncodingInt8:
+			b, err := reader.ReadByte()
+			return strconv.Itoa(int(int8(b))), err
+		case rdbEncodingInt16:
+			var v int16
+			err := binary.Read(reader, binary.LittleEndian, &v)
+			return strconv.Itoa(int(v)), err
+		case rdbEncodingInt32:
+			var v int32
+			err := binary.Read(reader, binary.LittleEndian, &v)
+			return strconv.Itoa(int(v)), err
+		case rdbEncodingLZF:
+			return readLZFString(reader)
+		}
+		return "", fmt.Errorf("unknown string encoding: %x", b0)
+	}
+
 	size, err := readEncodedInt(reader)
 	if err != nil {
 		return "", err
 	}
-	data := make([]byte, size)
-	actual, err := reader.Read(data)
+	data, err := readRDBBytes(reader, size)
+	return string(data), err
+}
+
+// readRDBBytes reads size bytes, growing the buffer as they arrive so that a
+// bad length in a truncated payload doesn't allocate it all upfront.
+func readRDBBytes(reader *rdbReader, size int) ([]byte, error) {
+	if size > maxBulkLength {
+		return nil, fmt.Errorf("string too long: %d bytes", size)
+	}
+	if size <= rdbMaxPrealloc {
+		data := make([]byte, size)
+		_, err := io.ReadFull(reader, data)
+		return data, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(rdbMaxPrealloc)
+	if _, err := io.CopyN(&buf, reader, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readLZFString(reader *rdbReader) (string, error) {
+	compressedLen, err := readEncodedInt(reader)
+	if err != nil {
+		return "", err
+	}
+	length, err := readEncodedInt(reader)
 	if err != nil {
 		return "", err
 	}
-	if int(size) != actual {
-		return "", errors.New("unexpected string length")
+	if length > maxBulkLength {
+		return "", fmt.Errorf("string too long: %d bytes", length)
+	}
+	compressed, err := readRDBBytes(reader, compressedLen)
+	if err != nil {
+		return "", err
+	}
+	data, err := lzfDecompress(compressed, length)
+	return string(data), err
+}
+
+func writeRDB(w io.Writer, snap *snapshot) error {
+	cw := &crc64Writer{w: w}
+	bw := bufio.NewWriter(cw)
+
+	bw.WriteString("REDIS0011")
+	writeRDBAux(bw, "redis-ver", "7.2.0")
+	bw.WriteByte(rdbOpcodeAux)
+	writeRDBString(bw, "redis-bits")
+	writeRDBIntString(bw, 64)
+	bw.WriteByte(rdbOpcodeAux)
+	writeRDBString(bw, "ctime")
+	writeRDBIntString(bw, int(time.Now().Unix()))
+
+	if size := snap.size(); size > 0 {
+		bw.WriteByte(rdbOpcodeSelectDB)
+		writeRDBLength(bw, 0)
+		bw.WriteByte(rdbOpcodeResizeDB)
+		writeRDBLength(bw, size)
+		writeRDBLength(bw, len(snap.ttl))
+
+		for key, value := range snap.store {
+			writeRDBEntry(bw, snap.ttl, key, value)
+		}
+		for key, s := range snap.streams {
+			writeRDBEntry(bw, snap.ttl, key, s)
+		}
+		for key, list := range snap.lists {
+			writeRDBEntry(bw, snap.ttl, key, list)
+		}
+		for key, set := range snap.sets {
+			writeRDBEntry(bw, snap.ttl, key, set)
+		}
+		for key, zset := range snap.zsets {
+			writeRDBEntry(bw, snap.ttl, key, zset)
+		}
+		for key, hash := range snap.hashes {
+			writeRDBEntry(bw, snap.ttl, key, hash)
+		}
+	}
+
+	bw.WriteByte(rdbOpcodeEOF)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, cw.crc)
+}
+
+func writeRDBEntry(bw *bufio.Writer, ttl map[string]time.Time, key string, value any) {
+	writeRDBExpiry(bw, ttl, key)
+	bw.WriteByte(rdbValueType(value))
+	writeRDBString(bw, key)
+	writeRDBValue(bw, value)
+}
+
+// rdbValueType is the type writeRDBValue encodes value with.
+func rdbValueType(value any) byte {
+	switch value.(type) {
+	case *stream:
+		return rdbTypeStreamListpacks3
+	case []string:
+		return rdbTypeList
+	case map[string]struct{}:
+		return rdbTypeSet
+	case map[string]float64:
+		return rdbTypeZset2
+	case map[string]string:
+		return rdbTypeHash
+	}
+	return rdbTypeString
+}
+
+// writeRDBValue is the counterpart of readRDBValue, for the in-memory forms
+// it returns.
+func writeRDBValue(bw *bufio.Writer, value any) {
+	switch v := value.(type) {
+	case string:
+		writeRDBString(bw, v)
+	case *stream:
+		writeRDBStream(bw, v)
+	case []string:
+		writeRDBLength(bw, len(v))
+		for _, element := range v {
+			writeRDBString(bw, element)
+		}
+	case map[string]struct{}:
+		writeRDBLength(bw, len(v))
+		for member := range v {
+			writeRDBString(bw, member)
+		}
+	case map[string]float64:
+		writeRDBLength(bw, len(v))
+		for member, score := range v {
+			writeRDBString(bw, member)
+			binary.Write(bw, binary.LittleEndian, score)
+		}
+	case map[string]string:
+		writeRDBLength(bw, len(v))
+		for field, value := range v {
+			writeRDBString(bw, field)
+			writeRDBString(bw, value)
+		}
+	}
+}
+
+func writeRDBAux(bw *bufio.Writer, key, value string) {
+	bw.WriteByte(rdbOpcodeAux)
+	writeRDBString(bw, key)
+	writeRDBString(bw, value)
+}
+
+func writeRDBExpiry(bw *bufio.Writer, ttl map[string]time.Time, key string) {
+	if expiration, ok := ttl[key]; ok {
+		bw.WriteByte(rdbOpcodeExpireTimeMs)
+		binary.Write(bw, binary.LittleEndian, expiration.UnixMilli())
+	}
+}
+
+func writeRDBLength(bw *bufio.Writer, length int) {
+	switch {
+	case length >= 0 && length < 1<<6:
+		bw.WriteByte(byte(length))
+	case length >= 0 && length < 1<<14:
+		bw.WriteByte(0b01000000 | byte(length>>8))
+		bw.WriteByte(byte(length))
+	case length >= 0 && length <= 0xFFFFFFFF:
+		bw.WriteByte(0b10000000)
+		binary.Write(bw, binary.BigEndian, uint32(length))
+	default:
+		bw.WriteByte(0b10000001)
+		binary.Write(bw, binary.BigEndian, uint64(length))
+	}
+}
+
+// writeRDBIntString writes a string in the special integer encoding.
+func writeRDBIntString(bw *bufio.Writer, value int) {
+	switch {
+	case value >= -1<<7 && value < 1<<7:
+		bw.WriteByte(0b11000000)
+		bw.WriteByte(byte(value))
+	case value >= -1<<15 && value < 1<<15:
+		bw.WriteByte(0b11000001)
+		binary.Write(bw, binary.LittleEndian, int16(value))
+	default:
+		bw.WriteByte(0b11000010)
+		binary.Write(bw, binary.LittleEndian, int32(value))
+	}
+}
+
+func writeRDBString(bw *bufio.Writer, s string) {
+	writeRDBLength(bw, len(s))
+	bw.WriteString(s)
+}
+
+func writeRDBStream(bw *bufio.Writer, s *stream) {
+	nodes := (len(s.entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	writeRDBLength(bw, nodes)
+
+	for start := 0; start < len(s.entries); start += streamNodeMaxEntries {
+		node := s.entries[start:min(start+streamNodeMaxEntries, len(s.entries))]
+		master := node[0]
+
+		masterID := make([]byte, 16)
+		binary.BigEndian.PutUint64(masterID[:8], master.id[0])
+		binary.BigEndian.PutUint64(masterID[8:], master.id[1])
+		writeRDBString(bw, string(masterID))
+
+		masterFields := streamEntryFields(master)
+		elements := []string{strconv.Itoa(len(node)), "0", strconv.Itoa(len(masterFields))}
+		elements = append(elements, masterFields...)
+		elements = append(elements, "0")
+
+		for _, entry := range node {
+			fields := streamEntryFields(entry)
+			sameFields := slices.Equal(fields, masterFields)
+			flags := 0
+			if sameFields {
+				flags |= streamItemFlagSameFields
+			}
+			elements = append(elements,
+				strconv.Itoa(flags),
+				strconv.FormatInt(int64(entry.id[0]-master.id[0]), 10),
+				strconv.FormatInt(int64(entry.id[1]-master.id[1]), 10))
+			if sameFields {
+				for i := 1; i < len(entry.store); i += 2 {
+					elements = append(elements, entry.store[i])
+				}
+				elements = append(elements, strconv.Itoa(len(fields)+3))
+			} else {
+				elements = append(elements, strconv.Itoa(len(fields)))
+				elements = append(elements, entry.store...)
+				elements = append(elements, strconv.Itoa(2*len(fields)+4))
+			}
+		}
+		writeRDBString(bw, string(encodeListpack(elements)))
+	}
+
+	writeRDBLength(bw, len(s.entries))
+	writeRDBLength(bw, int(s.last[0]))
+	writeRDBLength(bw, int(s.last[1]))
+	var first [2]uint64
+	if len(s.entries) > 0 {
+		first = s.entries[0].id
+	}
+	writeRDBLength(bw, int(first[0]))
+	writeRDBLength(bw, int(first[1]))
+	writeRDBLength(bw, int(s.maxDeletedID[0]))
+	writeRDBLength(bw, int(s.maxDeletedID[1]))
+	writeRDBLength(bw, s.entriesAdded)
+	writeRDBStreamGroups(bw, s)
+}
+
+func writeRDBStreamGroups(bw *bufio.Writer, s *stream) {
+	writeRDBLength(bw, len(s.groups))
+	for _, name := range sortedKeys(s.groups) {
+		group := s.groups[name]
+		writeRDBString(bw, name)
+		writeRDBLength(bw, int(group.lastID[0]))
+		writeRDBLength(bw, int(group.lastID[1]))
+		writeRDBLength(bw, group.entriesRead)
+
+		writeRDBLength(bw, len(group.pending))
+		for _, id := range sortedPendingIDs(group.pending) {
+			pending := group.pending[id]
+			writeRDBStreamID(bw, id)
+			binary.Write(bw, binary.LittleEndian, pending.deliveryTime.UnixMilli())
+			writeRDBLength(bw, pending.deliveryCount)
+		}
+
+		writeRDBLength(bw, len(group.consumers))
+		for _, consumerName := range sortedKeys(group.consumers) {
+			consumer := group.consumers[consumerName]
+			writeRDBString(bw, consumerName)
+			binary.Write(bw, binary.LittleEndian, rdbUnixMilli(consumer.seenTime))
+			binary.Write(bw, binary.LittleEndian, rdbUnixMilli(consumer.activeTime))
+			writeRDBLength(bw, len(consumer.pending))
+			for _, id := range sortedPendingIDs(consumer.pending) {
+				writeRDBStreamID(bw, id)
+			}
+		}
+	}
+}
+
+// rdbUnixMilli converts a consumer time for the RDB file, where -1 stands for
+// a consumer that never did it, as rdbTime reads it back.
+func rdbUnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixMilli()
+}
+
+func rdbTime(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+func writeRDBStreamID(bw *bufio.Writer, id [2]uint64) {
+	binary.Write(bw, binary.BigEndian, id[0])
+	binary.Write(bw, binary.BigEndian, id[1])
+}
+
+func streamEntryFields(entry *streamEntry) []string {
+	fields := make([]string, 0, len(entry.store)/2)
+	for i := 0; i < len(entry.store); i += 2 {
+		fields = append(fields, entry.store[i])
+	}
+	return fields
+}
+
+// saveRDBFile writes the snapshot to a temporary file and renames it over
+// path, so a crash mid-save never leaves a truncated RDB behind.
+func saveRDBFile(path string, snap *snapshot) error {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	err = writeRDB(file, snap)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+func parseSavePoints(value string) ([]savePoint, error) {
+	args := strings.Fields(value)
+	if len(args)%2 != 0 {
+		return nil, errors.New("invalid save parameters")
+	}
+	savePoints := []savePoint{}
+	for i := 0; i < len(args); i += 2 {
+		seconds, err := strconv.Atoi(args[i])
+		if err != nil || seconds < 1 {
+			return nil, fmt.Errorf("invalid save seconds %q", args[i])
+		}
+		changes, err := strconv.Atoi(args[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", args[i+1])
+		}
+		savePoints = append(savePoints, savePoint{seconds, changes})
+	}
+	return savePoints, nil
+}
+
+func formatSavePoints(savePoints []savePoint) string {
+	args := make([]string, 0, 2*len(savePoints))
+	for _, sp := range savePoints {
+		args = append(args, strconv.Itoa(sp.seconds), strconv.Itoa(sp.changes))
+	}
+	return strings.Join(args, " ")
+}
+
+// after a failed background save, wait this long before retrying a save point
+const bgsaveRetryDelay = 5 * time.Second
+
+// checkSavePoints must be called with srv.mu held.
+func (srv *serverState) checkSavePoints() {
+	if srv.bgsaveInProgress {
+		return
+	}
+	if srv.bgsaveScheduled {
+		srv.startBgsave()
+		return
+	}
+
+	now := time.Now()
+	if !srv.lastBgsaveOK && now.Sub(srv.lastBgsaveTry) < bgsaveRetryDelay {
+		return
+	}
+	for _, sp := range srv.config.savePoints {
+		if srv.dirty >= sp.changes && now.Sub(srv.lastSave) >= time.Duration(sp.seconds)*time.Second {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", sp.changes, sp.seconds)
+			srv.startBgsave()
+			return
+		}
+	}
+}
+
+// startBgsave must be called with srv.mu held.
+func (srv *serverState) startBgsave() {
+	snap := srv.takeSnapshot()
+	dirty := srv.dirty
+	path := srv.rdbFilePath()
+
+	srv.bgsaveInProgress = true
+	srv.bgsaveScheduled = false
+	srv.lastBgsaveTry = time.Now()
+
+	go func() {
+		err := saveRDBFile(path, snap)
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		srv.bgsaveInProgress = false
+		srv.lastBgsaveOK = err == nil
+		if err != nil {
+			fmt.Println("Background saving error:", err)
+			return
+		}
+		srv.dirty -= dirty
+		srv.lastSave = time.Now()
+		fmt.Println("Background saving terminated with success")
+	}()
+}
+
+func (srv *serverState) handleSave(c *client, cmd []string) string {
+	if srv.bgsaveInProgress {
+		return encodeError(errors.New("Background save already in progress"))
+	}
+	if err := saveRDBFile(srv.rdbFilePath(), srv.takeSnapshot()); err != nil {
+		fmt.Println("Error saving DB on disk:", err)
+		return encodeError(err)
+	}
+	srv.dirty = 0
+	srv.lastSave = time.Now()
+	return "+OK\r\n"
+}
+
+func (srv *serverState) handleBgsave(c *client, cmd []string) string {
+	schedule := len(cmd) == 2 && strings.ToUpper(cmd[1]) == "SCHEDULE"
+	if len(cmd) > 1 && !schedule {
+		return encodeError(errSyntax)
+	}
+	if srv.bgsaveInProgress {
+		if schedule {
+			srv.bgsaveScheduled = true
+			return encodeSimpleString("Background saving scheduled")
+		}
+		return encodeError(errors.New("Background save already in progress"))
+	}
+	srv.startBgsave()
+	return encodeSimpleString("Background saving started")
+}
+
+func (srv *serverState) handleLastsave(c *client, cmd []string) string {
+	return encodeInteger(int(srv.lastSave.Unix()))
+}
+
+func (srv *serverState) infoPersistence() string {
+	status := "ok"
+	if !srv.lastBgsaveOK {
+		status = "err"
+	}
+	rewriteStatus := "ok"
+	if !srv.aofLastRewriteOK {
+		rewriteStatus = "err"
 	}
-	return string(data), nil
+	return fmt.Sprintf("# Persistence\r\nrdb_changes_since_last_save:%d\r\nrdb_bgsave_in_progress:%d\r\nrdb_last_save_time:%d\r\nrdb_last_bgsave_status:%s\r\n"+
+		"aof_enabled:%d\r\naof_rewrite_in_progress:%d\r\naof_last_bgrewrite_status:%s\r\n",
+		srv.dirty, boolToInt(srv.bgsaveInProgress), srv.lastSave.Unix(), status,
+		boolToInt(srv.config.appendOnly), boolToInt(srv.aofRewriteInProgress), rewriteStatus)
 }
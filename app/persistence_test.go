@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64Jones(t *testing.T) {
+	// the check value Redis tests its implementation with
+	if crc := crc64Jones(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64Jones = %016x", crc)
+	}
+}
+
+// rdbFixture is the keyspace expected from one of the synthetic files of
+// testdata, see testdata/genrdb.go. stream is the format version of the
+// "stream" key, 0 when there is none.
+type rdbFixture struct {
+	file   string
+	store  map[string]string
+	lists  map[string][]string
+	sets   map[string]map[string]struct{}
+	zsets  map[string]map[string]float64
+	hashes map[string]map[string]string
+	ttl    map[string]time.Time
+	stream int
+}
+
+var rdbFixtures = []rdbFixture{
+	{
+		file: "synthetic-redis-2.8.rdb",
+		store: map[string]string{
+			"string": "hello", "int8": "-128", "int16": "12345", "int32": "123456789",
+			"lzf": strings.Repeat("a", 20), "expiring": "later",
+		},
+		lists: map[string][]string{"list": {"a", "b"}, "ziplist": {"a", "7", "-100", "1000", "100000", "bb"}},
+		sets:  map[string]map[string]struct{}{"set": toSet([]string{"x", "y"}), "intset": toSet([]string{"-5", "1", "300"})},
+		zsets: map[string]map[string]float64{
+			"zset":        {"one": 1, "half": 0.5, "top": math.Inf(1)},
+			"zsetziplist": {"a": 1.5, "b": 2},
+		},
+		hashes: map[string]map[string]string{
+			"hash":        {"field": "value"},
+			"zipmap":      {"f1": "v1", "f2": "v2"},
+			"hashziplist": {"f": "v", "n": "12"},
+		},
+		ttl: map[string]time.Time{"expiring": time.Unix(math.MaxInt32, 0)},
+	},
+	{
+		file:  "synthetic-redis-3.2.rdb",
+		store: map[string]string{"string": "value"},
+		lists: map[string][]string{"quicklist": {"a", "b", "3", "c"}},
+		sets:  map[string]map[string]struct{}{"intset64": toSet([]string{"-5000000000", "5000000000"})},
+		ttl:   map[string]time.Time{"string": time.UnixMilli(4102444800000)},
+	},
+	{
+		file:   "synthetic-redis-5.0.rdb",
+		lists:  map[string][]string{"quicklist": {"x", "y", "z"}},
+		zsets:  map[string]map[string]float64{"zset2": {"a": 1.5, "b": -2}},
+		stream: 1,
+	},
+	{
+		file:   "synthetic-redis-7.0.rdb",
+		lists:  map[string][]string{"list": {"a", "-3000", "a large element"}},
+		zsets:  map[string]map[string]float64{"zset": {"m1": 1.5, "m2": 3}},
+		hashes: map[string]map[string]string{"hash": {"f1": "v1", "f2": "77"}},
+		stream: 2,
+	},
+	{
+		file:   "synthetic-redis-7.2.rdb",
+		sets:   map[string]map[string]struct{}{"set": toSet([]string{"a", "b", "3"})},
+		stream: 3,
+	},
+	{
+		file:   "synthetic-redis-7.4.rdb",
+		hashes: map[string]map[string]string{"hash": {"f": "v"}},
+		ttl:    map[string]time.Time{"hash": time.UnixMilli(4102444800000)},
+	},
+}
+
+// checkKeys compares a part of the keyspace, nil and empty maps alike.
+func checkKeys[V any](t *testing.T, kind string, got, want map[string]V) {
+	t.Helper()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", kind, got, want)
+	}
+}
+
+func TestLoadRDBFixtures(t *testing.T) {
+	for _, fixture := range rdbFixtures {
+		t.Run(fixture.file, func(t *testing.T) {
+			srv := newTestServer(t)
+			if err := srv.readRDBFile(filepath.Join("testdata", fixture.file)); err != nil {
+				t.Fatal(err)
+			}
+			checkKeys(t, "strings", srv.store, fixture.store)
+			checkKeys(t, "lists", srv.lists, fixture.lists)
+			checkKeys(t, "sets", srv.sets, fixture.sets)
+			checkKeys(t, "sorted sets", srv.zsets, fixture.zsets)
+			checkKeys(t, "hashes", srv.hashes, fixture.hashes)
+			checkKeys(t, "expiration times", srv.ttl, fixture.ttl)
+
+			if fixture.stream == 0 {
+				checkKeys(t, "streams", srv.streams, nil)
+				return
+			}
+			s := srv.streams["stream"]
+			if s == nil {
+				t.Fatalf("streams = %v, want a stream", srv.streams)
+			}
+			checkFixtureStream(t, s, fixture.stream)
+		})
+	}
+}
+
+// checkFixtureStream checks the stream written by testdata/genrdb.go in the
+// given format version: the first one knows neither deleted entries nor
+// entries read, the third adds the active time of consumers.
+func checkFixtureStream(t *testing.T, s *stream, version int) {
+	t.Helper()
+	var entries [][]string
+	for _, entry := range s.entries {
+		entries = append(entries, append([]string{formatStreamID(entry.id)}, entry.store...))
+	}
+	wantEntries := [][]string{
+		{"1000-0", "f1", "a", "f2", "b"},
+		{"1000-1", "other", "c"},
+		{"1002-0", "f1", "d", "f2", ""},
+	}
+	if !reflect.DeepEqual(entries, wantEntries) {
+		t.Errorf("entries = %q, want %q", entries, wantEntries)
+	}
+
+	first, last, maxDeletedID, entriesAdded, entriesRead := [2]uint64{1000, 0}, [2]uint64{1002, 0}, [2]uint64{1001, 0}, 4, 2
+	if version == 1 {
+		maxDeletedID, entriesAdded, entriesRead = [2]uint64{}, 3, -1
+	}
+	if s.first != first || s.last != last || s.maxDeletedID != maxDeletedID || s.entriesAdded != entriesAdded {
+		t.Errorf("first %v, last %v, max deleted %v, entries added %d; want %v, %v, %v, %d",
+			s.first, s.last, s.maxDeletedID, s.entriesAdded, first, last, maxDeletedID, entriesAdded)
+	}
+
+	group := s.groups["g"]
+	if len(s.groups) != 1 || group == nil {
+		t.Fatalf("groups = %v, want g", s.groups)
+	}
+	if group.lastID != [2]uint64{1000, 1} || group.entriesRead != entriesRead {
+		t.Errorf("group last ID %v, entries read %d; want 1000-1, %d", group.lastID, group.entriesRead, entriesRead)
+	}
+
+	alice, bob := group.consumers["alice"], group.consumers["bob"]
+	if len(group.consumers) != 2 || alice == nil || bob == nil {
+		t.Fatalf("consumers = %v, want alice and bob", group.consumers)
+	}
+	pending := group.pending[[2]uint64{1000, 0}]
+	if len(group.pending) != 1 || pending == nil || pending.consumer != alice || alice.pending[pending.id] != pending || len(bob.pending) != 0 ||
+		pending.deliveryCount != 2 || !pending.deliveryTime.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("pending entries = %v, want 1000-0 delivered twice to alice", group.pending)
+	}
+
+	aliceActive, bobActive := time.UnixMilli(1700000001000), time.UnixMilli(1700000002000)
+	if version >= 3 {
+		aliceActive, bobActive = time.UnixMilli(1700000000000), time.Time{}
+	}
+	for _, check := range []struct {
+		consumer     *streamConsumer
+		seen, active time.Time
+	}{
+		{alice, time.UnixMilli(1700000001000), aliceActive},
+		{bob, time.UnixMilli(1700000002000), bobActive},
+	} {
+		if !check.consumer.seenTime.Equal(check.seen) || !check.consumer.activeTime.Equal(check.active) {
+			t.Errorf("%s seen %v, active %v; want %v, %v", check.consumer.name,
+				check.consumer.seenTime, check.consumer.activeTime, check.seen, check.active)
+		}
+	}
+}
+
+func TestLoadRDBErrors(t *testing.T) {
+	srv := newTestServer(t)
+	err := srv.readRDBFile(filepath.Join("testdata", "corrupt-checksum.rdb"))
+	if err == nil || !strings.Contains(err.Error(), "wrong RDB checksum") {
+		t.Errorf("loading a file with a wrong checksum: %v", err)
+	}
+
+	// keys of another database are refused, not dropped
+	err = srv.readRDB(strings.NewReader("REDIS0011\xFE\x00\x00\x01a\x01a\xFE\x01\x00\x01b\x01b\xFF"))
+	if err == nil || !strings.Contains(err.Error(), "database 1") {
+		t.Errorf("loading a file with keys in database 1: %v", err)
+	}
+
+	// every truncation of a valid file is an error, never a partial load
+	valid, err := os.ReadFile(filepath.Join("testdata", "synthetic-redis-7.2.rdb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(valid) {
+		if err := srv.readRDB(bytes.NewReader(valid[:n])); err == nil {
+			t.Fatalf("loading the first %d bytes of %d succeeded", n, len(valid))
+		}
+	}
+}
+
+// TestLoadRDBExpiredKeys loads a payload holding an expired key: a master
+// drops it, a replica loading its master's payload keeps it until the DEL of
+// the master arrives.
+func TestLoadRDBExpiredKeys(t *testing.T) {
+	master := newTestServer(t)
+	master.store["expired"] = "value"
+	master.ttl["expired"] = time.Now().Add(-time.Minute)
+	master.store["live"] = "value"
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, master.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestServer(t)
+	if err := loaded.readRDB(bytes.NewReader(rdb.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.store["expired"]; ok || loaded.store["live"] != "value" {
+		t.Errorf("a master loaded %v", loaded.store)
+	}
+
+	replica := newTestServer(t)
+	replica.config.role = "slave"
+	payload := bufio.NewReader(strings.NewReader(fmt.Sprintf("$%d\r\n%s", rdb.Len(), rdb.Bytes())))
+	if err := replica.loadFullResynch(replica.replGeneration, payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := replica.store["expired"]; !ok || replica.store["live"] != "value" {
+		t.Errorf("a replica loaded %v", replica.store)
+	}
+	c := &client{id: 1}
+	if reply := call(t, replica, c, "GET", "expired"); reply != nil {
+		t.Errorf("GET of the expired key on the replica = %v", reply)
+	}
+	call(t, replica, &client{id: 2, master: true}, "DEL", "expired")
+	if _, ok := replica.store["expired"]; ok {
+		t.Error("the DEL of the master didn't remove the expired key")
+	}
+}
+
+func TestParseStreamNodeBounds(t *testing.T) {
+	for _, elements := range [][]string{
+		{"1", "0", "-1", "0"},                                  // negative master field count
+		{"1", "0", "4000000000", "0"},                          // more master fields than elements
+		{"-1", "0", "0", "0"},                                  // negative entry count
+		{"9223372036854775807", "1", "0", "0"},                 // entry count overflowing with the deleted ones
+		{"1", "0", "0", "0", "0", "0", "0", "-1", "1"},         // negative field count
+		{"1", "0", "0", "0", "0", "0", "0", "1000000000", "1"}, // more fields than elements
+	} {
+		if entries, err := parseStreamNode(elements, 0, 0); err == nil {
+			t.Errorf("parseStreamNode(%q) = %v, want an error", elements, entries)
+		}
+	}
+}
+
+func TestLoadRDBBadLengths(t *testing.T) {
+	srv := newTestServer(t)
+	for _, value := range [][]byte{
+		{rdbTypeSet, 0x80, 0x7F, 0xFF, 0xFF, 0xFF, 1, 'a'},  // a set of 2^31-1 members
+		{rdbTypeZset2, 0x80, 0x7F, 0xFF, 0xFF, 0xFF},        // a sorted set as large
+		{rdbTypeString, 0x80, 0x1F, 0xFF, 0xFF, 0xFF, 'a'},  // a string of 512 MB
+		{rdbTypeString, 0xC3, 0x01, 0x80, 0x1F, 0xFF, 0xFF}, // a compressed string as large
+	} {
+		payload := append([]byte("REDIS0011\xFE\x00"), value[0], 1, 'k')
+		payload = append(payload, value[1:]...)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := srv.readRDB(bytes.NewReader(payload))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("loading % x succeeded", payload)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("loading % x allocated %d bytes", payload, allocated)
+		}
+	}
+}
+
+// waitBgsave waits for the background save of srv to finish and checks it
+// succeeded.
+func waitBgsave(t *testing.T, srv *serverState) {
+	t.Helper()
+	waitFor(t, 5*time.Second, "the background save to finish", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return !srv.bgsaveInProgress
+	})
+	if !srv.lastBgsaveOK {
+		t.Fatal("the background save failed")
+	}
+}
+
+// loadRDBFile loads the RDB file of srv into a new server.
+func loadRDBFile(t *testing.T, srv *serverState) *serverState {
+	t.Helper()
+	loaded := newTestServer(t)
+	if err := loaded.readRDBFile(srv.rdbFilePath()); err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// TestSave checks that SAVE writes a file holding the keyspace and moves
+// LASTSAVE forward.
+func TestSave(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "SET", "string", "value", "EX", "3600")
+	call(t, srv, c, "RPUSH", "list", "a", "b")
+	call(t, srv, c, "XADD", "stream", "1-1", "f", "v")
+	srv.mu.Lock()
+	srv.lastSave = srv.lastSave.Add(-time.Minute)
+	srv.mu.Unlock()
+	before := call(t, srv, c, "LASTSAVE").(int)
+
+	if reply := call(t, srv, c, "SAVE"); reply != "OK" {
+		t.Fatalf("SAVE = %v", reply)
+	}
+	if after := call(t, srv, c, "LASTSAVE").(int); after <= before {
+		t.Errorf("LASTSAVE = %d after SAVE, %d before", after, before)
+	}
+	if dirty := srv.dirty; dirty != 0 {
+		t.Errorf("%d changes since the SAVE", dirty)
+	}
+	checkSameKeyspace(t, loadRDBFile(t, srv), srv)
+}
+
+// TestBgsave checks that BGSAVE saves the keyspace as it was when it started,
+// while writes go on, and refuses to run twice at once.
+func TestBgsave(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for i := range 1000 {
+		call(t, srv, c, "SET", "key:"+strconv.Itoa(i), "before")
+	}
+
+	// the save can't finish while the lock is held
+	srv.mu.Lock()
+	replies := []string{
+		srv.handleBgsave(c, []string{"BGSAVE"}),
+		srv.handleBgsave(c, []string{"BGSAVE"}),
+		srv.handleSave(c, []string{"SAVE"}),
+		srv.handleBgsave(c, []string{"BGSAVE", "SCHEDULE"}),
+	}
+	srv.mu.Unlock()
+	for i, want := range []string{
+		"+Background saving started\r\n",
+		"-ERR Background save already in progress\r\n",
+		"-ERR Background save already in progress\r\n",
+		"+Background saving scheduled\r\n",
+	} {
+		if replies[i] != want {
+			t.Errorf("reply %d = %q, want %q", i, replies[i], want)
+		}
+	}
+
+	snapshot := map[string]string{}
+	for key, value := range srv.store {
+		snapshot[key] = value
+	}
+	for i := range 1000 {
+		call(t, srv, c, "SET", "key:"+strconv.Itoa(i), "during")
+	}
+	waitBgsave(t, srv)
+	loaded := loadRDBFile(t, srv)
+	checkKeys(t, "saved strings", loaded.store, snapshot)
+	if srv.dirty != 1000 {
+		t.Errorf("%d changes since the BGSAVE, want the 1000 made during it", srv.dirty)
+	}
+
+	// the scheduled save starts once the first one is done
+	srv.mu.Lock()
+	srv.checkSavePoints()
+	srv.mu.Unlock()
+	waitBgsave(t, srv)
+	checkSameKeyspace(t, loadRDBFile(t, srv), srv)
+}
+
+// TestSavePoints checks that a save point starts a background save once
+// enough changes were made since the last save, long enough ago.
+func TestSavePoints(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	if reply := call(t, srv, c, "CONFIG", "SET", "save", "1 2"); reply != "OK" {
+		t.Fatalf("CONFIG SET save: %v", reply)
+	}
+	checkSavePoints := func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.checkSavePoints()
+		return srv.bgsaveInProgress
+	}
+
+	call(t, srv, c, "SET", "a", "1")
+	call(t, srv, c, "SET", "b", "2")
+	if checkSavePoints() {
+		t.Fatal("a save point fired before its time")
+	}
+	srv.mu.Lock()
+	srv.lastSave = srv.lastSave.Add(-2 * time.Second)
+	srv.mu.Unlock()
+	before := call(t, srv, c, "LASTSAVE").(int)
+	call(t, srv, c, "DEL", "b")
+	if !checkSavePoints() {
+		t.Fatal("the save point didn't fire")
+	}
+	waitBgsave(t, srv)
+	if after := call(t, srv, c, "LASTSAVE").(int); after <= before {
+		t.Errorf("LASTSAVE = %d after the save point fired, %d before", after, before)
+	}
+	checkSameKeyspace(t, loadRDBFile(t, srv), srv)
+	if checkSavePoints() {
+		t.Error("the save point fired again without changes")
+	}
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bufio"
-	"encoding/hex"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,8 +16,44 @@ import (
 
 type replica struct {
 	conn      net.Conn
-	offset    int
+	host      string
+	port      int
 	ackOffset int
+	// online is false until the full resynch payload is sent, meanwhile
+	// propagated commands are buffered in pending
+	online  bool
+	pending []byte
+	// out queues the replication stream once online, see
+	// writeReplicationStream
+	out     chan []byte
+	lastAck time.Time
+}
+
+// replicaOutputQueue is how many writes a replica may fall behind before its
+// link is dropped, making it resynchronize.
+const replicaOutputQueue = 4096
+
+// drop closes the link of r, ending its writer and serveReplica.
+func (r *replica) drop() {
+	if r.out != nil {
+		close(r.out)
+		r.out = nil
+	}
+	r.conn.Close()
+}
+
+// writeReplicationStream writes the queued stream to a replica until its link
+// is dropped. A write that fails or takes longer than timeout closes the
+// connection, which ends serveReplica.
+func writeReplicationStream(conn net.Conn, out <-chan []byte, timeout time.Duration) {
+	for data := range out {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write(data); err != nil {
+			fmt.Printf("Disconnected: %s\n", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+	}
 }
 
 func randReplid() string {
@@ -29,144 +66,624 @@ func randReplid() string {
 	return string(result)
 }
 
-func (srv *serverState) replicaHandshake() {
-	masterConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", "0.0.0.0", srv.config.masterPort))
+// replica link states, as reported by INFO replication
+const (
+	replStateConnecting = "connecting"
+	replStateHandshake  = "handshake"
+	replStateSync       = "sync"
+	replStateConnected  = "connected"
+)
+
+const (
+	replReconnectMinDelay = 100 * time.Millisecond
+	replReconnectMaxDelay = 5 * time.Second
+)
+
+// parseReplicaOf returns the master address of --replicaof, given either as
+// one "host port" string or as the host followed by the port argument.
+func parseReplicaOf(value string, args []string) (string, int, error) {
+	fields := append(strings.Fields(value), args...)
+	switch len(fields) {
+	case 1:
+		return fields[0], 6379, nil
+	case 2:
+		port, err := strconv.Atoi(fields[1])
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, fmt.Errorf("invalid master port %q", fields[1])
+		}
+		return fields[0], port, nil
+	}
+	return "", 0, fmt.Errorf("expected <host> <port>, got %q", strings.Join(fields, " "))
+}
+
+// formatReplid shows a missing replication ID the way Redis does.
+func formatReplid(replid string) string {
+	if replid == "" {
+		return strings.Repeat("0", 40)
+	}
+	return replid
+}
+
+// promoteToMaster turns a replica into a master keeping its dataset. Its
+// replication ID stays valid as the secondary one up to the current offset,
+// so the other replicas of the former master can continue with PSYNC.
+// Called with srv.mu held.
+func (srv *serverState) promoteToMaster() {
+	if srv.config.replid != "" {
+		srv.config.replid2 = srv.config.replid
+		srv.config.secondReplOffset = srv.config.replOffset + 1
+	}
+	srv.config.replid = randReplid()
+	if srv.config.role == "slave" {
+		// our own replicas learn the new ID when they reconnect
+		srv.disconnectReplicas()
+	}
+	srv.config.role = "master"
+	srv.config.masterHost, srv.config.masterPort = "", 0
+	srv.replGeneration++
+	if srv.masterConn != nil {
+		srv.masterConn.Close()
+		srv.masterConn = nil
+	}
+	srv.replState = ""
+	if srv.backlog == nil {
+		srv.backlog = newReplicationBacklog(srv.config.replBacklogSize)
+	}
+}
+
+// replicaOf starts replicating from host:port, dropping the link with the
+// previous master if any. The dataset, replication ID and offset are kept to
+// attempt a partial resynch. Called with srv.mu held.
+func (srv *serverState) replicaOf(host string, port int) {
+	if srv.config.role == "master" {
+		// they would miss the writes streamed by the new master
+		srv.disconnectReplicas()
+	}
+	srv.config.role = "slave"
+	srv.config.masterHost, srv.config.masterPort = host, port
+	srv.replGeneration++
+	if srv.masterConn != nil {
+		srv.masterConn.Close()
+		srv.masterConn = nil
+	}
+	srv.replState = replStateConnecting
+	go srv.replicationLoop(srv.replGeneration)
+}
+
+// addReplica registers the replica link of c, buffering what is propagated
+// until attachReplica brings it online. Called with srv.mu held.
+func (srv *serverState) addReplica(c *client) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	srv.replicas = append(srv.replicas, replica{
+		conn:    c.conn,
+		host:    host,
+		port:    c.listeningPort,
+		lastAck: time.Now(),
+	})
+}
+
+// disconnectReplicas drops every replica link, making the replicas reconnect
+// and resynchronize. Called with srv.mu held.
+func (srv *serverState) disconnectReplicas() {
+	for i := range srv.replicas {
+		srv.replicas[i].drop()
+	}
+	srv.replicas = nil
+	srv.cancelDisklessSync()
+}
+
+func (srv *serverState) handleReplicaof(c *client, cmd []string) string {
+	if strings.ToUpper(cmd[1]) == "NO" && strings.ToUpper(cmd[2]) == "ONE" {
+		if srv.config.role == "slave" {
+			srv.promoteToMaster()
+			fmt.Println("MASTER MODE enabled (user request)")
+		}
+		return "+OK\r\n"
+	}
+
+	if srv.failover != nil {
+		return encodeError(errors.New("REPLICAOF not allowed while failing over."))
+	}
+	port, err := strconv.Atoi(cmd[2])
+	if err != nil || port < 1 || port > 65535 {
+		return encodeError(errors.New("Invalid master port"))
+	}
+	if srv.config.role == "slave" && srv.config.masterHost == cmd[1] && srv.config.masterPort == port {
+		return "+OK Already connected to specified master\r\n"
+	}
+	srv.replicaOf(cmd[1], port)
+	fmt.Printf("REPLICAOF %s:%d enabled (user request)\n", cmd[1], port)
+	return "+OK\r\n"
+}
+
+var errMasterChanged = errors.New("master changed")
+
+// replicationLoop keeps the link with the master up, reconnecting with an
+// exponential backoff whenever it breaks. It stops once the link generation
+// gen is superseded by REPLICAOF, FAILOVER or a promotion.
+func (srv *serverState) replicationLoop(gen int) {
+	delay := replReconnectMinDelay
+	for {
+		err := srv.connectToMaster(gen)
+
+		srv.mu.Lock()
+		if gen != srv.replGeneration {
+			srv.mu.Unlock()
+			return
+		}
+		connected := srv.replState == replStateConnected
+		srv.replState = replStateConnecting
+		srv.masterConn = nil
+		srv.mu.Unlock()
+
+		if connected {
+			delay = replReconnectMinDelay
+		}
+		fmt.Printf("MASTER <-> REPLICA link down: %v, reconnecting in %v\n", err, delay)
+		time.Sleep(delay)
+		delay = min(2*delay, replReconnectMaxDelay)
+	}
+}
+
+// setReplState moves the link of generation gen to state, failing if the
+// link was superseded meanwhile.
+func (srv *serverState) setReplState(gen int, state string) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if gen != srv.replGeneration {
+		return errMasterChanged
+	}
+	srv.replState = state
+	srv.masterLastIO = time.Now()
+	return nil
+}
+
+// connectToMaster goes through the handshake and sync, then applies the
+// commands streamed by the master until the link breaks.
+func (srv *serverState) connectToMaster(gen int) error {
+	srv.mu.Lock()
+	address := net.JoinHostPort(srv.config.masterHost, strconv.Itoa(srv.config.masterPort))
+	timeout := time.Duration(srv.config.replTimeout) * time.Second
+	srv.mu.Unlock()
+	if err := srv.setReplState(gen, replStateConnecting); err != nil {
+		return err
+	}
+
+	masterConn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
-		fmt.Printf("Failed to connect to master %v\n", err)
-		os.Exit(1)
+		return err
 	}
+	defer masterConn.Close()
+	fmt.Printf("Connected to master %s\n", address)
 
+	srv.mu.Lock()
+	if gen != srv.replGeneration {
+		srv.mu.Unlock()
+		return errMasterChanged
+	}
+	srv.masterConn = masterConn
+	srv.replState = replStateHandshake
+	srv.masterLastIO = time.Now()
+	srv.mu.Unlock()
+
+	// nothing should take longer than repl-timeout until the sync is done
+	masterConn.SetReadDeadline(time.Now().Add(timeout))
 	reader := bufio.NewReader(masterConn)
-	masterConn.Write([]byte(encodeStringArray([]string{"PING"})))
-	reader.ReadString('\n')
-	masterConn.Write([]byte(encodeStringArray([]string{"REPLCONF", "listening-port", strconv.Itoa(srv.config.port)})))
-	reader.ReadString('\n')
-	masterConn.Write([]byte(encodeStringArray([]string{"REPLCONF", "capa", "psync2"})))
-	reader.ReadString('\n')
-	masterConn.Write([]byte(encodeStringArray([]string{"PSYNC", "?", "-1"})))
-	reader.ReadString('\n')
-
-	response, _ := reader.ReadString('\n')
-	if response[0] != '$' {
-		fmt.Printf("Invalid response\n")
-		os.Exit(1)
-	}
-	rdbSize, _ := strconv.Atoi(response[1 : len(response)-2])
-	buffer := make([]byte, rdbSize)
-	receivedSize, err := reader.Read(buffer)
+
+	if _, err := sendHandshakeCommand(masterConn, reader, "PING"); err != nil {
+		return err
+	}
+	if _, err := sendHandshakeCommand(masterConn, reader, "REPLCONF", "listening-port", strconv.Itoa(srv.config.port)); err != nil {
+		return err
+	}
+	if _, err := sendHandshakeCommand(masterConn, reader, "REPLCONF", "capa", "eof", "capa", "psync2"); err != nil {
+		// an old master without PSYNC2, nothing to worry about
+		fmt.Printf("Master does not understand REPLCONF capa: %v\n", err)
+	}
+
+	// continue from where we left off if we ever synced with a master
+	srv.mu.Lock()
+	psync := []string{"PSYNC", "?", "-1"}
+	if srv.config.replid != "" {
+		psync = []string{"PSYNC", srv.config.replid, strconv.Itoa(srv.config.replOffset + 1)}
+	}
+	srv.mu.Unlock()
+	if err := srv.setReplState(gen, replStateSync); err != nil {
+		return err
+	}
+
+	response, err := sendHandshakeCommand(masterConn, reader, psync...)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(response)
+	switch {
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		srv.mu.Lock()
+		if gen != srv.replGeneration {
+			srv.mu.Unlock()
+			return errMasterChanged
+		}
+		if len(fields) == 2 && fields[1] != srv.config.replid {
+			// the master was promoted, our history is still valid
+			srv.config.replid2 = srv.config.replid
+			srv.config.secondReplOffset = srv.config.replOffset + 1
+			srv.config.replid = fields[1]
+			// let our replicas learn the new ID through PSYNC
+			srv.disconnectReplicas()
+		}
+		if srv.backlog == nil {
+			srv.backlog = newReplicationBacklog(srv.config.replBacklogSize)
+		}
+		srv.mu.Unlock()
+		fmt.Printf("Partial resynch with master from offset %s\n", psync[2])
+
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		offset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("invalid PSYNC reply %q", response)
+		}
+		if err := srv.loadFullResynch(gen, reader); err != nil {
+			return fmt.Errorf("loading the RDB received from master: %w", err)
+		}
+		srv.mu.Lock()
+		srv.config.replid = fields[1]
+		srv.config.replOffset = offset
+		srv.config.replid2 = ""
+		srv.config.secondReplOffset = -1
+		// our replicas hold a history that no longer exists
+		srv.disconnectReplicas()
+		srv.backlog = newReplicationBacklog(srv.config.replBacklogSize)
+		srv.mu.Unlock()
+
+	default:
+		return fmt.Errorf("unexpected PSYNC reply %q", response)
+	}
+
+	if err := srv.setReplState(gen, replStateConnected); err != nil {
+		return err
+	}
+	fmt.Println("MASTER <-> REPLICA sync: finished with success")
+
+	return srv.handlePropagation(reader, masterConn)
+}
+
+// sendHandshakeCommand sends a command to the master and returns its single
+// line reply, turning error replies into errors.
+func sendHandshakeCommand(conn net.Conn, reader *bufio.Reader, cmd ...string) (string, error) {
+	if _, err := conn.Write([]byte(encodeStringArray(cmd))); err != nil {
+		return "", err
+	}
+	response, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Printf("Invalid RDB received %v\n", err)
-		os.Exit(1)
+		return "", fmt.Errorf("reading %s reply: %w", cmd[0], err)
 	}
-	if rdbSize != receivedSize {
-		fmt.Printf("Size mismatch - got: %d, want: %d\n", receivedSize, rdbSize)
+	response = strings.TrimRight(response, "\r\n")
+	if strings.HasPrefix(response, "-") {
+		return "", fmt.Errorf("error reply to %s: %s", cmd[0], response[1:])
 	}
+	return response, nil
+}
 
-	go srv.handlePropagation(reader, masterConn)
+// loadFullResynch replaces the keyspace with the RDB payload that follows a
+// +FULLRESYNC reply.
+func (srv *serverState) loadFullResynch(gen int, reader *bufio.Reader) error {
+	payload, err := readResynchPayload(reader)
+	if err != nil {
+		return err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if gen != srv.replGeneration {
+		return errMasterChanged
+	}
+	srv.flushKeyspace()
+	if err := srv.readRDB(bytes.NewReader(payload)); err != nil {
+		return err
+	}
+	fmt.Printf("Loaded %d bytes of RDB from master\n", len(payload))
+	return nil
 }
 
-var emptyRDB = []byte("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
+// attachReplica runs once the PSYNC reply is sent: it sends the full resynch
+// payload if needed, then the commands propagated meanwhile, and marks the
+// replica online.
+func (srv *serverState) attachReplica(c *client) error {
+	var err error
+	switch {
+	case c.disklessSync != nil:
+		err = srv.sendDisklessResynch(c)
+	case c.resynch != nil:
+		srv.mu.Lock()
+		dir := srv.config.dbDir
+		srv.mu.Unlock()
+		err = sendDiskResynch(c, dir)
+		c.resynch = nil
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
-func sendFullResynch(conn net.Conn) int {
-	buffer := make([]byte, hex.DecodedLen(len(emptyRDB)))
-	// TODO: check for errors
-	hex.Decode(buffer, emptyRDB)
-	conn.Write([]byte(fmt.Sprintf("$%d\r\n", len(buffer))))
-	conn.Write(buffer)
-	return len(buffer)
+	for i := range srv.replicas {
+		r := &srv.replicas[i]
+		if r.conn != c.conn {
+			continue
+		}
+		if err != nil {
+			srv.removeReplica(c.conn)
+			return err
+		}
+		r.out = make(chan []byte, replicaOutputQueue)
+		go writeReplicationStream(r.conn, r.out, time.Duration(srv.config.replTimeout)*time.Second)
+		if len(r.pending) > 0 {
+			r.out <- r.pending
+		}
+		r.online = true
+		r.lastAck = time.Now()
+		r.pending = nil
+		break
+	}
+	return nil
 }
 
+// propagateToReplicas must be called with srv.mu held.
 func (srv *serverState) propagateToReplicas(cmd []string) {
-	if len(srv.replicas) == 0 {
+	// a replica forwards the stream of its master in handlePropagation
+	// instead
+	if srv.backlog == nil || srv.config.role != "master" {
 		return
 	}
 	fmt.Printf("Propagating = %q\n", cmd)
+	srv.feedReplicationStream([]byte(encodeStringArray(cmd)))
+}
+
+// feedReplicationStream appends data to the backlog and queues it for every
+// replica, advancing the replication offset. Called with srv.mu held.
+func (srv *serverState) feedReplicationStream(data []byte) {
+	srv.backlog.feed(data)
+	srv.config.replOffset += len(data)
 	for i := 0; i < len(srv.replicas); i++ {
-		fmt.Printf("Replicating to: %s\n", srv.replicas[i].conn.RemoteAddr().String())
-		bytesWritten, err := srv.replicas[i].conn.Write([]byte(encodeStringArray(cmd)))
-		// remove stale replicas
-		if err != nil {
-			fmt.Printf("Disconnected: %s\n", srv.replicas[i].conn.RemoteAddr().String())
-			if len(srv.replicas) > 0 {
-				// TODO: mutex?
-				last := len(srv.replicas) - 1
-				srv.replicas[i] = srv.replicas[last]
-				srv.replicas = srv.replicas[:last]
-				i--
-			}
+		r := &srv.replicas[i]
+		if !r.online {
+			r.pending = append(r.pending, data...)
+			continue
+		}
+		fmt.Printf("Replicating to: %s\n", r.conn.RemoteAddr().String())
+		select {
+		case r.out <- data:
+		default:
+			// the replica stopped reading, it resynchronizes when it
+			// comes back
+			fmt.Printf("Disconnected: %s, output queue full\n", r.conn.RemoteAddr().String())
+			r.drop()
+			srv.replicas = slices.Delete(srv.replicas, i, i+1)
+			i--
 		}
-		srv.replicas[i].offset += bytesWritten
 	}
 }
 
-func (srv *serverState) handlePropagation(reader *bufio.Reader, masterConn net.Conn) {
-	defer masterConn.Close()
+// handlePropagation applies the commands streamed by the master until the
+// connection breaks, or stays silent for repl-timeout seconds: the master
+// pings more often than that, so the link is dead.
+func (srv *serverState) handlePropagation(reader *bufio.Reader, masterConn net.Conn) error {
+	master := &client{conn: masterConn, master: true}
+	srv.mu.Lock()
+	timeout := time.Duration(srv.config.replTimeout) * time.Second
+	acks := make(chan int, 1)
+	srv.masterAcks = acks
+	srv.mu.Unlock()
+	go writeReplicaAcks(masterConn, acks, timeout)
+	defer func() {
+		srv.mu.Lock()
+		if srv.masterAcks == acks {
+			srv.masterAcks = nil
+		}
+		close(acks)
+		srv.mu.Unlock()
+	}()
+
+	// record the stream, including what the handshake already buffered, to
+	// forward it to our own replicas exactly as received
+	raw := &streamRecorder{}
+	buffered, _ := reader.Peek(reader.Buffered())
+	reader = bufio.NewReader(io.TeeReader(io.MultiReader(bytes.NewReader(buffered), masterConn), raw))
 
 	for {
+		masterConn.SetReadDeadline(time.Now().Add(timeout))
 		cmd, cmdSize, err := decodeStringArray(reader)
 		if err != nil {
-			if err == io.EOF {
-				break
+			return err
+		}
+
+		fmt.Printf("[from master] Command = %q\n", cmd)
+		response := srv.handleCommand(master, cmd)
+
+		if strings.ToUpper(cmd[0]) == "REPLCONF" {
+			if _, err := masterConn.Write([]byte(response)); err != nil {
+				return err
 			}
-			fmt.Printf("Error decoding command from master: %v\n", err.Error())
 		}
+		srv.mu.Lock()
+		srv.feedReplicationStream(raw.next(cmdSize))
+		srv.masterLastIO = time.Now()
+		timeout = time.Duration(srv.config.replTimeout) * time.Second
+		srv.mu.Unlock()
+	}
+}
+
+// streamRecorder keeps the bytes read from the master until they are
+// forwarded.
+type streamRecorder struct {
+	buf []byte
+}
+
+func (r *streamRecorder) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	return len(p), nil
+}
+
+// next returns the following n bytes of the stream.
+func (r *streamRecorder) next(n int) []byte {
+	data := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return data
+}
 
-		if len(cmd) == 0 {
+// serveReplica reads what a replica sends back on its link, REPLCONF ACK
+// offsets, until the link breaks. Replicas never get replies.
+func (srv *serverState) serveReplica(c *client, reader *bufio.Reader) {
+	for {
+		cmd, _, err := decodeStringArray(reader)
+		if err != nil {
 			break
 		}
+		srv.handleCommand(c, cmd)
+	}
 
-		fmt.Printf("[from master] Command = %q\n", cmd)
-		response, _ := srv.handleCommand(cmd)
+	srv.mu.Lock()
+	srv.removeReplica(c.conn)
+	srv.mu.Unlock()
+	fmt.Printf("[#%d] Replica disconnected\n", c.id)
+}
 
-		if strings.ToUpper(cmd[0]) == "REPLCONF" {
-			_, err := masterConn.Write([]byte(response))
-			if err != nil {
-				fmt.Printf("Error responding to master: %v\n", err.Error())
-				break
-			}
+// removeReplica must be called with srv.mu held.
+func (srv *serverState) removeReplica(conn net.Conn) {
+	srv.replicas = slices.DeleteFunc(srv.replicas, func(r replica) bool {
+		if r.conn == conn {
+			r.drop()
+		}
+		return r.conn == conn
+	})
+}
+
+// ackReplica records the offset acknowledged with REPLCONF ACK and wakes up
+// the clients in WAIT. Called with srv.mu held.
+func (srv *serverState) ackReplica(conn net.Conn, offset int) {
+	for i := range srv.replicas {
+		r := &srv.replicas[i]
+		if r.conn == conn {
+			r.ackOffset = max(r.ackOffset, offset)
+			r.lastAck = time.Now()
 		}
-		srv.replicaOffset += cmdSize
 	}
+	close(srv.ackNotify)
+	srv.ackNotify = make(chan struct{})
 }
 
-func (srv *serverState) waitForWriteAck(count, timeout int) string {
-	getAckCmd := []byte(encodeStringArray([]string{"REPLCONF", "GETACK", "*"}))
+var (
+	errReadOnlyReplica = codedError{"READONLY", "You can't write against a read only replica."}
+	errNoReplicas      = codedError{"NOREPLICAS", "Not enough good replicas to write."}
+)
 
-	acks := 0
+// countGoodReplicas counts the online replicas that acknowledged within
+// min-replicas-max-lag seconds. Called with srv.mu held.
+func (srv *serverState) countGoodReplicas() int {
+	good := 0
+	maxLag := time.Duration(srv.config.minReplicasMaxLag) * time.Second
+	for _, r := range srv.replicas {
+		if r.online && time.Since(r.lastAck) <= maxLag {
+			good++
+		}
+	}
+	return good
+}
 
-	for i := 0; i < len(srv.replicas); i++ {
-		if srv.replicas[i].offset > 0 {
-			bytesWritten, _ := srv.replicas[i].conn.Write(getAckCmd)
-			srv.replicas[i].offset += bytesWritten
-			go func(conn net.Conn) {
-				fmt.Println("waiting response from replica", conn.RemoteAddr().String())
-				buffer := make([]byte, 1024)
-				_, err := conn.Read(buffer)
-				if err == nil {
-					fmt.Println("got response from replica", conn.RemoteAddr().String())
-				} else {
-					fmt.Println("error from replica", conn.RemoteAddr().String(), " => ", err.Error())
-				}
-				srv.ackReceived <- true
-			}(srv.replicas[i].conn)
-		} else {
-			acks++
-		}
-	}
-
-	timer := time.After(time.Duration(timeout) * time.Millisecond)
-
-outer:
-	for acks < count {
+// checkWriteAllowed refuses a write command from c on a read only replica,
+// or on a master without enough good replicas. Called with srv.mu held.
+func (srv *serverState) checkWriteAllowed(c *client) error {
+	if c.master || c.id < 0 {
+		// the master link and the AOF loader
+		return nil
+	}
+	if srv.config.role == "slave" && srv.config.replicaReadOnly {
+		return errReadOnlyReplica
+	}
+	if srv.config.role == "master" && srv.config.minReplicasToWrite > 0 &&
+		srv.countGoodReplicas() < srv.config.minReplicasToWrite {
+		return errNoReplicas
+	}
+	return nil
+}
+
+// countAckedReplicas must be called with srv.mu held.
+func (srv *serverState) countAckedReplicas(offset int) int {
+	acked := 0
+	for _, r := range srv.replicas {
+		if r.online && r.ackOffset >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// waitForReplicas blocks until count replicas acknowledged offset or timeout
+// passes (zero waits forever) and returns how many did. It is called with
+// srv.mu held and releases it while waiting.
+func (srv *serverState) waitForReplicas(offset, count int, timeout time.Duration) int {
+	acked := srv.countAckedReplicas(offset)
+	if acked >= count {
+		return acked
+	}
+	srv.propagateToReplicas([]string{"REPLCONF", "GETACK", "*"})
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for acked < count {
+		notify := srv.ackNotify
+		srv.mu.Unlock()
 		select {
-		case <-srv.ackReceived:
-			acks++
-			fmt.Println("acks =", acks)
-		case <-timer:
-			fmt.Println("timeout! acks =", acks)
-			break outer
+		case <-notify:
+		case <-expired:
+			srv.mu.Lock()
+			return srv.countAckedReplicas(offset)
 		}
+		srv.mu.Lock()
+		acked = srv.countAckedReplicas(offset)
 	}
+	return acked
+}
 
-	return encodeInteger(acks)
+// pingReplicas sends a PING down the replication stream every
+// repl-ping-replica-period seconds, letting replicas tell an idle master from
+// a dead link. Called with srv.mu held.
+func (srv *serverState) pingReplicas() {
+	period := time.Duration(srv.config.replPingReplicaPeriod) * time.Second
+	if srv.config.role != "master" || srv.backlog == nil || len(srv.replicas) == 0 || time.Since(srv.lastPingSent) < period {
+		return
+	}
+	srv.lastPingSent = time.Now()
+	srv.feedReplicationStream([]byte(encodeStringArray([]string{"PING"})))
+}
+
+// sendReplicaAck tells the master how far the replica got, once a second.
+// The ACK is written by writeReplicaAcks; one still queued means the master
+// is not reading, the fresher offset can wait. Called from cron with srv.mu
+// held.
+func (srv *serverState) sendReplicaAck() {
+	if srv.replState != replStateConnected || srv.masterAcks == nil || time.Since(srv.lastAckSent) < time.Second {
+		return
+	}
+	srv.lastAckSent = time.Now()
+	select {
+	case srv.masterAcks <- srv.config.replOffset:
+	default:
+	}
+}
+
+// writeReplicaAcks sends the offsets queued by sendReplicaAck until
+// handlePropagation returns. A write that fails or takes longer than timeout
+// closes the link, which ends handlePropagation.
+func writeReplicaAcks(conn net.Conn, acks <-chan int, timeout time.Duration) {
+	for offset := range acks {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		if _, err := conn.Write([]byte(encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(offset)}))); err != nil {
+			conn.Close()
+			return
+		}
+	}
 }
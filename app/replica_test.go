@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeMaster accepts the connections of a replica on behalf of the test,
+// which then plays the master side of the protocol by hand.
+type fakeMaster struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newFakeMaster(t *testing.T) *fakeMaster {
+	t.Helper()
+	return newFakeMasterOn(t, "127.0.0.1")
+}
+
+// newFakeMasterOn listens on a random port of host.
+func newFakeMasterOn(t *testing.T, host string) *fakeMaster {
+	t.Helper()
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMaster{listener: listener, conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(m.conns)
+				return
+			}
+			m.conns <- conn
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return m
+}
+
+func (m *fakeMaster) port() int {
+	return m.listener.Addr().(*net.TCPAddr).Port
+}
+
+// accept returns the next connection of the replica.
+func (m *fakeMaster) accept(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	select {
+	case conn := <-m.conns:
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replica did not connect")
+		return nil, nil
+	}
+}
+
+// expect reads the next command of the replica and replies to it.
+func expect(t *testing.T, conn net.Conn, reader *bufio.Reader, reply string, want ...string) {
+	t.Helper()
+	cmd, _, err := decodeStringArray(reader)
+	if err != nil {
+		t.Fatalf("reading %q: %v", want, err)
+	}
+	if !slices.Equal(cmd, want) {
+		t.Fatalf("replica sent %q, want %q", cmd, want)
+	}
+	if _, err := conn.Write([]byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitReplState waits until the link of srv is in state.
+func waitReplState(t *testing.T, srv *serverState, state string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		srv.mu.Lock()
+		current := srv.replState
+		srv.mu.Unlock()
+		if current == state {
+			return
+		}
+	}
+	t.Fatalf("the replication link never got to state %q", state)
+}
+
+func masterLinkStatus(t *testing.T, srv *serverState) string {
+	t.Helper()
+	info, _ := call(t, srv, &client{id: 1}, "INFO", "replication").(string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if status, ok := strings.CutPrefix(line, "master_link_status:"); ok {
+			return status
+		}
+	}
+	t.Fatalf("no master_link_status in %q", info)
+	return ""
+}
+
+func stopReplication(t *testing.T, srv *serverState) {
+	call(t, srv, &client{id: 1}, "REPLICAOF", "NO", "ONE")
+}
+
+const fakeReplid = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+
+// TestReplicaLink takes the link with a fake master through its states,
+// then checks that the replica reconnects and continues where it left off
+// when the master drops the connection.
+func TestReplicaLink(t *testing.T) {
+	master := newFakeMaster(t)
+	srv := newTestServer(t)
+	srv.config.port = 6380
+	replid := srv.config.replid
+	c := &client{id: 1}
+	if reply := call(t, srv, c, "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port())); reply != "OK" {
+		t.Fatalf("REPLICAOF: %v", reply)
+	}
+	defer stopReplication(t, srv)
+
+	conn, reader := master.accept(t)
+	waitReplState(t, srv, replStateHandshake)
+	if status := masterLinkStatus(t, srv); status != "down" {
+		t.Errorf("master_link_status during the handshake = %s", status)
+	}
+	expect(t, conn, reader, "+PONG\r\n", "PING")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "listening-port", "6380")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "capa", "eof", "capa", "psync2")
+	// a former master offers to continue its own history
+	cmd, _, err := decodeStringArray(reader)
+	if want := []string{"PSYNC", replid, "1"}; err != nil || !slices.Equal(cmd, want) {
+		t.Fatalf("replica sent %q, %v, want %q", cmd, err, want)
+	}
+	waitReplState(t, srv, replStateSync)
+
+	// the dataset of the master, then a write streamed right behind it
+	dataset := newTestServer(t)
+	call(t, dataset, c, "SET", "loaded", "from rdb")
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, dataset.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	propagated := encodeStringArray([]string{"SET", "streamed", "after sync"})
+	fmt.Fprintf(conn, "+FULLRESYNC %s 100\r\n$%d\r\n%s%s", fakeReplid, rdb.Len(), rdb.Bytes(), propagated)
+
+	waitReplState(t, srv, replStateConnected)
+	if status := masterLinkStatus(t, srv); status != "up" {
+		t.Errorf("master_link_status once connected = %s", status)
+	}
+	// REPLCONF GETACK is answered with the offset, which includes every
+	// command applied so far
+	getack := encodeStringArray([]string{"REPLCONF", "GETACK", "*"})
+	conn.Write([]byte(getack))
+	offset := 100 + len(propagated)
+	ack, _, err := decodeStringArray(reader)
+	if err != nil || !slices.Equal(ack, []string{"REPLCONF", "ACK", strconv.Itoa(offset)}) {
+		t.Fatalf("replica acknowledged %q, %v, want offset %d", ack, err, offset)
+	}
+	offset += len(getack)
+	for key, want := range map[string]string{"loaded": "from rdb", "streamed": "after sync"} {
+		if got := call(t, srv, c, "GET", key); got != want {
+			t.Errorf("GET %s = %v, want %q", key, got, want)
+		}
+	}
+
+	// the master goes away: the replica reconnects after a backoff and asks
+	// to continue from the next offset
+	dropped := time.Now()
+	conn.Close()
+	waitReplState(t, srv, replStateConnecting)
+	if status := masterLinkStatus(t, srv); status != "down" {
+		t.Errorf("master_link_status after the master dropped the link = %s", status)
+	}
+	conn, reader = master.accept(t)
+	if elapsed := time.Since(dropped); elapsed < replReconnectMinDelay {
+		t.Errorf("reconnected after %v, before the backoff delay", elapsed)
+	}
+	expect(t, conn, reader, "+PONG\r\n", "PING")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "listening-port", "6380")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "capa", "eof", "capa", "psync2")
+	expect(t, conn, reader, "+CONTINUE "+fakeReplid+"\r\n", "PSYNC", fakeReplid, strconv.Itoa(offset+1))
+	waitReplState(t, srv, replStateConnected)
+	conn.Write([]byte(encodeStringArray([]string{"SET", "streamed", "after reconnect"})))
+	conn.Write([]byte(getack))
+	if _, _, err := decodeStringArray(reader); err != nil {
+		t.Fatal(err)
+	}
+	if got := call(t, srv, c, "GET", "streamed"); got != "after reconnect" {
+		t.Errorf("GET streamed = %v after the partial resynch", got)
+	}
+}
+
+// TestReplicaIPv6Master checks that a master configured by an IPv6 address
+// is dialed as [host]:port.
+func TestReplicaIPv6Master(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	} else {
+		l.Close()
+	}
+	master := newFakeMasterOn(t, "::1")
+	srv := newTestServer(t)
+	call(t, srv, &client{id: 1}, "REPLICAOF", "::1", strconv.Itoa(master.port()))
+	defer stopReplication(t, srv)
+
+	conn, reader := master.accept(t)
+	expect(t, conn, reader, "+PONG\r\n", "PING")
+}
+
+// TestReplicaReconnectBackoff checks that the delay between attempts doubles
+// while the master keeps dropping the link during the handshake.
+func TestReplicaReconnectBackoff(t *testing.T) {
+	master := newFakeMaster(t)
+	srv := newTestServer(t)
+	call(t, srv, &client{id: 1}, "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port()))
+	defer stopReplication(t, srv)
+
+	var attempts []time.Time
+	for range 4 {
+		conn, _ := master.accept(t)
+		attempts = append(attempts, time.Now())
+		conn.Close()
+	}
+	want := replReconnectMinDelay
+	for i := 1; i < len(attempts); i++ {
+		if gap := attempts[i].Sub(attempts[i-1]); gap < want {
+			t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, gap, want)
+		}
+		want = min(2*want, replReconnectMaxDelay)
+	}
+}
+
+// TestReplicaTimeout checks that a master that stays silent for repl-timeout
+// seconds is taken for dead, even though the connection is still open.
+func TestReplicaTimeout(t *testing.T) {
+	master := newFakeMaster(t)
+	srv := newTestServer(t)
+	srv.config.replTimeout = 1
+	srv.config.replid = fakeReplid
+	c := &client{id: 1}
+	call(t, srv, c, "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port()))
+	defer stopReplication(t, srv)
+
+	conn, reader := master.accept(t)
+	expect(t, conn, reader, "+PONG\r\n", "PING")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "listening-port", "0")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "capa", "eof", "capa", "psync2")
+	expect(t, conn, reader, "+CONTINUE\r\n", "PSYNC", fakeReplid, "1")
+	waitReplState(t, srv, replStateConnected)
+
+	// a PING from the master keeps the link alive
+	silent := time.Now()
+	time.Sleep(600 * time.Millisecond)
+	conn.Write([]byte(encodeStringArray([]string{"PING"})))
+	time.Sleep(600 * time.Millisecond)
+	if status := masterLinkStatus(t, srv); status != "up" {
+		t.Fatalf("master_link_status = %s although the master pinged", status)
+	}
+
+	master.accept(t)
+	if elapsed := time.Since(silent); elapsed < 1600*time.Millisecond {
+		t.Errorf("the replica gave up on the master after %v", elapsed)
+	}
+}
+
+// TestStalledReplica checks that a replica that stops reading never blocks
+// the other clients: its link is dropped once its output queue is full.
+func TestStalledReplica(t *testing.T) {
+	srv := newTestServer(t)
+	srv.backlog = newReplicationBacklog(srv.config.replBacklogSize)
+	// the replica end of a pipe is never read, every write to it blocks
+	conn, stalled := net.Pipe()
+	defer stalled.Close()
+	r := &client{id: 2, conn: conn, replica: true}
+	srv.mu.Lock()
+	srv.addReplica(r)
+	srv.mu.Unlock()
+	if err := srv.attachReplica(r); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c := &client{id: 1}
+		for i := range 2 * replicaOutputQueue {
+			call(t, srv, c, "SET", "key", strconv.Itoa(i))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes blocked on a replica that stopped reading")
+	}
+
+	srv.mu.Lock()
+	replicas := len(srv.replicas)
+	srv.mu.Unlock()
+	if replicas != 0 {
+		t.Errorf("%d replicas still connected", replicas)
+	}
+}
+
+// startTestReplica serves a new server replicating master and waits until
+// the master streams to it.
+func startTestReplica(t *testing.T, master *serverState) *serverState {
+	t.Helper()
+	replica := newTestServer(t)
+	port, _ := serveTestServer(t, replica)
+	if reply := call(t, replica, &client{id: 1}, "REPLICAOF", "127.0.0.1", strconv.Itoa(master.config.port)); reply != "OK" {
+		t.Fatalf("REPLICAOF: %v", reply)
+	}
+	t.Cleanup(func() { stopReplication(t, replica) })
+	waitReplState(t, replica, replStateConnected)
+	waitFor(t, 5*time.Second, "the master to stream to the replica", func() bool {
+		master.mu.Lock()
+		defer master.mu.Unlock()
+		for _, r := range master.replicas {
+			if r.port == port && r.online {
+				return true
+			}
+		}
+		return false
+	})
+	return replica
+}
+
+// TestWait checks that WAIT returns as soon as enough replicas acknowledged
+// the writes of the client, or with fewer once the timeout passes.
+func TestWait(t *testing.T) {
+	master := newTestServer(t)
+	serveTestServer(t, master)
+	replicas := []*serverState{startTestReplica(t, master), startTestReplica(t, master)}
+	c := &client{id: 1}
+
+	// nothing to wait for
+	if reply := call(t, master, c, "WAIT", "0", "0"); reply != 2 {
+		t.Errorf("WAIT 0 0 = %v, want 2", reply)
+	}
+
+	call(t, master, c, "SET", "key", "value")
+	start := time.Now()
+	if reply := call(t, master, c, "WAIT", "2", "5000"); reply != 2 {
+		t.Errorf("WAIT 2 = %v, want 2", reply)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("WAIT 2 returned after %v, not once both replicas acknowledged", elapsed)
+	}
+	for i, replica := range replicas {
+		if reply := call(t, replica, c, "GET", "key"); reply != "value" {
+			t.Errorf("GET key on replica %d = %v after WAIT", i, reply)
+		}
+	}
+
+	call(t, master, c, "SET", "key", "other")
+	start = time.Now()
+	if reply := call(t, master, c, "WAIT", "3", "300"); reply != 2 {
+		t.Errorf("WAIT 3 = %v, want 2", reply)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("WAIT 3 returned after %v, before its timeout", elapsed)
+	}
+
+	if reply, _ := call(t, replicas[0], c, "WAIT", "0", "0").(error); reply == nil || reply.Error() != "ERR WAIT cannot be used with replica instances." {
+		t.Errorf("WAIT on a replica = %v", reply)
+	}
+}
+
+// TestWriteAllowed checks that a read only replica refuses writes but from its
+// master, and that a master refuses them without enough good replicas.
+func TestWriteAllowed(t *testing.T) {
+	master := newTestServer(t)
+	serveTestServer(t, master)
+	c := &client{id: 1}
+	for _, param := range [][]string{{"min-replicas-to-write", "1"}, {"min-replicas-max-lag", "10"}} {
+		if reply := call(t, master, c, "CONFIG", "SET", param[0], param[1]); reply != "OK" {
+			t.Fatalf("CONFIG SET %s: %v", param[0], reply)
+		}
+	}
+	wantError := func(srv *serverState, want string) {
+		t.Helper()
+		if reply, _ := call(t, srv, c, "SET", "key", "value").(error); reply == nil || !strings.HasPrefix(reply.Error(), want+" ") {
+			t.Errorf("SET = %v, want a %s error", reply, want)
+		}
+	}
+	wantError(master, "NOREPLICAS")
+
+	replica := startTestReplica(t, master)
+	call(t, replica, c, "CONFIG", "SET", "replica-read-only", "yes")
+	if reply := call(t, master, c, "SET", "key", "value"); reply != "OK" {
+		t.Errorf("SET with a good replica = %v", reply)
+	}
+	wantError(replica, "READONLY")
+	call(t, master, c, "WAIT", "1", "5000")
+	if reply := call(t, replica, c, "GET", "key"); reply != "value" {
+		t.Errorf("GET key on the replica = %v, the write of the master was refused", reply)
+	}
+
+	// the replica didn't acknowledge for longer than min-replicas-max-lag
+	master.mu.Lock()
+	master.replicas[0].lastAck = time.Now().Add(-11 * time.Second)
+	master.mu.Unlock()
+	wantError(master, "NOREPLICAS")
+	call(t, master, c, "CONFIG", "SET", "min-replicas-max-lag", "20")
+	if reply := call(t, master, c, "SET", "key", "value"); reply != "OK" {
+		t.Errorf("SET with a lag under min-replicas-max-lag = %v", reply)
+	}
+}
+
+// fullResynch takes a replica of the fake master through the handshake, up to
+// its PSYNC, and sends the +FULLRESYNC reply.
+func fullResynch(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	expect(t, conn, reader, "+PONG\r\n", "PING")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "listening-port", "0")
+	expect(t, conn, reader, "+OK\r\n", "REPLCONF", "capa", "eof", "capa", "psync2")
+	if cmd, _, err := decodeStringArray(reader); err != nil || cmd[0] != "PSYNC" {
+		t.Fatalf("replica sent %q, %v, want PSYNC", cmd, err)
+	}
+	fmt.Fprintf(conn, "+FULLRESYNC %s 100\r\n", fakeReplid)
+}
+
+// TestDisklessPayload sends a replica full resynch payloads terminated by an
+// EOF mark: one it loads, then ones whose mark is corrupted, which make it
+// drop the link and keep its dataset.
+func TestDisklessPayload(t *testing.T) {
+	master := newFakeMaster(t)
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "REPLICAOF", "127.0.0.1", strconv.Itoa(master.port()))
+	defer stopReplication(t, srv)
+
+	dataset := newTestServer(t)
+	call(t, dataset, c, "SET", "loaded", "from rdb")
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, dataset.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	mark := strings.Repeat("m", rdbEOFMarkLength)
+
+	conn, reader := master.accept(t)
+	fullResynch(t, conn, reader)
+	// the stream of commands follows the mark at once, in the same write
+	fmt.Fprintf(conn, "$EOF:%s\r\n%s%s%s", mark, rdb.Bytes(), mark, encodeStringArray([]string{"SET", "streamed", "after sync"}))
+	waitReplState(t, srv, replStateConnected)
+	conn.Write([]byte(encodeStringArray([]string{"REPLCONF", "GETACK", "*"})))
+	if _, _, err := decodeStringArray(reader); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"loaded": "from rdb", "streamed": "after sync"} {
+		if got := call(t, srv, c, "GET", key); got != want {
+			t.Errorf("GET %s = %v, want %q", key, got, want)
+		}
+	}
+
+	for _, payload := range []string{
+		// a mark of the wrong length
+		fmt.Sprintf("$EOF:%s\r\n%s%s", mark[1:], rdb.Bytes(), mark[1:]),
+		// a payload that never ends with the mark announced
+		fmt.Sprintf("$EOF:%s\r\n%s%s", mark, rdb.Bytes(), strings.Repeat("x", rdbEOFMarkLength)),
+	} {
+		conn.Close()
+		conn, reader = master.accept(t)
+		fullResynch(t, conn, reader)
+		conn.Write([]byte(payload))
+		conn.Close()
+		conn, reader = master.accept(t)
+		if got := call(t, srv, c, "GET", "streamed"); got != "after sync" {
+			t.Errorf("GET streamed = %v after the payload %q", got, payload)
+		}
+	}
+	conn.Close()
+}
+
+// TestDisklessSync checks that a master configured with repl-diskless-sync
+// streams its dataset to a replica.
+func TestDisklessSync(t *testing.T) {
+	master := newTestServer(t)
+	serveTestServer(t, master)
+	c := &client{id: 1}
+	call(t, master, c, "CONFIG", "SET", "repl-diskless-sync", "yes")
+	call(t, master, c, "CONFIG", "SET", "repl-diskless-sync-delay", "0")
+	call(t, master, c, "SET", "key", "value")
+
+	replica := startTestReplica(t, master)
+	if reply := call(t, replica, c, "GET", "key"); reply != "value" {
+		t.Errorf("GET key on the replica = %v", reply)
+	}
+	if entries, _ := os.ReadDir(master.config.dbDir); len(entries) != 0 {
+		t.Errorf("the master wrote %v for a diskless sync", entries)
+	}
+}
+
+// TestChainedReplication checks that a replica forwards the stream of its
+// master to its own replicas, and that they resynchronize when it switches
+// to another master.
+func TestChainedReplication(t *testing.T) {
+	master := newTestServer(t)
+	serveTestServer(t, master)
+	intermediate := startTestReplica(t, master)
+	sub := startTestReplica(t, intermediate)
+	c := &client{id: 1}
+
+	call(t, master, c, "SET", "key", "from master")
+	waitFor(t, 5*time.Second, "the sub-replica to get the write", func() bool {
+		return call(t, sub, c, "GET", "key") == "from master"
+	})
+
+	other := newTestServer(t)
+	otherPort, _ := serveTestServer(t, other)
+	call(t, other, c, "SET", "other", "from the other master")
+	if reply := call(t, intermediate, c, "REPLICAOF", "127.0.0.1", strconv.Itoa(otherPort)); reply != "OK" {
+		t.Fatalf("REPLICAOF: %v", reply)
+	}
+	waitFor(t, 5*time.Second, "the sub-replica to get the dataset of the other master", func() bool {
+		return call(t, sub, c, "GET", "other") == "from the other master"
+	})
+	if reply := call(t, sub, c, "GET", "key"); reply != nil {
+		t.Errorf("GET key on the sub-replica = %v after the resynch", reply)
+	}
+
+	call(t, other, c, "SET", "key", "from the other master")
+	waitFor(t, 5*time.Second, "the sub-replica to get the write of the other master", func() bool {
+		return call(t, sub, c, "GET", "key") == "from the other master"
+	})
+	call(t, master, c, "SET", "key", "from the former master")
+	call(t, other, c, "SET", "last", "write")
+	waitFor(t, 5*time.Second, "the sub-replica to get the last write", func() bool {
+		return call(t, sub, c, "GET", "last") == "write"
+	})
+	if reply := call(t, sub, c, "GET", "key"); reply != "from the other master" {
+		t.Errorf("GET key on the sub-replica = %v, a write of the former master got through", reply)
+	}
+}
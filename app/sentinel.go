@@ -0,0 +1,966 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In sentinel mode the binary serves no dataset: it monitors masters and
+// their replicas, and when a quorum of sentinels agrees that a master is down,
+// the sentinel elected leader promotes its best replica and re-points the
+// others. Sentinels find out about each other and about completed failovers
+// through SENTINEL HELLO messages sent to their peers.
+
+type sentinelConfig struct {
+	enabled         bool
+	monitors        []sentinelMonitor
+	peers           []string
+	downAfter       int // milliseconds
+	failoverTimeout int // milliseconds
+}
+
+type sentinelMonitor struct {
+	name   string
+	host   string
+	port   int
+	quorum int
+}
+
+// addMonitor parses a --sentinel-monitor "<name> <host> <port> <quorum>".
+func (cfg *sentinelConfig) addMonitor(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return fmt.Errorf("expected <name> <host> <port> <quorum>, got %q", value)
+	}
+	port, err := strconv.Atoi(fields[2])
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", fields[2])
+	}
+	quorum, err := strconv.Atoi(fields[3])
+	if err != nil || quorum < 1 {
+		return fmt.Errorf("quorum must be 1 or greater, got %q", fields[3])
+	}
+	cfg.monitors = append(cfg.monitors, sentinelMonitor{fields[0], fields[1], port, quorum})
+	return nil
+}
+
+// addPeer parses a --sentinel-peer "<host>:<port>".
+func (cfg *sentinelConfig) addPeer(value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return err
+	}
+	cfg.peers = append(cfg.peers, value)
+	return nil
+}
+
+const (
+	sentinelPingPeriod  = time.Second
+	sentinelInfoPeriod  = 10 * time.Second
+	sentinelHelloPeriod = 2 * time.Second
+	sentinelCallTimeout = time.Second
+	// how often a promoted replica is polled until it reports role:master
+	sentinelPromotionPoll = 100 * time.Millisecond
+	// failovers start after a random delay up to this, so that sentinels
+	// seeing the master down at the same time don't all split the votes
+	sentinelMaxDesync = time.Second
+)
+
+type sentinelState struct {
+	mu              sync.Mutex
+	port            int
+	runid           string
+	currentEpoch    int
+	masters         map[string]*monitoredMaster
+	peers           map[string]*sentinelPeer // by address
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	done            chan struct{} // closed by close, stops helloLoop
+}
+
+type monitoredMaster struct {
+	stop        chan struct{} // closed by removeMaster, stops watchMaster
+	name        string
+	quorum      int
+	master      *sentinelInstance
+	replicas    map[string]*sentinelInstance // by address
+	configEpoch int                          // epoch of the failover that made master the master
+	odown       bool                         // a quorum of sentinels agrees master is down
+
+	// the last failover attempted, elected or not
+	failoverState string
+	failoverStart time.Time
+
+	// the sentinel we voted for as failover leader, once per epoch
+	leader      string
+	leaderEpoch int
+}
+
+// sentinelInstance is a monitored master or replica.
+type sentinelInstance struct {
+	stop     chan struct{} // closed by dropInstance, stops monitorInstance
+	addr     string
+	link     *sentinelLink
+	lastOK   time.Time         // last valid PING reply
+	info     map[string]string // last INFO replication
+	infoTime time.Time
+}
+
+type sentinelPeer struct {
+	addr      string
+	runid     string
+	link      *sentinelLink
+	lastHello time.Time
+}
+
+// sentinelLink is a connection to an instance or another sentinel, dialed
+// again on the next call after any error, until shutdown.
+type sentinelLink struct {
+	mu     sync.Mutex
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	closed bool
+}
+
+var errSentinelLinkClosed = errors.New("link closed")
+
+func (l *sentinelLink) call(cmd ...string) (any, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errSentinelLinkClosed
+	}
+	if l.conn == nil {
+		conn, err := net.DialTimeout("tcp", l.addr, sentinelCallTimeout)
+		if err != nil {
+			return nil, err
+		}
+		l.conn, l.reader = conn, bufio.NewReader(conn)
+	}
+
+	l.conn.SetDeadline(time.Now().Add(sentinelCallTimeout))
+	_, err := l.conn.Write([]byte(encodeStringArray(cmd)))
+	var reply any
+	if err == nil {
+		reply, err = decodeReply(l.reader)
+	}
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// close must be called with l.mu held, or on a link no one else uses.
+func (l *sentinelLink) close() {
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+// shutdown closes the link for good, once the call in progress if any is
+// over. It may block for a whole call: don't hold s.mu.
+func (l *sentinelLink) shutdown() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	l.close()
+}
+
+// sentinelCall sends a single command over a connection of its own.
+func sentinelCall(addr string, cmd ...string) (any, error) {
+	link := &sentinelLink{addr: addr}
+	defer link.close()
+	reply, err := link.call(cmd...)
+	if replyErr, ok := reply.(error); ok {
+		return nil, replyErr
+	}
+	return reply, err
+}
+
+func runSentinel(port int, cfg *sentinelConfig) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		fmt.Printf("Failed to bind to port %d\n", port)
+		os.Exit(1)
+	}
+	s := newSentinel(port, cfg)
+	fmt.Printf("Sentinel ID is %s, listening on: %s\n", s.runid, listener.Addr().String())
+
+	if err := s.serve(listener); err != nil {
+		fmt.Println("Error accepting connection: ", err.Error())
+		os.Exit(1)
+	}
+}
+
+// newSentinel starts monitoring the masters of cfg, announcing itself to
+// the other sentinels as listening on port.
+func newSentinel(port int, cfg *sentinelConfig) *sentinelState {
+	s := &sentinelState{
+		port:            port,
+		runid:           randReplid(),
+		masters:         make(map[string]*monitoredMaster),
+		peers:           make(map[string]*sentinelPeer),
+		downAfter:       time.Duration(cfg.downAfter) * time.Millisecond,
+		failoverTimeout: time.Duration(cfg.failoverTimeout) * time.Millisecond,
+		done:            make(chan struct{}),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, addr := range cfg.peers {
+		s.addPeer(addr)
+	}
+	for _, mon := range cfg.monitors {
+		m := &monitoredMaster{
+			stop:     make(chan struct{}),
+			name:     mon.name,
+			quorum:   mon.quorum,
+			replicas: make(map[string]*sentinelInstance),
+		}
+		m.master = s.newInstance(m, net.JoinHostPort(mon.host, strconv.Itoa(mon.port)))
+		s.masters[mon.name] = m
+		fmt.Printf("+monitor master %s %s quorum %d\n", m.name, m.master.addr, m.quorum)
+		go s.watchMaster(m)
+	}
+	go s.helloLoop()
+	return s
+}
+
+// serve accepts clients until listener fails.
+func (s *sentinelState) serve(listener net.Listener) error {
+	for id := 1; ; id++ {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveClient(id, conn)
+	}
+}
+
+// close stops monitoring anything and closes every link.
+func (s *sentinelState) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.done)
+	for _, m := range s.masters {
+		s.removeMaster(m)
+	}
+	for _, peer := range s.peers {
+		go peer.link.shutdown()
+	}
+}
+
+// newInstance starts monitoring the instance at addr for m. Called with s.mu
+// held.
+func (s *sentinelState) newInstance(m *monitoredMaster, addr string) *sentinelInstance {
+	inst := &sentinelInstance{stop: make(chan struct{}), addr: addr, link: &sentinelLink{addr: addr}, lastOK: time.Now()}
+	go s.monitorInstance(m, inst)
+	return inst
+}
+
+// dropInstance stops monitoring inst. Called with s.mu held.
+func (s *sentinelState) dropInstance(inst *sentinelInstance) {
+	close(inst.stop)
+	go inst.link.shutdown()
+}
+
+// resetMaster forgets the replicas of m, found again in the INFO of its
+// master, and any failover in progress. Called with s.mu held.
+func (s *sentinelState) resetMaster(m *monitoredMaster) {
+	for _, inst := range m.replicas {
+		s.dropInstance(inst)
+	}
+	m.replicas = make(map[string]*sentinelInstance)
+	m.odown, m.failoverState, m.failoverStart = false, "", time.Time{}
+	fmt.Printf("+reset-master master %s %s\n", m.name, m.master.addr)
+}
+
+// removeMaster stops monitoring m, its master and replicas. Called with s.mu
+// held.
+func (s *sentinelState) removeMaster(m *monitoredMaster) {
+	close(m.stop)
+	s.dropInstance(m.master)
+	for _, inst := range m.replicas {
+		s.dropInstance(inst)
+	}
+	delete(s.masters, m.name)
+}
+
+// addPeer must be called with s.mu held.
+func (s *sentinelState) addPeer(addr string) *sentinelPeer {
+	peer := &sentinelPeer{addr: addr, link: &sentinelLink{addr: addr}}
+	s.peers[addr] = peer
+	return peer
+}
+
+// isDown reports whether inst is subjectively down: it did not answer PING
+// for down-after-milliseconds. Called with s.mu held.
+func (s *sentinelState) isDown(inst *sentinelInstance) bool {
+	return time.Since(inst.lastOK) > s.downAfter
+}
+
+// monitorInstance pings inst every second and refreshes its INFO
+// replication, every second too while its master is in trouble, until inst
+// is dropped.
+func (s *sentinelState) monitorInstance(m *monitoredMaster, inst *sentinelInstance) {
+	ticker := time.NewTicker(sentinelPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-inst.stop:
+			return
+		case <-ticker.C:
+		}
+		reply, err := inst.link.call("PING")
+
+		s.mu.Lock()
+		if err == nil && reply == "PONG" {
+			inst.lastOK = time.Now()
+		}
+		period := sentinelInfoPeriod
+		if m.odown || m.failoverState != "" || s.isDown(m.master) {
+			period = sentinelPingPeriod
+		}
+		refresh := time.Since(inst.infoTime) >= period
+		s.mu.Unlock()
+
+		if !refresh {
+			continue
+		}
+		reply, err = inst.link.call("INFO", "replication")
+		if text, ok := reply.(string); err == nil && ok {
+			s.mu.Lock()
+			// a dropped instance must not bring back the replicas of
+			// a removed master
+			select {
+			case <-inst.stop:
+			default:
+				s.refreshInfo(m, inst, parseInfoFields(text))
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// parseInfoFields turns an INFO reply into its "field:value" pairs.
+func parseInfoFields(text string) map[string]string {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(text, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// refreshInfo learns the replicas of the master from its INFO, and brings
+// back in line the replicas, or former masters, that are not replicating
+// from it. Called with s.mu held.
+func (s *sentinelState) refreshInfo(m *monitoredMaster, inst *sentinelInstance, info map[string]string) {
+	inst.info, inst.infoTime = info, time.Now()
+
+	if inst == m.master {
+		if info["role"] != "master" {
+			return
+		}
+		for key, value := range info {
+			if n, ok := strings.CutPrefix(key, "slave"); !ok || strings.Trim(n, "0123456789") != "" {
+				continue
+			}
+			replica := map[string]string{}
+			for _, field := range strings.Split(value, ",") {
+				if k, v, ok := strings.Cut(field, "="); ok {
+					replica[k] = v
+				}
+			}
+			addr := net.JoinHostPort(replica["ip"], replica["port"])
+			if _, known := m.replicas[addr]; !known && replica["port"] != "0" {
+				m.replicas[addr] = s.newInstance(m, addr)
+				fmt.Printf("+slave slave %s @ %s %s\n", addr, m.name, m.master.addr)
+			}
+		}
+		return
+	}
+
+	// leave the replicas alone while the master is being replaced
+	if m.failoverState != "" || m.odown || s.isDown(m.master) {
+		return
+	}
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	switch {
+	case info["role"] == "master":
+		fmt.Printf("+convert-to-slave slave %s @ %s %s\n", inst.addr, m.name, m.master.addr)
+	case info["role"] == "slave" && net.JoinHostPort(info["master_host"], info["master_port"]) != m.master.addr:
+		fmt.Printf("+fix-slave-config slave %s @ %s %s\n", inst.addr, m.name, m.master.addr)
+	default:
+		return
+	}
+	go sentinelCall(inst.addr, "REPLICAOF", host, port)
+}
+
+// watchMaster checks every second whether the master of m is down, asks the
+// other sentinels whether they agree, and attempts a failover once they do,
+// until m is removed.
+func (s *sentinelState) watchMaster(m *monitoredMaster) {
+	ticker := time.NewTicker(sentinelPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		down := s.isDown(m.master)
+		if !down && m.odown {
+			fmt.Printf("-odown master %s %s\n", m.name, m.master.addr)
+			m.odown = false
+		}
+		s.mu.Unlock()
+		if !down {
+			continue
+		}
+
+		s.checkObjectivelyDown(m)
+		if !s.canStartFailover(m) {
+			continue
+		}
+
+		// meanwhile another sentinel may ask for our vote, which delays
+		// our own attempt
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(sentinelMaxDesync)))):
+		}
+		if s.canStartFailover(m) {
+			s.startFailover(m)
+		}
+	}
+}
+
+// canStartFailover reports whether the master of m is objectively down with
+// no failover attempted for twice the failover timeout, by us or by the
+// leader we voted for.
+func (s *sentinelState) canStartFailover(m *monitoredMaster) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return m.odown && m.failoverState == "" && time.Since(m.failoverStart) >= 2*s.failoverTimeout
+}
+
+// peerLinks must be called with s.mu held.
+func (s *sentinelState) peerLinks() []*sentinelLink {
+	links := make([]*sentinelLink, 0, len(s.peers))
+	for _, peer := range s.peers {
+		links = append(links, peer.link)
+	}
+	return links
+}
+
+// callPeers sends cmd to every peer at once and returns the replies that
+// arrived, leaving out errors.
+func callPeers(links []*sentinelLink, cmd ...string) []any {
+	var wg sync.WaitGroup
+	replies := make([]any, len(links))
+	for i, link := range links {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply, err := link.call(cmd...); err == nil {
+				replies[i] = reply
+			}
+		}()
+	}
+	wg.Wait()
+	return slices.DeleteFunc(replies, func(reply any) bool {
+		_, isErr := reply.(error)
+		return reply == nil || isErr
+	})
+}
+
+// checkObjectivelyDown counts the sentinels that see the master of m down,
+// this one included, and flags it as objectively down once they reach the
+// quorum.
+func (s *sentinelState) checkObjectivelyDown(m *monitoredMaster) {
+	s.mu.Lock()
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	epoch := strconv.Itoa(s.currentEpoch)
+	links := s.peerLinks()
+	s.mu.Unlock()
+
+	votes := 1
+	for _, reply := range callPeers(links, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, epoch, "*") {
+		if fields, ok := reply.([]any); ok && len(fields) == 3 && fields[0] == 1 {
+			votes++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	odown := votes >= m.quorum
+	if odown && !m.odown {
+		fmt.Printf("+odown master %s %s #quorum %d/%d\n", m.name, m.master.addr, votes, m.quorum)
+	}
+	m.odown = odown
+}
+
+// startFailover asks the other sentinels to elect this one as the leader of
+// a new epoch, and fails over the master of m if a majority, and at least the
+// quorum, voted for it.
+func (s *sentinelState) startFailover(m *monitoredMaster) {
+	s.mu.Lock()
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	m.failoverState, m.failoverStart = "wait_start", time.Now()
+	m.leader, m.leaderEpoch = s.runid, epoch
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	links := s.peerLinks()
+	needed := max(m.quorum, (len(links)+1)/2+1)
+	s.mu.Unlock()
+	fmt.Printf("+new-epoch %d\n+try-failover master %s %s:%s\n", epoch, m.name, host, port)
+
+	votes := 1
+	for _, reply := range callPeers(links, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, strconv.Itoa(epoch), s.runid) {
+		if fields, ok := reply.([]any); ok && len(fields) == 3 && fields[1] == s.runid && fields[2] == epoch {
+			votes++
+		}
+	}
+	if votes < needed {
+		fmt.Printf("-failover-abort-not-elected master %s %s:%s (%d/%d votes)\n", m.name, host, port, votes, needed)
+		s.endFailover(m)
+		return
+	}
+	fmt.Printf("+elected-leader master %s %s:%s (%d votes)\n", m.name, host, port, votes)
+
+	if err := s.failover(m, epoch); err != nil {
+		fmt.Printf("-failover-abort master %s %s:%s: %v\n", m.name, host, port, err)
+		s.endFailover(m)
+	}
+}
+
+func (s *sentinelState) endFailover(m *monitoredMaster) {
+	s.mu.Lock()
+	m.failoverState = ""
+	s.mu.Unlock()
+}
+
+func (s *sentinelState) setFailoverState(m *monitoredMaster, state string) {
+	s.mu.Lock()
+	m.failoverState = state
+	s.mu.Unlock()
+}
+
+// failover promotes the best replica of m, waits until it reports being a
+// master, then points the other replicas to it and tells the other
+// sentinels.
+func (s *sentinelState) failover(m *monitoredMaster, epoch int) error {
+	s.mu.Lock()
+	m.failoverState = "select_slave"
+	promoted := s.selectReplica(m)
+	s.mu.Unlock()
+	if promoted == "" {
+		return errors.New("no good replica")
+	}
+	fmt.Printf("+selected-slave slave %s @ %s\n", promoted, m.name)
+
+	s.setFailoverState(m, "send_slaveof_noone")
+	if _, err := sentinelCall(promoted, "REPLICAOF", "NO", "ONE"); err != nil {
+		return err
+	}
+
+	s.setFailoverState(m, "wait_promotion")
+	deadline := time.Now().Add(s.failoverTimeout)
+	for {
+		reply, err := sentinelCall(promoted, "INFO", "replication")
+		if text, ok := reply.(string); err == nil && ok && parseInfoFields(text)["role"] == "master" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for the promotion")
+		}
+		time.Sleep(sentinelPromotionPoll)
+	}
+	fmt.Printf("+promoted-slave slave %s @ %s\n", promoted, m.name)
+
+	s.mu.Lock()
+	s.switchMaster(m, promoted, epoch)
+	host, port, _ := net.SplitHostPort(promoted)
+	var others []string
+	for addr := range m.replicas {
+		others = append(others, addr)
+	}
+	s.mu.Unlock()
+
+	// the former master is among them, it is re-pointed once back anyway
+	for _, addr := range others {
+		go sentinelCall(addr, "REPLICAOF", host, port)
+	}
+	go s.sendHellos()
+	return nil
+}
+
+// selectReplica picks the replica of m that answers PING and has the most
+// replication stream, the lowest address winning ties. Called with s.mu held.
+func (s *sentinelState) selectReplica(m *monitoredMaster) string {
+	best, bestOffset := "", -1
+	for addr, inst := range m.replicas {
+		if s.isDown(inst) || inst.info["role"] != "slave" {
+			continue
+		}
+		offset, err := strconv.Atoi(inst.info["master_repl_offset"])
+		if err != nil {
+			continue
+		}
+		if offset > bestOffset || (offset == bestOffset && addr < best) {
+			best, bestOffset = addr, offset
+		}
+	}
+	return best
+}
+
+// switchMaster makes the instance at addr the master of m, the former master
+// becoming one of its replicas. Called with s.mu held.
+func (s *sentinelState) switchMaster(m *monitoredMaster, addr string, configEpoch int) {
+	old := m.master
+	inst, ok := m.replicas[addr]
+	if !ok {
+		inst = s.newInstance(m, addr)
+	}
+	delete(m.replicas, addr)
+	m.replicas[old.addr] = old
+	m.master = inst
+	m.configEpoch = configEpoch
+	m.odown, m.failoverState = false, ""
+	fmt.Printf("+switch-master %s %s %s\n", m.name, old.addr, addr)
+}
+
+func (s *sentinelState) helloLoop() {
+	ticker := time.NewTicker(sentinelHelloPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		s.sendHellos()
+	}
+}
+
+// sendHellos announces this sentinel and the current master of each
+// monitored name, with the epoch of its configuration, to the other
+// sentinels.
+func (s *sentinelState) sendHellos() {
+	s.mu.Lock()
+	var hellos [][]string
+	for _, m := range s.masters {
+		host, port, _ := net.SplitHostPort(m.master.addr)
+		hellos = append(hellos, []string{"SENTINEL", "HELLO", strconv.Itoa(s.port), s.runid,
+			strconv.Itoa(s.currentEpoch), m.name, host, port, strconv.Itoa(m.configEpoch)})
+	}
+	links := s.peerLinks()
+	s.mu.Unlock()
+
+	for _, hello := range hellos {
+		callPeers(links, hello...)
+	}
+}
+
+func (s *sentinelState) serveClient(id int, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	c := &client{id: id, conn: conn}
+
+	for {
+		cmd, _, err := decodeStringArray(reader)
+		if err != nil {
+			if _, ok := err.(protocolError); ok {
+				conn.Write([]byte(encodeError(err)))
+			}
+			return
+		}
+
+		var response string
+		if handler, ok := sentinelCommands[strings.ToLower(cmd[0])]; ok {
+			s.mu.Lock()
+			response = handler(s, c, cmd)
+			s.mu.Unlock()
+		} else {
+			response = encodeError(unknownCommandError(cmd))
+		}
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+// the commands a sentinel understands, run with s.mu held
+var sentinelCommands = map[string]func(s *sentinelState, c *client, cmd []string) string{
+	"ping":     (*sentinelState).handlePing,
+	"info":     (*sentinelState).handleInfo,
+	"sentinel": (*sentinelState).handleSentinel,
+}
+
+func (s *sentinelState) handlePing(c *client, cmd []string) string {
+	return "+PONG\r\n"
+}
+
+func (s *sentinelState) masterStatus(m *monitoredMaster) string {
+	switch {
+	case m.odown:
+		return "odown"
+	case s.isDown(m.master):
+		return "sdown"
+	}
+	return "ok"
+}
+
+func (s *sentinelState) sortedMasters() []*monitoredMaster {
+	masters := make([]*monitoredMaster, 0, len(s.masters))
+	for _, m := range s.masters {
+		masters = append(masters, m)
+	}
+	slices.SortFunc(masters, func(a, b *monitoredMaster) int { return strings.Compare(a.name, b.name) })
+	return masters
+}
+
+func (s *sentinelState) handleInfo(c *client, cmd []string) string {
+	info := fmt.Sprintf("# Sentinel\r\nsentinel_masters:%d\r\n", len(s.masters))
+	for i, m := range s.sortedMasters() {
+		info += fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, m.name, s.masterStatus(m), m.master.addr, len(m.replicas), len(s.peers)+1)
+	}
+	return encodeBulkString(info)
+}
+
+func (s *sentinelState) masterFields(m *monitoredMaster) []string {
+	host, port, _ := net.SplitHostPort(m.master.addr)
+	flags := "master"
+	if s.isDown(m.master) {
+		flags += ",s_down"
+	}
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != "" {
+		flags += ",failover_in_progress"
+	}
+	return []string{
+		"name", m.name,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(s.peers)),
+		"quorum", strconv.Itoa(m.quorum),
+		"config-epoch", strconv.Itoa(m.configEpoch),
+		"failover-state", m.failoverState,
+	}
+}
+
+func (s *sentinelState) replicaFields(inst *sentinelInstance) []string {
+	host, port, _ := net.SplitHostPort(inst.addr)
+	flags := "slave"
+	if s.isDown(inst) {
+		flags += ",s_down"
+	}
+	return []string{
+		"name", inst.addr,
+		"ip", host,
+		"port", port,
+		"flags", flags,
+		"master-link-status", inst.info["master_link_status"],
+		"master-host", inst.info["master_host"],
+		"master-port", inst.info["master_port"],
+		"slave-repl-offset", inst.info["master_repl_offset"],
+	}
+}
+
+var errNoSuchMaster = errors.New("No such master with that name")
+
+func (s *sentinelState) handleSentinel(c *client, cmd []string) string {
+	if len(cmd) < 2 {
+		return encodeError(errWrongArgs("sentinel"))
+	}
+	sub := strings.ToUpper(cmd[1])
+	// the subcommands below take a master name
+	var m *monitoredMaster
+	switch sub {
+	case "MASTER", "GET-MASTER-ADDR-BY-NAME", "REPLICAS", "SLAVES", "SENTINELS", "REMOVE":
+		if len(cmd) != 3 {
+			return encodeError(errWrongArgs("sentinel|" + strings.ToLower(sub)))
+		}
+		m = s.masters[cmd[2]]
+		if m == nil && sub != "GET-MASTER-ADDR-BY-NAME" {
+			return encodeError(errNoSuchMaster)
+		}
+	}
+
+	switch sub {
+	case "MYID":
+		return encodeBulkString(s.runid)
+
+	case "MASTERS":
+		var masters []string
+		for _, m := range s.sortedMasters() {
+			masters = append(masters, encodeStringArray(s.masterFields(m)))
+		}
+		return encodeArray(masters)
+
+	case "MASTER":
+		return encodeStringArray(s.masterFields(m))
+
+	case "GET-MASTER-ADDR-BY-NAME":
+		if m == nil {
+			return encodeNullArray()
+		}
+		host, port, _ := net.SplitHostPort(m.master.addr)
+		return encodeStringArray([]string{host, port})
+
+	case "REPLICAS", "SLAVES":
+		addrs := make([]string, 0, len(m.replicas))
+		for addr := range m.replicas {
+			addrs = append(addrs, addr)
+		}
+		slices.Sort(addrs)
+		var replicas []string
+		for _, addr := range addrs {
+			replicas = append(replicas, encodeStringArray(s.replicaFields(m.replicas[addr])))
+		}
+		return encodeArray(replicas)
+
+	case "SENTINELS":
+		var peers []string
+		for _, peer := range s.peers {
+			host, port, _ := net.SplitHostPort(peer.addr)
+			peers = append(peers, encodeStringArray([]string{
+				"name", peer.addr, "ip", host, "port", port, "runid", peer.runid,
+				"last-hello-message", strconv.Itoa(int(time.Since(peer.lastHello).Milliseconds())),
+			}))
+		}
+		return encodeArray(peers)
+
+	case "REMOVE":
+		s.removeMaster(m)
+		fmt.Printf("-monitor master %s %s\n", m.name, m.master.addr)
+		return "+OK\r\n"
+
+	case "RESET":
+		if len(cmd) != 3 {
+			return encodeError(errWrongArgs("sentinel|reset"))
+		}
+		reset := 0
+		for _, m := range s.masters {
+			if matchPattern(cmd[2], m.name) {
+				s.resetMaster(m)
+				reset++
+			}
+		}
+		return encodeInteger(reset)
+
+	case "IS-MASTER-DOWN-BY-ADDR":
+		return s.handleIsMasterDown(cmd)
+
+	case "HELLO":
+		return s.handleHello(c, cmd)
+	}
+	return encodeError(fmt.Errorf("unknown subcommand '%s'. Try SENTINEL HELP.", cmd[1]))
+}
+
+// handleIsMasterDown answers SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port>
+// <current-epoch> <runid> with whether we see that master down and, when
+// runid is not *, our vote for the failover leader of the epoch: the first
+// sentinel asking gets it.
+func (s *sentinelState) handleIsMasterDown(cmd []string) string {
+	if len(cmd) != 6 {
+		return encodeError(errWrongArgs("sentinel|is-master-down-by-addr"))
+	}
+	epoch, err := strconv.Atoi(cmd[4])
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	addr := net.JoinHostPort(cmd[2], cmd[3])
+	var m *monitoredMaster
+	for _, candidate := range s.masters {
+		if candidate.master.addr == addr {
+			m = candidate
+		}
+	}
+
+	down, leader, leaderEpoch := 0, "*", 0
+	if m != nil && s.isDown(m.master) {
+		down = 1
+	}
+	if m != nil && cmd[5] != "*" {
+		if epoch > s.currentEpoch {
+			s.currentEpoch = epoch
+			fmt.Printf("+new-epoch %d\n", epoch)
+		}
+		if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+			m.leader, m.leaderEpoch = cmd[5], epoch
+			fmt.Printf("+vote-for-leader %s %d\n", m.leader, epoch)
+			if m.leader != s.runid {
+				// give the leader time to complete before trying ourselves
+				m.failoverStart = time.Now()
+			}
+		}
+		leader, leaderEpoch = m.leader, m.leaderEpoch
+	}
+	return encodeArray([]string{encodeInteger(down), encodeBulkString(leader), encodeInteger(leaderEpoch)})
+}
+
+// handleHello records a SENTINEL HELLO <port> <runid> <current-epoch> <name>
+// <master-ip> <master-port> <config-epoch> from another sentinel, and
+// switches to the master it announces if its configuration is newer.
+func (s *sentinelState) handleHello(c *client, cmd []string) string {
+	if len(cmd) != 9 {
+		return encodeError(errWrongArgs("sentinel|hello"))
+	}
+	epoch, err1 := strconv.Atoi(cmd[4])
+	configEpoch, err2 := strconv.Atoi(cmd[8])
+	if err1 != nil || err2 != nil {
+		return encodeError(errNotInteger)
+	}
+	runid := cmd[3]
+	if runid == s.runid {
+		return "+OK\r\n"
+	}
+
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	addr := net.JoinHostPort(host, cmd[2])
+	for other, peer := range s.peers {
+		// the same sentinel configured under another address
+		if peer.runid == runid && other != addr {
+			go peer.link.shutdown()
+			delete(s.peers, other)
+		}
+	}
+	peer, ok := s.peers[addr]
+	if !ok {
+		peer = s.addPeer(addr)
+		fmt.Printf("+sentinel sentinel %s %s\n", runid, addr)
+	}
+	peer.runid, peer.lastHello = runid, time.Now()
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		fmt.Printf("+new-epoch %d\n", epoch)
+	}
+	if m := s.masters[cmd[5]]; m != nil && configEpoch > m.configEpoch {
+		if masterAddr := net.JoinHostPort(cmd[6], cmd[7]); masterAddr != m.master.addr {
+			s.switchMaster(m, masterAddr, configEpoch)
+		}
+		m.configEpoch = configEpoch
+	}
+	return "+OK\r\n"
+}
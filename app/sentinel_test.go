@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSentinel runs a sentinel on a random port of the loopback interface
+// until the test ends, monitoring the master "mymaster" at masterAddr.
+func newTestSentinel(t *testing.T, listener net.Listener, masterAddr string, quorum int, downAfter time.Duration, peers ...string) *sentinelState {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(masterAddr)
+	cfg := &sentinelConfig{
+		enabled:         true,
+		downAfter:       int(downAfter.Milliseconds()),
+		failoverTimeout: 5000,
+	}
+	if err := cfg.addMonitor(strings.Join([]string{"mymaster", host, port, strconv.Itoa(quorum)}, " ")); err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range peers {
+		if err := cfg.addPeer(peer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newSentinel(listener.Addr().(*net.TCPAddr).Port, cfg)
+	go s.serve(listener)
+	t.Cleanup(func() {
+		listener.Close()
+		s.close()
+	})
+	return s
+}
+
+func listenLoopback(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// sentinelCommand runs cmd on s as a client of the loopback interface and
+// returns the decoded reply.
+func sentinelCommand(t *testing.T, s *sentinelState, cmd ...string) any {
+	t.Helper()
+	c := &client{id: 1, conn: loopbackConn{}}
+	s.mu.Lock()
+	response := sentinelCommands[strings.ToLower(cmd[0])](s, c, cmd)
+	s.mu.Unlock()
+	reply, err := decodeReply(bufio.NewReader(strings.NewReader(response)))
+	if err != nil {
+		t.Fatalf("%q: decoding the reply: %v", cmd, err)
+	}
+	return reply
+}
+
+// loopbackConn stands for the connection of a client of 127.0.0.1.
+type loopbackConn struct {
+	net.Conn
+}
+
+func (loopbackConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+// waitFor polls cond until it holds, failing the test after timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// TestSentinelLeaderVote checks that a sentinel gives its vote for the
+// failover leader of an epoch to the first sentinel asking, and only to it.
+func TestSentinelLeaderVote(t *testing.T) {
+	// nothing listens there, the master is down at once
+	dead := listenLoopback(t)
+	masterAddr := dead.Addr().String()
+	dead.Close()
+	s := newTestSentinel(t, listenLoopback(t), masterAddr, 1, time.Millisecond)
+	host, port, _ := net.SplitHostPort(masterAddr)
+	time.Sleep(10 * time.Millisecond)
+
+	for _, vote := range []struct {
+		epoch, runid string
+		want         []any
+	}{
+		{"1", "sentinel-a", []any{1, "sentinel-a", 1}},
+		{"1", "sentinel-b", []any{1, "sentinel-a", 1}},
+		{"2", "sentinel-b", []any{1, "sentinel-b", 2}},
+		{"1", "sentinel-a", []any{1, "sentinel-b", 2}},
+		// asking whether the master is down doesn't vote
+		{"3", "*", []any{1, "*", 0}},
+	} {
+		reply := sentinelCommand(t, s, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, port, vote.epoch, vote.runid)
+		if got, ok := reply.([]any); !ok || len(got) != 3 || got[0] != vote.want[0] || got[1] != vote.want[1] || got[2] != vote.want[2] {
+			t.Errorf("vote of epoch %s for %s = %v, want %v", vote.epoch, vote.runid, reply, vote.want)
+		}
+	}
+	if reply := sentinelCommand(t, s, "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "1", "1", "*"); reply.([]any)[0] != 0 {
+		t.Errorf("an unknown master is down: %v", reply)
+	}
+}
+
+// TestSentinelQuorum checks that a master is only objectively down once
+// quorum sentinels see it down.
+func TestSentinelQuorum(t *testing.T) {
+	dead := listenLoopback(t)
+	masterAddr := dead.Addr().String()
+	dead.Close()
+	peerListener := listenLoopback(t)
+	peer := newTestSentinel(t, peerListener, masterAddr, 2, time.Hour)
+	s := newTestSentinel(t, listenLoopback(t), masterAddr, 2, time.Millisecond, peerListener.Addr().String())
+	m := s.masters["mymaster"]
+	time.Sleep(10 * time.Millisecond)
+
+	s.checkObjectivelyDown(m)
+	if s.mu.Lock(); m.odown {
+		t.Error("objectively down with one sentinel of two seeing it down")
+	}
+	s.mu.Unlock()
+
+	// the peer gives up on the master too
+	peer.mu.Lock()
+	peer.downAfter = time.Millisecond
+	peer.mu.Unlock()
+	s.checkObjectivelyDown(m)
+	if s.mu.Lock(); !m.odown {
+		t.Error("not objectively down with both sentinels seeing it down")
+	}
+	s.mu.Unlock()
+	if flags := sentinelCommand(t, s, "SENTINEL", "MASTER", "mymaster").([]any)[7]; flags != "master,s_down,o_down" {
+		t.Errorf("flags = %v", flags)
+	}
+}
+
+// TestSentinelFailover runs three sentinels watching a master and its
+// replica. Two of them only learn about the others through HELLO messages.
+// Once the master dies, they agree that it is down, elect a leader that
+// promotes the replica, and all end up announcing the replica as the master.
+func TestSentinelFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes several seconds of sentinel timers")
+	}
+	master := newTestServer(t)
+	masterPort, killMaster := serveTestServer(t, master)
+	replica := newTestServer(t)
+	replicaPort, _ := serveTestServer(t, replica)
+	call(t, replica, &client{id: 1}, "REPLICAOF", "127.0.0.1", strconv.Itoa(masterPort))
+	defer stopReplication(t, replica)
+	waitReplState(t, replica, replStateConnected)
+
+	masterAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(masterPort))
+	replicaAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(replicaPort))
+	listeners := []net.Listener{listenLoopback(t), listenLoopback(t), listenLoopback(t)}
+	downAfter := 1500 * time.Millisecond
+	sentinels := []*sentinelState{
+		newTestSentinel(t, listeners[0], masterAddr, 2, downAfter, listeners[1].Addr().String(), listeners[2].Addr().String()),
+		newTestSentinel(t, listeners[1], masterAddr, 2, downAfter),
+		newTestSentinel(t, listeners[2], masterAddr, 2, downAfter),
+	}
+
+	for _, s := range sentinels[1:] {
+		waitFor(t, 5*time.Second, "the first sentinel to say hello", func() bool {
+			peers := sentinelCommand(t, s, "SENTINEL", "SENTINELS", "mymaster").([]any)
+			return len(peers) == 1 && peers[0].([]any)[7] == sentinels[0].runid
+		})
+	}
+	for _, s := range sentinels {
+		waitFor(t, 5*time.Second, "the sentinels to find the replica", func() bool {
+			replicas := sentinelCommand(t, s, "SENTINEL", "REPLICAS", "mymaster").([]any)
+			return len(replicas) == 1 && replicas[0].([]any)[1] == replicaAddr && replicas[0].([]any)[9] == "up"
+		})
+	}
+
+	killMaster()
+	for _, s := range sentinels {
+		waitFor(t, 15*time.Second, "the sentinels to switch to the replica", func() bool {
+			addr := sentinelCommand(t, s, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster").([]any)
+			return net.JoinHostPort(addr[0].(string), addr[1].(string)) == replicaAddr
+		})
+	}
+	info, _ := call(t, replica, &client{id: 1}, "INFO", "replication").(string)
+	if role := parseInfoFields(info)["role"]; role != "master" {
+		t.Errorf("the replica has role %v after the failover", role)
+	}
+	// the former master is now known as a replica of the new one
+	epochs := map[any]bool{}
+	for _, s := range sentinels {
+		fields := sentinelCommand(t, s, "SENTINEL", "MASTER", "mymaster").([]any)
+		epochs[fields[15]] = true
+		replicas := sentinelCommand(t, s, "SENTINEL", "REPLICAS", "mymaster").([]any)
+		if len(replicas) != 1 || replicas[0].([]any)[1] != masterAddr {
+			t.Errorf("replicas after the failover = %v", replicas)
+		}
+	}
+	if len(epochs) != 1 || epochs["0"] {
+		t.Errorf("config epochs after the failover = %v", epochs)
+	}
+}
+
+// TestSentinelRemove checks that SENTINEL REMOVE and RESET stop monitoring
+// the instances they drop.
+func TestSentinelRemove(t *testing.T) {
+	master := newTestServer(t)
+	masterPort, _ := serveTestServer(t, master)
+	s := newTestSentinel(t, listenLoopback(t), net.JoinHostPort("127.0.0.1", strconv.Itoa(masterPort)), 1, time.Minute)
+	s.mu.Lock()
+	m := s.masters["mymaster"]
+	replica := s.newInstance(m, "127.0.0.1:1")
+	m.replicas[replica.addr] = replica
+	s.mu.Unlock()
+
+	if reply := sentinelCommand(t, s, "SENTINEL", "RESET", "my*"); reply != 1 {
+		t.Errorf("SENTINEL RESET = %v", reply)
+	}
+	select {
+	case <-replica.stop:
+	default:
+		t.Error("the replica is still monitored after SENTINEL RESET")
+	}
+
+	if reply := sentinelCommand(t, s, "SENTINEL", "REMOVE", "mymaster"); reply != "OK" {
+		t.Errorf("SENTINEL REMOVE = %v", reply)
+	}
+	select {
+	case <-m.master.stop:
+	default:
+		t.Error("the master is still monitored after SENTINEL REMOVE")
+	}
+	if reply, _ := sentinelCommand(t, s, "SENTINEL", "MASTER", "mymaster").(error); reply == nil {
+		t.Error("SENTINEL MASTER succeeds after SENTINEL REMOVE")
+	}
+}
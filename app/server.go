@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,56 +20,225 @@ type serverConfig struct {
 	role       string
 	replid     string
 	replOffset int
-	masterHost string
-	masterPort int
-	dbDir      string
-	dbFileName string
+	// the previous replication ID, valid up to secondReplOffset, after a
+	// replica was promoted
+	replid2          string
+	secondReplOffset int
+	masterHost       string
+	masterPort       int
+	dbDir            string
+	dbFileName       string
+	savePoints       []savePoint
+
+	appendOnly     bool
+	appendFsync    string
+	appendFileName string
+
+	replBacklogSize int
+	// a master pings its replicas every replPingReplicaPeriod seconds, and
+	// a replica drops a link silent for replTimeout seconds
+	replPingReplicaPeriod int
+	replTimeout           int
+	// stream full resynch payloads straight to the replicas, batching
+	// those arriving within replDisklessSyncDelay seconds
+	replDisklessSync      bool
+	replDisklessSyncDelay int
+	// replicas reject writes from their own clients
+	replicaReadOnly bool
+	// a master refuses writes unless at least minReplicasToWrite replicas
+	// acknowledged within the last minReplicasMaxLag seconds
+	minReplicasToWrite int
+	minReplicasMaxLag  int
+
+	// entries claimed again after this many deliveries go to a dead-letter
+	// stream instead, 0 to disable
+	streamMaxDeliveries int
+
+	clusterEnabled     bool
+	clusterNodeTimeout int // milliseconds
 }
 
+// serverState holds the keyspace and replication state. Every field below mu
+// is guarded by it; commands run one at a time with mu held (see
+// handleCommand), so handlers must release it before blocking.
 type serverState struct {
-	streams       map[string]*stream
-	store         map[string]string
-	ttl           map[string]time.Time
-	config        serverConfig
-	replicas      []replica
-	replicaOffset int
-	ackReceived   chan bool
+	mu       sync.Mutex
+	streams  map[string]*stream
+	store    map[string]string
+	lists    map[string][]string
+	sets     map[string]map[string]struct{}
+	zsets    map[string]map[string]float64
+	hashes   map[string]map[string]string
+	ttl      map[string]time.Time
+	config   serverConfig
+	replicas []replica
+	backlog  *replicationBacklog
+	// replicas waiting for the next diskless sync to start
+	disklessSync *disklessSync
+	ackNotify    chan struct{} // closed and replaced on every REPLCONF ACK
+	lastAckSent  time.Time
+	lastPingSent time.Time
+
+	// replica side of the link with the master
+	replState      string
+	replGeneration int // bumped whenever the master changes, see replicaOf
+	masterConn     net.Conn
+	masterAcks     chan int // offsets for writeReplicaAcks to send
+	masterLastIO   time.Time
+
+	failover     *failoverRequest
+	writesPaused chan struct{} // closed when writes resume
+
+	// persistence
+	dirty            int
+	lastSave         time.Time
+	lastBgsaveTry    time.Time
+	lastBgsaveOK     bool
+	bgsaveInProgress bool
+	bgsaveScheduled  bool
+
+	aofFile              *os.File
+	aofPendingFsync      bool
+	aofLastFsync         time.Time
+	aofRewriteInProgress bool
+	aofRewriteBuf        []byte
+	aofLastRewriteOK     bool
+
+	cluster *clusterState // nil unless cluster mode is enabled
+
+	obeying bool // running a command of the master link or the AOF loader
+
+	// XREAD readers blocked on stream keys that do not exist yet
+	streamWaiters map[string][]chan bool
+}
+
+// client is the per-connection state handed to command handlers.
+type client struct {
+	id            int
+	conn          net.Conn
+	listeningPort int  // announced by replicas with REPLCONF listening-port
+	writeOffset   int  // replication offset after the last write, see WAIT
+	master        bool // the link with our master, exempt from replica-read-only
+	capaEOF       bool // the replica understands diskless payloads
+	asking        bool // ASKING was sent, see checkClusterSlot
+	// set by PSYNC: once the reply is sent the connection becomes a
+	// replica link, after the full resynch payload when resynch or
+	// disklessSync is set
+	replica      bool
+	resynch      *snapshot
+	disklessSync *disklessSync
 }
 
 func main() {
 
 	var config serverConfig
+	var save, appendOnly, replBacklogSize, replicaReadOnly, replDisklessSync, clusterEnabled string
 
 	flag.IntVar(&config.port, "port", 6379, "listen on specified port")
 	flag.StringVar(&config.masterHost, "replicaof", "", "start server in replica mode of given host and port")
 	flag.StringVar(&config.dbDir, "dir", "/tmp", "directory to store the RDB file")
 	flag.StringVar(&config.dbFileName, "dbfilename", "redis.rdb", "name of the RDB file")
+	flag.StringVar(&save, "save", "3600 1 300 100 60 10000", "save the DB after <seconds> <changes> pairs, empty to disable")
+	flag.StringVar(&appendOnly, "appendonly", "no", "log every write to the append only file (yes|no)")
+	flag.StringVar(&config.appendFsync, "appendfsync", fsyncEverySec, "fsync policy of the append only file (always|everysec|no)")
+	flag.StringVar(&config.appendFileName, "appendfilename", "appendonly.aof", "name of the append only file")
+	flag.StringVar(&replBacklogSize, "repl-backlog-size", "1mb", "size of the replication backlog kept for partial resynchronization")
+	flag.IntVar(&config.replPingReplicaPeriod, "repl-ping-replica-period", 10, "seconds between the PINGs a master sends to its replicas")
+	flag.IntVar(&config.replTimeout, "repl-timeout", 60, "seconds without data from the master after which a replica reconnects")
+	flag.StringVar(&replDisklessSync, "repl-diskless-sync", "no", "stream full resynch payloads to replicas instead of writing an RDB file first (yes|no)")
+	flag.IntVar(&config.replDisklessSyncDelay, "repl-diskless-sync-delay", 5, "seconds to wait for more replicas before a diskless sync")
+	flag.StringVar(&replicaReadOnly, "replica-read-only", "yes", "reject writes from clients of a replica (yes|no)")
+	flag.IntVar(&config.minReplicasToWrite, "min-replicas-to-write", 0, "refuse writes with fewer good replicas, 0 to disable")
+	flag.IntVar(&config.minReplicasMaxLag, "min-replicas-max-lag", 10, "seconds since the last ack after which a replica is not good")
+	flag.IntVar(&config.streamMaxDeliveries, "stream-max-deliveries", 0, "move stream entries claimed after this many deliveries to a dead-letter stream, 0 to disable")
+	flag.StringVar(&clusterEnabled, "cluster-enabled", "no", "serve a share of the 16384 hash slots of a cluster (yes|no)")
+	flag.IntVar(&config.clusterNodeTimeout, "cluster-node-timeout", 15000, "milliseconds a cluster node may be unreachable before it is failing")
+	var sentinel sentinelConfig
+	flag.BoolVar(&sentinel.enabled, "sentinel", false, "run as a sentinel monitoring masters instead of serving data")
+	flag.Func("sentinel-monitor", `monitor a master given as "<name> <host> <port> <quorum>", can be repeated`, sentinel.addMonitor)
+	flag.Func("sentinel-peer", "address of another sentinel monitoring the same masters, can be repeated", sentinel.addPeer)
+	flag.IntVar(&sentinel.downAfter, "sentinel-down-after-milliseconds", 30000, "time without a valid PING reply after which an instance is down")
+	flag.IntVar(&sentinel.failoverTimeout, "sentinel-failover-timeout", 180000, "time a failover may take, twice that before retrying one")
 	flag.Parse()
 
+	if sentinel.enabled {
+		port := 26379
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "port" {
+				port = config.port
+			}
+		})
+		runSentinel(port, &sentinel)
+		return
+	}
+
+	var err error
+	config.savePoints, err = parseSavePoints(save)
+	if err != nil {
+		fmt.Println("Invalid save parameter:", err)
+		os.Exit(1)
+	}
+	config.appendOnly, err = parseYesNo(appendOnly)
+	if err != nil {
+		fmt.Println("Invalid appendonly parameter:", err)
+		os.Exit(1)
+	}
+	config.appendFsync = strings.ToLower(config.appendFsync)
+	if err = checkFsyncPolicy(config.appendFsync); err != nil {
+		fmt.Println("Invalid appendfsync parameter:", err)
+		os.Exit(1)
+	}
+	config.replBacklogSize, err = parseMemory(replBacklogSize)
+	if err != nil {
+		fmt.Println("Invalid repl-backlog-size parameter:", err)
+		os.Exit(1)
+	}
+	config.replDisklessSync, err = parseYesNo(replDisklessSync)
+	if err != nil {
+		fmt.Println("Invalid repl-diskless-sync parameter:", err)
+		os.Exit(1)
+	}
+	config.replicaReadOnly, err = parseYesNo(replicaReadOnly)
+	if err != nil {
+		fmt.Println("Invalid replica-read-only parameter:", err)
+		os.Exit(1)
+	}
+	config.clusterEnabled, err = parseYesNo(clusterEnabled)
+	if err != nil {
+		fmt.Println("Invalid cluster-enabled parameter:", err)
+		os.Exit(1)
+	}
+	if config.clusterNodeTimeout < 1 {
+		fmt.Println("Invalid cluster-node-timeout parameter: must be positive")
+		os.Exit(1)
+	}
+	if config.replPingReplicaPeriod < 1 || config.replTimeout < 1 {
+		fmt.Println("Invalid parameters: repl-ping-replica-period and repl-timeout must be positive")
+		os.Exit(1)
+	}
+	if config.replDisklessSyncDelay < 0 || config.minReplicasToWrite < 0 || config.minReplicasMaxLag < 0 || config.streamMaxDeliveries < 0 {
+		fmt.Println("Invalid parameters: must not be negative")
+		os.Exit(1)
+	}
+
+	config.secondReplOffset = -1
 	if len(config.masterHost) == 0 {
 		config.role = "master"
 		config.replid = randReplid()
 	} else {
 		config.role = "slave"
-		switch flag.NArg() {
-		case 0:
-			config.masterPort = 6379
-		case 1:
-			config.masterPort, _ = strconv.Atoi(flag.Arg(0))
-		default:
-			flag.Usage()
+		config.masterHost, config.masterPort, err = parseReplicaOf(config.masterHost, flag.Args())
+		if err != nil {
+			fmt.Println("Invalid replicaof parameter:", err)
+			os.Exit(1)
 		}
 	}
 
 	srv := newServer(config)
 
-	rdbFilePath := fmt.Sprintf("%s/%s", srv.config.dbDir, srv.config.dbFileName)
-	if _, err := os.Stat(rdbFilePath); err == nil {
-		err = readKeyFromRDBFile(rdbFilePath, srv.store, srv.ttl)
-		if err != nil {
-			fmt.Println("Error reading keys from RDB file:", err)
-			os.Exit(1)
-		}
+	if err := srv.loadDataFromDisk(); err != nil {
+		fmt.Println("Error loading data from disk:", err)
+		os.Exit(1)
 	}
 
 	srv.start()
@@ -74,18 +246,58 @@ func main() {
 
 func newServer(config serverConfig) *serverState {
 	var srv serverState
-	srv.store = make(map[string]string)
-	srv.ttl = make(map[string]time.Time)
-	srv.ackReceived = make(chan bool)
+	srv.flushKeyspace()
+	srv.ackNotify = make(chan struct{})
 	srv.config = config
-	srv.streams = make(map[string]*stream)
+	srv.lastSave = time.Now()
+	srv.lastBgsaveOK = true
+	srv.aofLastRewriteOK = true
+	if config.clusterEnabled {
+		srv.cluster = newClusterState(config.port, time.Duration(config.clusterNodeTimeout)*time.Millisecond)
+	}
 	return &srv
 }
 
+// loadDataFromDisk restores the dataset from the AOF when it is enabled and
+// present, from the RDB file otherwise.
+func (srv *serverState) loadDataFromDisk() error {
+	aofPath := srv.aofFilePath()
+	if srv.config.appendOnly {
+		if _, err := os.Stat(aofPath); err == nil {
+			if err := srv.loadAppendOnlyFile(aofPath); err != nil {
+				return err
+			}
+			return srv.openAppendOnlyFile()
+		}
+	}
+
+	rdbFilePath := srv.rdbFilePath()
+	if _, err := os.Stat(rdbFilePath); err == nil {
+		if err := srv.readRDBFile(rdbFilePath); err != nil {
+			return err
+		}
+	}
+
+	if srv.config.appendOnly {
+		// start the AOF from the dataset loaded so far
+		file, err := rewriteAppendOnlyFile(srv.config.dbDir, srv.takeSnapshot())
+		if err != nil {
+			return err
+		}
+		return srv.finishAppendOnlyRewrite(file)
+	}
+	return nil
+}
+
 func (srv *serverState) start() {
 	if srv.config.role == "slave" {
-		srv.replicaHandshake()
+		go srv.replicationLoop(srv.replGeneration)
+	}
+
+	if srv.cluster != nil {
+		srv.startCluster()
 	}
+	go srv.cron()
 
 	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", srv.config.port))
 	if err != nil {
@@ -108,6 +320,7 @@ func (srv *serverState) serveClient(id int, conn net.Conn) {
 	fmt.Printf("[#%d] Client connected: %v\n", id, conn.RemoteAddr().String())
 
 	reader := bufio.NewReader(conn)
+	c := &client{id: id, conn: conn}
 
 	for {
 		cmd, _, err := decodeStringArray(reader)
@@ -115,15 +328,15 @@ func (srv *serverState) serveClient(id int, conn net.Conn) {
 			if err == io.EOF {
 				break
 			}
-			fmt.Printf("[%d] Error decoding command: %v\n", id, err.Error())
-		}
-
-		if len(cmd) == 0 {
+			fmt.Printf("[#%d] Error decoding command: %v\n", id, err.Error())
+			if _, ok := err.(protocolError); ok {
+				conn.Write([]byte(encodeError(err)))
+			}
 			break
 		}
 
 		fmt.Printf("[#%d] Command = %q\n", id, cmd)
-		response, resynch := srv.handleCommand(cmd)
+		response := srv.handleCommand(c, cmd)
 
 		if len(response) > 0 {
 			bytesSent, err := conn.Write([]byte(response))
@@ -134,12 +347,14 @@ func (srv *serverState) serveClient(id int, conn net.Conn) {
 			fmt.Printf("[#%d] Bytes sent: %d %q\n", id, bytesSent, response)
 		}
 
-		if resynch {
-			size := sendFullResynch(conn)
-			fmt.Printf("[#%d] full resynch sent: %d\n", id, size)
-			srv.replicas = append(srv.replicas, replica{conn, 0, 0})
+		if c.replica {
+			if err := srv.attachReplica(c); err != nil {
+				fmt.Printf("[#%d] Error attaching replica: %v\n", id, err.Error())
+				break
+			}
 			fmt.Printf("[#%d] Client promoted to replica\n", id)
-			return
+			srv.serveReplica(c, reader)
+			break
 		}
 	}
 
@@ -147,116 +362,322 @@ func (srv *serverState) serveClient(id int, conn net.Conn) {
 	conn.Close()
 }
 
-func (srv *serverState) handleCommand(cmd []string) (response string, resynch bool) {
-	isWrite := false
+// cron runs the periodic background tasks.
+func (srv *serverState) cron() {
+	for range time.Tick(100 * time.Millisecond) {
+		srv.mu.Lock()
+		srv.checkSavePoints()
+		srv.checkAppendOnlyFsync()
+		srv.sendReplicaAck()
+		srv.pingReplicas()
+		if srv.cluster != nil {
+			srv.clusterCron()
+		}
+		srv.mu.Unlock()
+	}
+}
 
-	switch strings.ToUpper(cmd[0]) {
+// handleCommand looks cmd up in the command table, checks its arity and runs
+// the handler with srv.mu held.
+func (srv *serverState) handleCommand(c *client, cmd []string) (response string) {
+	name := strings.ToLower(cmd[0])
+	command, ok := commandTable[name]
+	if !ok {
+		return encodeError(unknownCommandError(cmd))
+	}
+	if !command.checkArity(len(cmd)) {
+		return encodeError(errWrongArgs(name))
+	}
 
-	case "PING":
-		response = "+PONG\r\n"
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 
-	case "ECHO":
-		response = encodeBulkString(cmd[1])
+	// a FAILOVER holds writes until the replica took over
+	for srv.writesPaused != nil && command.flags&flagWrite != 0 {
+		paused := srv.writesPaused
+		srv.mu.Unlock()
+		<-paused
+		srv.mu.Lock()
+	}
+	// the master link and the AOF loader replay whatever they are sent
+	if srv.cluster != nil && c.id > 0 && !c.master {
+		if err := srv.checkClusterSlot(c, command, cmd); err != nil {
+			return encodeError(err)
+		}
+	}
+	if command.flags&flagWrite != 0 {
+		if err := srv.checkWriteAllowed(c); err != nil {
+			return encodeError(err)
+		}
+	}
 
-	case "INFO":
-		if len(cmd) == 2 && strings.ToUpper(cmd[1]) == "REPLICATION" {
-			response = encodeBulkString(fmt.Sprintf("role:%s\r\nmaster_replid:%s\r\nmaster_repl_offset:%d",
-				srv.config.role, srv.config.replid, srv.config.replOffset))
+	// the master link and the AOF loader must see keys as they are, even
+	// expired ones, see expireIfNeeded
+	srv.obeying = c.master || c.id < 0
+	dirty := srv.dirty
+	response = command.handler(srv, c, cmd)
+	srv.obeying = false
+	if command.flags&flagWrite != 0 && srv.dirty != dirty {
+		if rewritten := srv.rewriteForPropagation(cmd); rewritten != nil {
+			srv.propagate(rewritten)
 		}
+	}
+	if command.flags&flagWrite != 0 {
+		c.writeOffset = srv.config.replOffset
+	}
+	return
+}
+
+// propagate logs a command that changed the dataset to the AOF and streams it
+// to the replicas. Must be called with srv.mu held.
+func (srv *serverState) propagate(cmd []string) {
+	srv.feedAppendOnlyFile(cmd)
+	srv.propagateToReplicas(cmd)
+}
+
+func (srv *serverState) handlePing(c *client, cmd []string) string {
+	if len(cmd) == 2 {
+		return encodeBulkString(cmd[1])
+	}
+	return "+PONG\r\n"
+}
+
+func (srv *serverState) handleEcho(c *client, cmd []string) string {
+	return encodeBulkString(cmd[1])
+}
+
+var infoSections = []struct {
+	name   string
+	render func(srv *serverState) string
+}{
+	{"persistence", (*serverState).infoPersistence},
+	{"replication", (*serverState).infoReplication},
+	{"cluster", (*serverState).infoCluster},
+}
 
-	case "SET":
-		isWrite = true
-		key, value := cmd[1], cmd[2]
-		srv.store[key] = value
-		if len(cmd) == 5 && strings.ToUpper(cmd[3]) == "PX" {
-			expiration, _ := strconv.Atoi(cmd[4])
-			srv.ttl[key] = time.Now().Add(time.Millisecond * time.Duration(expiration))
+func (srv *serverState) handleInfo(c *client, cmd []string) string {
+	requested := map[string]bool{}
+	for _, section := range cmd[1:] {
+		requested[strings.ToLower(section)] = true
+	}
+	all := len(requested) == 0 || requested["all"] || requested["default"] || requested["everything"]
+
+	var info []string
+	for _, section := range infoSections {
+		if all || requested[section.name] {
+			info = append(info, section.render(srv))
 		}
-		response = "+OK\r\n"
+	}
+	return encodeBulkString(strings.Join(info, "\r\n"))
+}
 
-	case "GET":
-		key := cmd[1]
-		value, ok := srv.store[key]
-		if ok {
-			expiration, exists := srv.ttl[key]
-			if !exists || expiration.After(time.Now()) {
-				response = encodeBulkString(value)
-			} else if exists {
-				delete(srv.ttl, key)
-				delete(srv.store, key)
-				response = encodeBulkString("")
-			}
-		} else {
-			response = encodeBulkString("")
-		}
-
-	case "REPLCONF":
-		switch strings.ToUpper(cmd[1]) {
-		case "GETACK":
-			response = encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(srv.replicaOffset)})
-		case "ACK":
-			srv.ackReceived <- true
-			response = ""
-		default:
-			response = "+OK\r\n"
-		}
-
-	case "PSYNC":
-		if len(cmd) == 3 {
-			response = fmt.Sprintf("+FULLRESYNC %s 0\r\n", srv.config.replid)
-			resynch = true
-		}
-
-	case "WAIT":
-		count, _ := strconv.Atoi(cmd[1])
-		timeout, _ := strconv.Atoi(cmd[2])
-		response = srv.waitForWriteAck(count, timeout)
-
-	case "CONFIG":
-		switch strings.ToUpper(cmd[1]) {
-		case "GET":
-			if strings.ToUpper(cmd[2]) == "DIR" {
-				response = encodeStringArray([]string{"dir", srv.config.dbDir})
-			} else if strings.ToUpper(cmd[2]) == "DBFILENAME" {
-				response = encodeStringArray([]string{"dbfilename", srv.config.dbFileName})
-			}
-		default:
-			response = "+OK\r\n"
-		}
-	case "KEYS":
-		if len(cmd) == 2 && cmd[1] == "*" {
-			keys := make([]string, 0, len(srv.store))
-			for k := range srv.store {
-				keys = append(keys, k)
-			}
-			response = encodeStringArray(keys)
-		}
-	case "TYPE":
-		key := cmd[1]
-		_, exists := srv.streams[key]
-		if exists {
-			response = encodeSimpleString("stream")
-		} else {
-			_, exists := srv.store[key]
-			if exists {
-				response = encodeSimpleString("string")
-			} else {
-				response = encodeSimpleString("none")
+func (srv *serverState) infoReplication() string {
+	info := fmt.Sprintf("# Replication\r\nrole:%s\r\n", srv.config.role)
+	if srv.config.role == "slave" {
+		status, lastIO := "down", -1
+		if srv.replState == replStateConnected {
+			status, lastIO = "up", int(time.Since(srv.masterLastIO).Seconds())
+		}
+		info += fmt.Sprintf("master_host:%s\r\nmaster_port:%d\r\nmaster_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\nmaster_sync_in_progress:%d\r\n",
+			srv.config.masterHost, srv.config.masterPort, status, lastIO, boolToInt(srv.replState == replStateSync))
+	}
+	// replicas can have replicas of their own
+	info += fmt.Sprintf("connected_slaves:%d\r\n", len(srv.replicas))
+	if srv.config.role == "master" && srv.config.minReplicasToWrite > 0 {
+		info += fmt.Sprintf("min_slaves_good_slaves:%d\r\n", srv.countGoodReplicas())
+	}
+	for i, r := range srv.replicas {
+		state := "wait_bgsave"
+		if r.online {
+			state = "online"
+		}
+		info += fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, r.host, r.port, state, r.ackOffset, int(time.Since(r.lastAck).Seconds()))
+	}
+	if srv.config.role == "master" {
+		failoverState := "no-failover"
+		if srv.failover != nil {
+			failoverState = "waiting-for-sync"
+		}
+		info += fmt.Sprintf("master_failover_state:%s\r\n", failoverState)
+	}
+	info += fmt.Sprintf("master_replid:%s\r\nmaster_replid2:%s\r\nmaster_repl_offset:%d\r\nsecond_repl_offset:%d\r\n",
+		srv.config.replid, formatReplid(srv.config.replid2), srv.config.replOffset, srv.config.secondReplOffset)
+	if srv.backlog == nil {
+		return info + "repl_backlog_active:0\r\n"
+	}
+	return info + fmt.Sprintf("repl_backlog_active:1\r\nrepl_backlog_size:%d\r\nrepl_backlog_first_byte_offset:%d\r\nrepl_backlog_histlen:%d\r\n",
+		len(srv.backlog.buf), srv.backlog.firstOffset(srv.config.replOffset), srv.backlog.histlen)
+}
+
+func (srv *serverState) handleSet(c *client, cmd []string) string {
+	key, value := cmd[1], cmd[2]
+
+	var expiration time.Time
+	for i := 3; i < len(cmd); i++ {
+		option := strings.ToUpper(cmd[i])
+		if !slices.Contains([]string{"EX", "PX", "EXAT", "PXAT"}, option) || i+1 == len(cmd) || !expiration.IsZero() {
+			return encodeError(errSyntax)
+		}
+		i++
+		amount, err := strconv.ParseInt(cmd[i], 10, 64)
+		if err != nil {
+			return encodeError(errNotInteger)
+		}
+		if amount <= 0 {
+			return encodeError(fmt.Errorf("invalid expire time in 'set' command"))
+		}
+		switch option {
+		case "EX":
+			expiration = time.Now().Add(time.Second * time.Duration(amount))
+		case "PX":
+			expiration = time.Now().Add(time.Millisecond * time.Duration(amount))
+		case "EXAT":
+			expiration = time.Unix(amount, 0)
+		case "PXAT":
+			expiration = time.UnixMilli(amount)
+		}
+	}
+
+	srv.deleteKey(key)
+	srv.store[key] = value
+	if !expiration.IsZero() {
+		srv.ttl[key] = expiration
+		// an absolute time in the past, e.g. when replaying the AOF
+		if !expiration.After(time.Now()) {
+			srv.deleteKey(key)
+		}
+	}
+	srv.dirty++
+	return "+OK\r\n"
+}
+
+func (srv *serverState) handleGet(c *client, cmd []string) string {
+	key := cmd[1]
+	if srv.expireIfNeeded(key) {
+		return encodeNullBulkString()
+	}
+	value, ok := srv.store[key]
+	if !ok {
+		if srv.keyExists(key) {
+			return encodeError(errWrongType)
+		}
+		return encodeNullBulkString()
+	}
+	return encodeBulkString(value)
+}
+
+func (srv *serverState) handleReplconf(c *client, cmd []string) string {
+	switch strings.ToUpper(cmd[1]) {
+	case "GETACK":
+		return encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(srv.config.replOffset)})
+	case "ACK":
+		if len(cmd) != 3 {
+			return encodeError(errWrongArgs("replconf"))
+		}
+		if offset, err := strconv.Atoi(cmd[2]); err == nil {
+			srv.ackReplica(c.conn, offset)
+		}
+		return ""
+	case "LISTENING-PORT":
+		if len(cmd) != 3 {
+			return encodeError(errSyntax)
+		}
+		port, err := strconv.Atoi(cmd[2])
+		if err != nil {
+			return encodeError(errNotInteger)
+		}
+		c.listeningPort = port
+	case "CAPA":
+		// REPLCONF capa <capability> [capa <capability> ...]
+		for i := 2; i < len(cmd); i += 2 {
+			if strings.ToLower(cmd[i]) == "eof" {
+				c.capaEOF = true
 			}
 		}
-	case "XADD":
-		streamKey, id := cmd[1], cmd[2]
-		response = srv.handleStreamAdd(streamKey, id, cmd[3:])
-	case "XRANGE":
-		streamKey, start, end := cmd[1], cmd[2], cmd[3]
-		response = srv.handleStreamRange(streamKey, start, end)
-	case "XREAD":
-		response = srv.handleStreamRead(cmd)
 	}
+	return "+OK\r\n"
+}
 
-	if isWrite {
-		srv.propagateToReplicas(cmd)
+// handlePsync registers the replica and continues from the requested offset
+// when the backlog still holds it, otherwise a full resynch follows the reply
+// (see attachReplica). With the FAILOVER argument, sent by the master of a
+// replica once it has caught up, the replica is promoted instead.
+func (srv *serverState) handlePsync(c *client, cmd []string) string {
+	from, err := strconv.Atoi(cmd[2])
+	if len(cmd) > 3 {
+		if len(cmd) > 4 || strings.ToUpper(cmd[3]) != "FAILOVER" {
+			return encodeError(errSyntax)
+		}
+		if srv.config.role != "slave" || cmd[1] != srv.config.replid {
+			return encodeError(errors.New("PSYNC FAILOVER replid must match my replid."))
+		}
+		if err != nil || from != srv.config.replOffset+1 {
+			return encodeError(fmt.Errorf("PSYNC FAILOVER offset must match my offset %d.", srv.config.replOffset+1))
+		}
+		fmt.Printf("[#%d] MASTER MODE enabled (failover request from %s)\n", c.id, c.conn.RemoteAddr())
+		srv.promoteToMaster()
+		// the former master reconnects as a replica on its own
+		return fmt.Sprintf("+CONTINUE %s\r\n", srv.config.replid)
 	}
 
-	return
+	if srv.config.role == "slave" && srv.replState != replStateConnected {
+		// our dataset and offset are not those of the master yet
+		return encodeError(codedError{"NOMASTERLINK", "Can't SYNC while not connected with my master"})
+	}
+	if srv.backlog == nil {
+		srv.backlog = newReplicationBacklog(srv.config.replBacklogSize)
+	}
+	c.replica = true
+
+	// the previous replication ID is valid for the history before promotion
+	known := cmd[1] == srv.config.replid || (cmd[1] == srv.config.replid2 && from <= srv.config.secondReplOffset)
+	if err == nil && known {
+		if data, ok := srv.backlog.since(from, srv.config.replOffset); ok {
+			fmt.Printf("[#%d] Partial resynch accepted, sending %d bytes of backlog\n", c.id, len(data))
+			srv.addReplica(c)
+			return fmt.Sprintf("+CONTINUE %s\r\n%s", srv.config.replid, data)
+		}
+	}
+	if srv.config.replDisklessSync && c.capaEOF {
+		// replied to once the sync starts, see sendDisklessResynch
+		srv.queueDisklessSync(c)
+		return ""
+	}
+	srv.addReplica(c)
+	c.resynch = srv.takeSnapshot()
+	return fmt.Sprintf("+FULLRESYNC %s %d\r\n", srv.config.replid, srv.config.replOffset)
+}
+
+func (srv *serverState) handleWait(c *client, cmd []string) string {
+	count, err := strconv.Atoi(cmd[1])
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	timeout, err := strconv.Atoi(cmd[2])
+	if err != nil || timeout < 0 {
+		return encodeError(fmt.Errorf("timeout is not an integer or out of range"))
+	}
+	if srv.config.role != "master" {
+		return encodeError(errors.New("WAIT cannot be used with replica instances."))
+	}
+	return encodeInteger(srv.waitForReplicas(c.writeOffset, count, time.Duration(timeout)*time.Millisecond))
+}
+
+func (srv *serverState) handleKeys(c *client, cmd []string) string {
+	keys := []string{}
+	for _, k := range srv.allKeys() {
+		if !srv.expireIfNeeded(k) && matchPattern(cmd[1], k) {
+			keys = append(keys, k)
+		}
+	}
+	return encodeStringArray(keys)
+}
+
+func (srv *serverState) handleType(c *client, cmd []string) string {
+	key := cmd[1]
+	if srv.expireIfNeeded(key) {
+		return encodeSimpleString("none")
+	}
+	return encodeSimpleString(srv.keyType(key))
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestServer returns a master with an empty keyspace that never touches
+// the disk unless a test asks for it.
+func newTestServer(t *testing.T) *serverState {
+	t.Helper()
+	return newServer(serverConfig{
+		role:            "master",
+		replid:          randReplid(),
+		dbDir:           t.TempDir(),
+		dbFileName:      "dump.rdb",
+		appendFsync:     fsyncEverySec,
+		appendFileName:  "appendonly.aof",
+		replBacklogSize: 1 << 20,
+		replTimeout:     60,
+
+		replPingReplicaPeriod: 10,
+		secondReplOffset:      -1,
+	})
+}
+
+// serveTestServer serves srv on a random port of the loopback interface,
+// which becomes its configured port, until the test ends or kill is called.
+// kill closes the listener and every connection, as if the server died.
+func serveTestServer(t *testing.T, srv *serverState) (port int, kill func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port = listener.Addr().(*net.TCPAddr).Port
+	srv.mu.Lock()
+	srv.config.port = port
+	srv.mu.Unlock()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	killed := false
+	kill = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		killed = true
+		listener.Close()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	go func() {
+		for id := 1; ; id++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if killed {
+				conn.Close()
+			}
+			conns = append(conns, conn)
+			mu.Unlock()
+			go srv.serveClient(id, conn)
+		}
+	}()
+	t.Cleanup(kill)
+	return port, kill
+}
+
+// call runs cmd as client c and returns the decoded reply, nil when it can't
+// be decoded. Tests call it from goroutines of their own too, so it reports
+// with t.Errorf rather than stopping the test.
+func call(t *testing.T, srv *serverState, c *client, cmd ...string) any {
+	t.Helper()
+	reply, err := decodeReply(bufio.NewReader(strings.NewReader(srv.handleCommand(c, cmd))))
+	if err != nil {
+		t.Errorf("%q: decoding the reply: %v", cmd, err)
+		return nil
+	}
+	return reply
+}
+
+// TestConcurrentCommands runs commands from hundreds of clients at once,
+// some of them blocking, and checks that none of the writes got lost. Run it
+// with -race to check that srv.mu serialises every access to the keyspace.
+func TestConcurrentCommands(t *testing.T) {
+	const clients, commands = 200, 50
+	srv := newTestServer(t)
+	admin := &client{id: clients + 1}
+	if reply := call(t, srv, admin, "XGROUP", "CREATE", "jobs", "workers", "$", "MKSTREAM"); reply != "OK" {
+		t.Fatalf("XGROUP CREATE: %v", reply)
+	}
+
+	var wg sync.WaitGroup
+	delivered := make(chan string, clients)
+	for i := range clients {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c := &client{id: i + 1}
+			for j := range commands {
+				key := fmt.Sprintf("key:%d:%d", i, j)
+				call(t, srv, c, "SET", key, key, "PX", "60000")
+				if reply := call(t, srv, c, "GET", key); reply != key {
+					t.Errorf("GET %s = %v", key, reply)
+				}
+				call(t, srv, c, "RPUSH", "list", key)
+				call(t, srv, c, "SADD", "set", key)
+				call(t, srv, c, "HSET", "hash", key, "1")
+				call(t, srv, c, "XADD", "stream", "*", "key", key)
+				call(t, srv, c, "LRANGE", "list", "-3", "-1")
+				call(t, srv, c, "XRANGE", "stream", "-", "+", "COUNT", "3")
+			}
+			call(t, srv, c, "XADD", "jobs", "*", "client", fmt.Sprint(i))
+		}()
+		// every consumer blocks until it gets one job of its own
+		go func() {
+			defer wg.Done()
+			c := &client{id: clients + 2 + i}
+			reply := call(t, srv, c, "XREADGROUP", "GROUP", "workers", fmt.Sprintf("consumer:%d", i),
+				"COUNT", "1", "BLOCK", "0", "STREAMS", "jobs", ">")
+			streams, ok := reply.([]any)
+			if !ok || len(streams) != 1 {
+				t.Errorf("XREADGROUP = %v", reply)
+				return
+			}
+			entries := streams[0].([]any)[1].([]any)
+			if len(entries) != 1 {
+				t.Errorf("XREADGROUP delivered %d entries", len(entries))
+				return
+			}
+			delivered <- entries[0].([]any)[0].(string)
+		}()
+	}
+	wg.Wait()
+	close(delivered)
+
+	// integers, or the number of elements of arrays
+	size := func(reply any) any {
+		if elements, ok := reply.([]any); ok {
+			return len(elements)
+		}
+		return reply
+	}
+	const total = clients * commands
+	for _, check := range []struct {
+		cmd  []string
+		want int
+	}{
+		{[]string{"LLEN", "list"}, total},
+		{[]string{"XLEN", "stream"}, total},
+		{[]string{"XLEN", "jobs"}, clients},
+		{[]string{"SMEMBERS", "set"}, total},
+		{[]string{"HGETALL", "hash"}, 2 * total},
+		{[]string{"KEYS", "key:*"}, total},
+	} {
+		if got := size(call(t, srv, admin, check.cmd...)); got != check.want {
+			t.Errorf("%q = %v, want %d", check.cmd, got, check.want)
+		}
+	}
+
+	seen := map[string]bool{}
+	for id := range delivered {
+		if seen[id] {
+			t.Errorf("job %s delivered twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != clients {
+		t.Errorf("%d jobs delivered, want %d", len(seen), clients)
+	}
+}
+
+// TestCommandTable checks the replies of COMMAND, which render the command
+// table, and the errors for unknown commands and wrong arities.
+func TestCommandTable(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+
+	if reply := call(t, srv, c, "COMMAND", "COUNT"); reply != len(commandTable) {
+		t.Errorf("COMMAND COUNT = %v, want %d", reply, len(commandTable))
+	}
+	all, _ := call(t, srv, c, "COMMAND").([]any)
+	if len(all) != len(commandTable) {
+		t.Errorf("COMMAND lists %d commands, want %d", len(all), len(commandTable))
+	}
+	names, _ := call(t, srv, c, "COMMAND", "LIST").([]any)
+	if len(names) != len(commandTable) || !slices.IsSortedFunc(names, func(a, b any) int { return strings.Compare(a.(string), b.(string)) }) {
+		t.Errorf("COMMAND LIST = %v", names)
+	}
+
+	// name, arity, flags, first key, last key, step
+	get := "[get 2 [readonly fast] 1 1 1]"
+	del := "[del -2 [write] 1 -1 1]"
+	xread := "[xread -4 [readonly blocking movablekeys] 0 0 0]"
+	found := false
+	for _, info := range all {
+		if fmt.Sprint(info) == get {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("COMMAND doesn't list %s", get)
+	}
+	// a null array for an unknown command
+	info := call(t, srv, c, "COMMAND", "INFO", "GET", "del", "nosuch", "xread")
+	if got, want := fmt.Sprint(info), "["+get+" "+del+" <nil> "+xread+"]"; got != want {
+		t.Errorf("COMMAND INFO = %s, want %s", got, want)
+	}
+
+	long := []string{"NOPE"}
+	for range 10 {
+		long = append(long, strings.Repeat("x", 20))
+	}
+	for _, test := range []struct {
+		cmd []string
+		err string
+	}{
+		{[]string{"COMMAND", "NOPE"}, "ERR unknown subcommand 'NOPE'. Try COMMAND HELP."},
+		{[]string{"NOPE"}, "ERR unknown command 'NOPE', with args beginning with: "},
+		{[]string{"nope", "a", "b c"}, "ERR unknown command 'nope', with args beginning with: 'a' 'b c' "},
+		// the preview stops once it is 128 bytes long
+		{long, "ERR unknown command 'NOPE', with args beginning with: " + strings.Repeat("'"+long[1]+"' ", 6)},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"Get", "a", "b"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"SET", "a"}, "ERR wrong number of arguments for 'set' command"},
+		{[]string{"XREADGROUP", "GROUP", "g", "c", "STREAMS", "s"}, "ERR wrong number of arguments for 'xreadgroup' command"},
+	} {
+		if reply, _ := call(t, srv, c, test.cmd...).(error); reply == nil || reply.Error() != test.err {
+			t.Errorf("%q = %v, want %s", test.cmd, reply, test.err)
+		}
+	}
+	for _, cmd := range [][]string{
+		{"ECHO", "a"},
+		{"SET", "a", "b"},
+		{"SET", "a", "b", "PX", "100"},
+		{"DEL", "a", "b", "c"},
+	} {
+		if reply, ok := call(t, srv, c, cmd...).(error); ok {
+			t.Errorf("%q = %v", cmd, reply)
+		}
+	}
+}
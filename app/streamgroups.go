@@ -0,0 +1,900 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A consumer group delivers every entry of a stream to one of its consumers.
+// Entries delivered and not yet acknowledged with XACK stay in the pending
+// entries list (PEL) of the group, and in the one of the consumer they were
+// delivered to, so that they can be read again or handed to another consumer.
+type streamGroup struct {
+	name   string
+	lastID [2]uint64 // the last entry delivered to a consumer
+	// entries read by the group since the stream was created, -1 when
+	// unknown, e.g. after XGROUP SETID to an arbitrary ID
+	entriesRead int
+	pending     map[[2]uint64]*pendingEntry
+	consumers   map[string]*streamConsumer
+}
+
+type pendingEntry struct {
+	id            [2]uint64
+	consumer      *streamConsumer
+	deliveryTime  time.Time
+	deliveryCount int
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   time.Time // last interaction, successful or not
+	activeTime time.Time // last successful read or claim
+	pending    map[[2]uint64]*pendingEntry
+}
+
+func newStreamGroup(name string, lastID [2]uint64, entriesRead int) *streamGroup {
+	return &streamGroup{
+		name:        name,
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     make(map[[2]uint64]*pendingEntry),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+func (group *streamGroup) createConsumer(name string) *streamConsumer {
+	consumer := &streamConsumer{name: name, seenTime: time.Now(), pending: make(map[[2]uint64]*pendingEntry)}
+	group.consumers[name] = consumer
+	return consumer
+}
+
+// deletePending drops id from the PEL of the group and of its consumer.
+func (group *streamGroup) deletePending(id [2]uint64) bool {
+	pending, ok := group.pending[id]
+	if ok {
+		delete(group.pending, id)
+		delete(pending.consumer.pending, id)
+	}
+	return ok
+}
+
+// sortedPendingIDs returns the IDs of a PEL in ascending order.
+func sortedPendingIDs(pel map[[2]uint64]*pendingEntry) [][2]uint64 {
+	ids := make([][2]uint64, 0, len(pel))
+	for id := range pel {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareStreamIDs)
+	return ids
+}
+
+// cloneGroups deep copies the consumer groups, for snapshots.
+func (s *stream) cloneGroups() map[string]*streamGroup {
+	groups := make(map[string]*streamGroup, len(s.groups))
+	for name, group := range s.groups {
+		clone := newStreamGroup(name, group.lastID, group.entriesRead)
+		for consumerName, consumer := range group.consumers {
+			clone.consumers[consumerName] = &streamConsumer{
+				name:       consumerName,
+				seenTime:   consumer.seenTime,
+				activeTime: consumer.activeTime,
+				pending:    make(map[[2]uint64]*pendingEntry, len(consumer.pending)),
+			}
+		}
+		for id, pending := range group.pending {
+			consumer := clone.consumers[pending.consumer.name]
+			copied := *pending
+			copied.consumer = consumer
+			clone.pending[id] = &copied
+			consumer.pending[id] = &copied
+		}
+		groups[name] = clone
+	}
+	return groups
+}
+
+var (
+	errBusyGroup   = codedError{"BUSYGROUP", "Consumer Group name already exists"}
+	errXGroupNoKey = errors.New("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+func errNoGroup(key, group string) error {
+	return codedError{"NOGROUP", fmt.Sprintf("No such consumer group '%s' for key name '%s'", group, key)}
+}
+
+// lookupStream returns the stream at key, nil if there is none, and an
+// error if key holds another type.
+func (srv *serverState) lookupStream(key string) (*stream, error) {
+	if srv.expireIfNeeded(key) {
+		return nil, nil
+	}
+	s, ok := srv.streams[key]
+	if !ok && srv.keyExists(key) {
+		return nil, errWrongType
+	}
+	return s, nil
+}
+
+// lookupStreamGroup returns the group of the stream at key, or the error
+// reply to send when either is missing.
+func (srv *serverState) lookupStreamGroup(key, name string) (*stream, *streamGroup, error) {
+	s, err := srv.lookupStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil || s.groups[name] == nil {
+		return nil, nil, errNoGroup(key, name)
+	}
+	return s, s.groups[name], nil
+}
+
+// parseGroupStartID parses the ID a group starts after, "$" for the last
+// entry, and the ENTRIESREAD option that may follow it.
+func parseGroupStartID(s *stream, id string, options []string) (lastID [2]uint64, entriesRead int, err error) {
+	switch id {
+	case "$":
+		lastID, entriesRead = s.last, s.entriesAdded
+	default:
+		if lastID, err = parseStreamID(id, 0); err != nil {
+			return
+		}
+		entriesRead = -1
+		if lastID == [2]uint64{} {
+			entriesRead = 0
+		}
+	}
+	for i := 0; i < len(options); i++ {
+		if strings.ToUpper(options[i]) != "ENTRIESREAD" || i+1 == len(options) {
+			return lastID, 0, errSyntax
+		}
+		i++
+		n, convErr := strconv.Atoi(options[i])
+		if convErr != nil || n < -1 {
+			return lastID, 0, errors.New("value for ENTRIESREAD must be positive or -1")
+		}
+		entriesRead = n
+	}
+	return
+}
+
+func (srv *serverState) handleStreamGroup(c *client, cmd []string) string {
+	sub := strings.ToUpper(cmd[1])
+	arities := map[string]int{"CREATE": -5, "SETID": -5, "DESTROY": 4, "CREATECONSUMER": 5, "DELCONSUMER": 5}
+	arity, ok := arities[sub]
+	if !ok {
+		return encodeError(fmt.Errorf("unknown subcommand '%s'. Try XGROUP HELP.", cmd[1]))
+	}
+	if arity > 0 && len(cmd) != arity || arity < 0 && len(cmd) < -arity {
+		return encodeError(errWrongArgs("xgroup|" + strings.ToLower(sub)))
+	}
+	key, name := cmd[2], cmd[3]
+
+	if sub == "CREATE" {
+		// MKSTREAM and ENTRIESREAD come in any order
+		var options []string
+		mkstream := false
+		for i := 5; i < len(cmd); i++ {
+			switch strings.ToUpper(cmd[i]) {
+			case "MKSTREAM":
+				mkstream = true
+			case "ENTRIESREAD":
+				if i+1 == len(cmd) {
+					return encodeError(errSyntax)
+				}
+				options = append(options, cmd[i], cmd[i+1])
+				i++
+			default:
+				return encodeError(errSyntax)
+			}
+		}
+		s, err := srv.lookupStream(key)
+		if err != nil {
+			return encodeError(err)
+		}
+		if s == nil && !mkstream {
+			return encodeError(errXGroupNoKey)
+		}
+		if s == nil {
+			s = newStream()
+		}
+		lastID, entriesRead, err := parseGroupStartID(s, cmd[4], options)
+		if err != nil {
+			return encodeError(err)
+		}
+		if s.groups[name] != nil {
+			return encodeError(errBusyGroup)
+		}
+		if srv.streams[key] != s {
+			srv.storeNewStream(key, s)
+		}
+		s.groups[name] = newStreamGroup(name, lastID, entriesRead)
+		srv.dirty++
+		return "+OK\r\n"
+	}
+
+	s, err := srv.lookupStream(key)
+	switch {
+	case err != nil:
+		return encodeError(err)
+	case s == nil:
+		return encodeError(errXGroupNoKey)
+	case sub == "DESTROY" && s.groups[name] == nil:
+		return encodeInteger(0)
+	}
+	s, group, err := srv.lookupStreamGroup(key, name)
+	if err != nil {
+		return encodeError(err)
+	}
+	switch sub {
+	case "SETID":
+		lastID, entriesRead, err := parseGroupStartID(s, cmd[4], cmd[5:])
+		if err != nil {
+			return encodeError(err)
+		}
+		group.lastID, group.entriesRead = lastID, entriesRead
+		srv.dirty++
+		return "+OK\r\n"
+
+	case "DESTROY":
+		delete(s.groups, name)
+		srv.dirty++
+		// its blocked readers get their NOGROUP error
+		srv.wakeStreamWaiters(key)
+		return encodeInteger(1)
+
+	case "CREATECONSUMER":
+		if group.consumers[cmd[4]] != nil {
+			return encodeInteger(0)
+		}
+		group.createConsumer(cmd[4])
+		srv.dirty++
+		return encodeInteger(1)
+
+	default: // DELCONSUMER
+		consumer := group.consumers[cmd[4]]
+		if consumer == nil {
+			return encodeInteger(0)
+		}
+		pending := len(consumer.pending)
+		for id := range consumer.pending {
+			group.deletePending(id)
+		}
+		delete(group.consumers, consumer.name)
+		srv.dirty++
+		return encodeInteger(pending)
+	}
+}
+
+type readGroupArgs struct {
+	group    string
+	consumer string
+	count    int
+	block    int // milliseconds, -1 when not blocking, 0 forever
+	noack    bool
+	keys     []string
+	ids      []string
+}
+
+// parseReadGroupArgs parses XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK milliseconds] [NOACK] STREAMS key... id...
+func parseReadGroupArgs(cmd []string) (args readGroupArgs, err error) {
+	if strings.ToUpper(cmd[1]) != "GROUP" {
+		return args, errors.New("Missing GROUP option for XREADGROUP")
+	}
+	args.group, args.consumer, args.block = cmd[2], cmd[3], -1
+	for i := 4; i < len(cmd); i++ {
+		switch option := strings.ToUpper(cmd[i]); option {
+		case "COUNT", "BLOCK":
+			if i+1 == len(cmd) {
+				return args, errSyntax
+			}
+			i++
+			n, convErr := strconv.Atoi(cmd[i])
+			if convErr != nil {
+				return args, errNotInteger
+			}
+			if option == "COUNT" {
+				args.count = max(n, 0)
+			} else if n < 0 {
+				return args, errors.New("timeout is negative")
+			} else {
+				args.block = n
+			}
+		case "NOACK":
+			args.noack = true
+		case "STREAMS":
+			streams := cmd[i+1:]
+			if len(streams) == 0 || len(streams)%2 != 0 {
+				return args, errors.New("Unbalanced 'xreadgroup' list of streams: for each stream key an ID or '>' must be specified.")
+			}
+			args.keys, args.ids = streams[:len(streams)/2], streams[len(streams)/2:]
+			return args, nil
+		default:
+			return args, errSyntax
+		}
+	}
+	return args, errSyntax
+}
+
+// handleStreamReadGroup propagates what it did itself: it may block, and
+// writes of other clients meanwhile would make a call that read nothing look
+// like a write to handleCommand. As in Redis, every delivery is propagated
+// as an XCLAIM and the new position of the group as an XGROUP SETID, so that
+// replicas and the AOF end up with the same PEL whatever they hold.
+func (srv *serverState) handleStreamReadGroup(c *client, cmd []string) string {
+	args, err := parseReadGroupArgs(cmd)
+	if err != nil {
+		return encodeError(err)
+	}
+	startIDs := make([][2]uint64, len(args.ids))
+	for i, id := range args.ids {
+		if id == ">" {
+			continue
+		}
+		if startIDs[i], err = parseStreamID(id, 0); err != nil {
+			return encodeError(err)
+		}
+	}
+
+	var deadline <-chan time.Time
+	if args.block > 0 {
+		deadline = time.After(time.Duration(args.block) * time.Millisecond)
+	}
+	for {
+		streams := make([]*stream, len(args.keys))
+		for i, key := range args.keys {
+			s, err := srv.lookupStream(key)
+			if err != nil {
+				return encodeError(err)
+			}
+			if s == nil || s.groups[args.group] == nil {
+				return encodeError(codedError{"NOGROUP", fmt.Sprintf("No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, args.group)})
+			}
+			streams[i] = s
+		}
+
+		var replies []string
+		for i, s := range streams {
+			group := s.groups[args.group]
+			consumer := group.consumers[args.consumer]
+			if consumer == nil {
+				consumer = group.createConsumer(args.consumer)
+				srv.dirty++
+				srv.propagate([]string{"XGROUP", "CREATECONSUMER", args.keys[i], args.group, args.consumer})
+			}
+			now := time.Now()
+			consumer.seenTime = now
+
+			var entries []string
+			if args.ids[i] == ">" {
+				delivered := s.entriesAfter(group.lastID, args.count)
+				if len(delivered) == 0 {
+					continue
+				}
+				for _, entry := range delivered {
+					group.lastID = entry.id
+					if !args.noack {
+						// a new delivery of an entry still pending elsewhere
+						// moves it to this consumer
+						group.deletePending(entry.id)
+						pending := &pendingEntry{id: entry.id, consumer: consumer, deliveryTime: now, deliveryCount: 1}
+						group.pending[entry.id] = pending
+						consumer.pending[entry.id] = pending
+						srv.propagateClaim(args.keys[i], group, pending)
+					}
+					entries = append(entries, encodeStreamEntry(entry))
+				}
+				if group.entriesRead >= 0 {
+					group.entriesRead += len(delivered)
+				}
+				if group.lastID == s.last {
+					group.entriesRead = s.entriesAdded
+				}
+				consumer.activeTime = now
+				srv.dirty++
+				srv.propagate([]string{"XGROUP", "SETID", args.keys[i], args.group, formatStreamID(group.lastID),
+					"ENTRIESREAD", strconv.Itoa(group.entriesRead)})
+			} else {
+				// the history of the consumer: its pending entries after the ID
+				for _, id := range sortedPendingIDs(consumer.pending) {
+					if compareStreamIDs(id, startIDs[i]) <= 0 {
+						continue
+					}
+					if args.count > 0 && len(entries) == args.count {
+						break
+					}
+					pending := consumer.pending[id]
+					pending.deliveryTime = now
+					pending.deliveryCount++
+					if entry := s.lookupEntry(id); entry != nil {
+						entries = append(entries, encodeStreamEntry(entry))
+						srv.propagateClaim(args.keys[i], group, pending)
+					} else {
+						// deleted since it was delivered; an XCLAIM would
+						// drop it, the new delivery count is not worth that
+						entries = append(entries, encodeArray([]string{encodeBulkString(formatStreamID(id)), encodeNullArray()}))
+					}
+				}
+				if len(entries) > 0 {
+					srv.dirty++
+				}
+			}
+			replies = append(replies, encodeArray([]string{encodeBulkString(args.keys[i]), encodeArray(entries)}))
+		}
+
+		if len(replies) > 0 {
+			return encodeArray(replies)
+		}
+		if args.block < 0 {
+			return encodeNullArray()
+		}
+
+		// wait for an entry to be added to any of the streams
+		wakeup := make(chan bool, 1)
+		srv.addStreamWaiter(args.keys, wakeup)
+		srv.mu.Unlock()
+		timedOut := false
+		select {
+		case <-wakeup:
+		case <-deadline:
+			timedOut = true
+		}
+		srv.mu.Lock()
+		srv.removeStreamWaiter(args.keys, wakeup)
+		if timedOut {
+			return encodeNullArray()
+		}
+	}
+}
+
+func (srv *serverState) handleStreamAck(c *client, cmd []string) string {
+	ids := make([][2]uint64, len(cmd)-3)
+	for i, id := range cmd[3:] {
+		var err error
+		if ids[i], err = parseStreamID(id, 0); err != nil {
+			return encodeError(err)
+		}
+	}
+	_, group, err := srv.lookupStreamGroup(cmd[1], cmd[2])
+	if err != nil {
+		if errors.Is(err, errWrongType) {
+			return encodeError(err)
+		}
+		return encodeInteger(0)
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if group.deletePending(id) {
+			acked++
+		}
+	}
+	srv.dirty += acked
+	return encodeInteger(acked)
+}
+
+// parseStreamRangeID parses the bound of a range: "-" and "+" for the lowest
+// and highest IDs, and a "(" prefix for an exclusive bound. missingSeq is the
+// sequence number of an ID given without one.
+func parseStreamRangeID(id string, missingSeq uint64) ([2]uint64, error) {
+	switch id {
+	case "-":
+		return [2]uint64{}, nil
+	case "+":
+		return [2]uint64{math.MaxUint64, math.MaxUint64}, nil
+	}
+	exclusive := strings.HasPrefix(id, "(")
+	parsed, err := parseStreamID(strings.TrimPrefix(id, "("), missingSeq)
+	if err != nil || !exclusive {
+		return parsed, err
+	}
+	// the closest inclusive bound
+	switch {
+	case missingSeq == 0 && parsed[1] < math.MaxUint64:
+		parsed[1]++
+	case missingSeq == 0 && parsed[0] < math.MaxUint64:
+		parsed = [2]uint64{parsed[0] + 1, 0}
+	case missingSeq != 0 && parsed[1] > 0:
+		parsed[1]--
+	case missingSeq != 0 && parsed[0] > 0:
+		parsed = [2]uint64{parsed[0] - 1, math.MaxUint64}
+	case missingSeq == 0:
+		return parsed, errors.New("invalid start ID for the interval")
+	default:
+		return parsed, errors.New("invalid end ID for the interval")
+	}
+	return parsed, nil
+}
+
+// handleStreamPending implements XPENDING key group, summing up the PEL,
+// and XPENDING key group [IDLE min-idle-time] start end count [consumer],
+// listing its entries.
+func (srv *serverState) handleStreamPending(c *client, cmd []string) string {
+	key, name := cmd[1], cmd[2]
+	args := cmd[3:]
+	var minIdle time.Duration
+	if len(args) > 0 && strings.ToUpper(args[0]) == "IDLE" {
+		if len(args) < 2 {
+			return encodeError(errSyntax)
+		}
+		ms, err := strconv.Atoi(args[1])
+		if err != nil {
+			return encodeError(errNotInteger)
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		args = args[2:]
+		if len(args) == 0 {
+			return encodeError(errSyntax)
+		}
+	}
+	if len(args) != 0 && len(args) != 3 && len(args) != 4 {
+		return encodeError(errSyntax)
+	}
+
+	_, group, err := srv.lookupStreamGroup(key, name)
+	if err != nil {
+		return encodeError(err)
+	}
+
+	if len(args) == 0 {
+		if len(group.pending) == 0 {
+			return encodeArray([]string{encodeInteger(0), encodeNullBulkString(), encodeNullBulkString(), encodeNullArray()})
+		}
+		ids := sortedPendingIDs(group.pending)
+		var consumers []string
+		for _, consumerName := range sortedKeys(group.consumers) {
+			if pending := len(group.consumers[consumerName].pending); pending > 0 {
+				consumers = append(consumers, encodeStringArray([]string{consumerName, strconv.Itoa(pending)}))
+			}
+		}
+		return encodeArray([]string{
+			encodeInteger(len(ids)),
+			encodeBulkString(formatStreamID(ids[0])),
+			encodeBulkString(formatStreamID(ids[len(ids)-1])),
+			encodeArray(consumers),
+		})
+	}
+
+	start, err := parseStreamRangeID(args[0], 0)
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseStreamRangeID(args[1], math.MaxUint64)
+	if err != nil {
+		return encodeError(err)
+	}
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		return encodeError(errNotInteger)
+	}
+	pel := group.pending
+	if len(args) == 4 {
+		consumer := group.consumers[args[3]]
+		if consumer == nil {
+			return encodeArray(nil)
+		}
+		pel = consumer.pending
+	}
+
+	now := time.Now()
+	var entries []string
+	for _, id := range sortedPendingIDs(pel) {
+		if len(entries) >= count {
+			break
+		}
+		if compareStreamIDs(id, start) < 0 || compareStreamIDs(id, end) > 0 {
+			continue
+		}
+		pending := pel[id]
+		idle := now.Sub(pending.deliveryTime)
+		if idle < minIdle {
+			continue
+		}
+		entries = append(entries, encodeArray([]string{
+			encodeBulkString(formatStreamID(id)),
+			encodeBulkString(pending.consumer.name),
+			encodeInteger(int(idle.Milliseconds())),
+			encodeInteger(pending.deliveryCount),
+		}))
+	}
+	return encodeArray(entries)
+}
+
+// deadLetterKey names the stream that entries of key are moved to once they
+// were delivered too many times, in the same hash slot as key.
+func deadLetterKey(key string) string {
+	if name := key + ":dead-letter"; keyHashSlot(name) == keyHashSlot(key) {
+		return name
+	}
+	return "{" + key + "}:dead-letter"
+}
+
+// deadLetter acknowledges a pending entry and appends it to the dead-letter
+// stream of key, with where it came from and how many times it was
+// delivered. It reports false, leaving the entry pending, if the dead-letter
+// key holds another type. Called with srv.mu held.
+func (srv *serverState) deadLetter(key string, s *stream, group *streamGroup, pending *pendingEntry) bool {
+	dlKey := deadLetterKey(key)
+	dl, err := srv.lookupStream(dlKey)
+	if err != nil {
+		fmt.Printf("Can't dead-letter entry %s of stream %s: %v\n", formatStreamID(pending.id), key, err)
+		return false
+	}
+	created := dl == nil
+	if created {
+		dl = newStream()
+	}
+	entry, err := dl.addStreamEntry("*")
+	if err != nil {
+		fmt.Printf("Can't dead-letter entry %s of stream %s: %v\n", formatStreamID(pending.id), key, err)
+		return false
+	}
+	if created {
+		srv.storeNewStream(dlKey, dl)
+	}
+	entry.store = append(entry.store, "stream", key, "group", group.name, "consumer", pending.consumer.name,
+		"id", formatStreamID(pending.id), "deliveries", strconv.Itoa(pending.deliveryCount))
+	if original := s.lookupEntry(pending.id); original != nil {
+		entry.store = append(entry.store, original.store...)
+	}
+	srv.wakeStreamWaiters(dlKey)
+	group.deletePending(pending.id)
+	srv.dirty += 2
+	srv.propagate(append([]string{"XADD", dlKey, formatStreamID(entry.id)}, entry.store...))
+	srv.propagate([]string{"XACK", key, group.name, formatStreamID(pending.id)})
+	return true
+}
+
+// claimPending gives entry id to consumer, creating its pending entry if
+// there is none (XCLAIM FORCE). retryCount sets the delivery counter, which
+// is otherwise incremented unless justID is set. An entry claimed without
+// retryCount after stream-max-deliveries deliveries goes to the dead-letter
+// stream instead. Reports whether the entry was claimed. Called with srv.mu
+// held; the outcome is propagated as an XCLAIM setting everything
+// explicitly, as Redis does.
+func (srv *serverState) claimPending(key string, s *stream, group *streamGroup, id [2]uint64, consumer *streamConsumer,
+	deliveryTime time.Time, retryCount int, justID bool) bool {
+	pending := group.pending[id]
+	maxDeliveries := srv.config.streamMaxDeliveries
+	if pending != nil && retryCount < 0 && maxDeliveries > 0 && pending.deliveryCount >= maxDeliveries {
+		if srv.deadLetter(key, s, group, pending) {
+			return false
+		}
+	}
+
+	if pending == nil {
+		pending = &pendingEntry{id: id}
+		group.pending[id] = pending
+	} else {
+		delete(pending.consumer.pending, id)
+	}
+	pending.consumer = consumer
+	consumer.pending[id] = pending
+	pending.deliveryTime = deliveryTime
+	switch {
+	case retryCount >= 0:
+		pending.deliveryCount = retryCount
+	case !justID:
+		pending.deliveryCount++
+	}
+	consumer.activeTime = time.Now()
+	srv.dirty++
+	srv.propagateClaim(key, group, pending)
+	return true
+}
+
+// propagateClaim propagates the state of a pending entry as an XCLAIM that
+// sets everything explicitly. Called with srv.mu held.
+func (srv *serverState) propagateClaim(key string, group *streamGroup, pending *pendingEntry) {
+	srv.propagate([]string{"XCLAIM", key, group.name, pending.consumer.name, "0", formatStreamID(pending.id),
+		"TIME", strconv.FormatInt(pending.deliveryTime.UnixMilli(), 10), "RETRYCOUNT", strconv.Itoa(pending.deliveryCount),
+		"FORCE", "JUSTID", "LASTID", formatStreamID(group.lastID)})
+}
+
+// claimingConsumer returns the consumer claiming entries, creating it if
+// needed. Called with srv.mu held.
+func (srv *serverState) claimingConsumer(key string, group *streamGroup, name string) *streamConsumer {
+	consumer := group.consumers[name]
+	if consumer == nil {
+		consumer = group.createConsumer(name)
+		srv.dirty++
+		srv.propagate([]string{"XGROUP", "CREATECONSUMER", key, group.name, name})
+	}
+	consumer.seenTime = time.Now()
+	return consumer
+}
+
+// dropDeletedPending forgets a pending entry deleted from the stream since
+// it was delivered. Called with srv.mu held.
+func (srv *serverState) dropDeletedPending(key string, group *streamGroup, id [2]uint64) {
+	group.deletePending(id)
+	srv.dirty++
+	srv.propagate([]string{"XACK", key, group.name, formatStreamID(id)})
+}
+
+func parseMinIdleTime(value, command string) (time.Duration, error) {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid min-idle-time argument for %s", command)
+	}
+	return time.Duration(max(ms, 0)) * time.Millisecond, nil
+}
+
+// handleStreamClaim implements XCLAIM key group consumer min-idle-time id...
+// [IDLE ms] [TIME unix-ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id].
+func (srv *serverState) handleStreamClaim(c *client, cmd []string) string {
+	key, groupName, consumerName := cmd[1], cmd[2], cmd[3]
+	minIdle, err := parseMinIdleTime(cmd[4], "XCLAIM")
+	if err != nil {
+		return encodeError(err)
+	}
+
+	var ids [][2]uint64
+	i := 5
+	for ; i < len(cmd); i++ {
+		id, err := parseStreamID(cmd[i], 0)
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return encodeError(errInvalidStreamID)
+	}
+	now := time.Now()
+	deliveryTime, retryCount := now, -1
+	force, justID := false, false
+	var lastID *[2]uint64
+	for ; i < len(cmd); i++ {
+		switch option := strings.ToUpper(cmd[i]); option {
+		case "FORCE":
+			force = true
+		case "JUSTID":
+			justID = true
+		case "IDLE", "TIME", "RETRYCOUNT", "LASTID":
+			if i+1 == len(cmd) {
+				return encodeError(errSyntax)
+			}
+			i++
+			if option == "LASTID" {
+				id, err := parseStreamID(cmd[i], 0)
+				if err != nil {
+					return encodeError(err)
+				}
+				lastID = &id
+				continue
+			}
+			n, err := strconv.ParseInt(cmd[i], 10, 64)
+			if err != nil || n < 0 {
+				return encodeError(fmt.Errorf("Invalid %s option argument for XCLAIM", option))
+			}
+			switch option {
+			case "IDLE":
+				deliveryTime = now.Add(-time.Duration(n) * time.Millisecond)
+			case "TIME":
+				deliveryTime = time.UnixMilli(n)
+			default:
+				retryCount = int(n)
+			}
+		default:
+			return encodeError(fmt.Errorf("Unrecognized XCLAIM option '%s'", cmd[i]))
+		}
+	}
+	if deliveryTime.After(now) {
+		deliveryTime = now
+	}
+
+	s, group, err := srv.lookupStreamGroup(key, groupName)
+	if err != nil {
+		return encodeError(err)
+	}
+	if lastID != nil && compareStreamIDs(*lastID, group.lastID) > 0 {
+		group.lastID = *lastID
+		srv.dirty++
+		srv.propagate([]string{"XGROUP", "SETID", key, groupName, formatStreamID(group.lastID), "ENTRIESREAD", strconv.Itoa(group.entriesRead)})
+	}
+	consumer := srv.claimingConsumer(key, group, consumerName)
+
+	var claimed []string
+	for _, id := range ids {
+		pending := group.pending[id]
+		entry := s.lookupEntry(id)
+		switch {
+		case pending == nil && (!force || entry == nil):
+			continue
+		case pending != nil && entry == nil:
+			srv.dropDeletedPending(key, group, id)
+			continue
+		case pending != nil && now.Sub(pending.deliveryTime) < minIdle:
+			continue
+		}
+		if !srv.claimPending(key, s, group, id, consumer, deliveryTime, retryCount, justID) {
+			continue
+		}
+		if justID {
+			claimed = append(claimed, encodeBulkString(formatStreamID(id)))
+		} else {
+			claimed = append(claimed, encodeStreamEntry(entry))
+		}
+	}
+	return encodeArray(claimed)
+}
+
+// handleStreamAutoClaim implements XAUTOCLAIM key group consumer
+// min-idle-time start [COUNT count] [JUSTID]: it claims up to count entries
+// idle for long enough, scanning the PEL from start, and returns the ID to
+// continue the scan from (0-0 once done), the claimed entries and the IDs of
+// the pending entries deleted from the stream, which are dropped.
+func (srv *serverState) handleStreamAutoClaim(c *client, cmd []string) string {
+	key, groupName, consumerName := cmd[1], cmd[2], cmd[3]
+	minIdle, err := parseMinIdleTime(cmd[4], "XAUTOCLAIM")
+	if err != nil {
+		return encodeError(err)
+	}
+	start, err := parseStreamRangeID(cmd[5], 0)
+	if err != nil {
+		return encodeError(err)
+	}
+	count, justID := 100, false
+	for i := 6; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "JUSTID":
+			justID = true
+		case "COUNT":
+			if i+1 == len(cmd) {
+				return encodeError(errSyntax)
+			}
+			i++
+			n, err := strconv.Atoi(cmd[i])
+			if err != nil || n < 1 || n > math.MaxInt/10 {
+				return encodeError(errors.New("COUNT must be > 0"))
+			}
+			count = n
+		default:
+			return encodeError(errSyntax)
+		}
+	}
+
+	s, group, err := srv.lookupStreamGroup(key, groupName)
+	if err != nil {
+		return encodeError(err)
+	}
+	consumer := srv.claimingConsumer(key, group, consumerName)
+
+	now := time.Now()
+	ids := sortedPendingIDs(group.pending)
+	i, _ := slices.BinarySearchFunc(ids, start, compareStreamIDs)
+	claimed, deleted := []string{}, []string{}
+	for attempts := 10 * count; i < len(ids) && attempts > 0 && len(claimed) < count; i, attempts = i+1, attempts-1 {
+		id := ids[i]
+		entry := s.lookupEntry(id)
+		if entry == nil {
+			srv.dropDeletedPending(key, group, id)
+			deleted = append(deleted, formatStreamID(id))
+			continue
+		}
+		if now.Sub(group.pending[id].deliveryTime) < minIdle {
+			continue
+		}
+		if !srv.claimPending(key, s, group, id, consumer, now, -1, justID) {
+			continue
+		}
+		if justID {
+			claimed = append(claimed, encodeBulkString(formatStreamID(id)))
+		} else {
+			claimed = append(claimed, encodeStreamEntry(entry))
+		}
+	}
+
+	next := [2]uint64{}
+	if i < len(ids) {
+		next = ids[i]
+	}
+	return encodeArray([]string{encodeBulkString(formatStreamID(next)), encodeArray(claimed), encodeStringArray(deleted)})
+}
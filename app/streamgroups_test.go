@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pel describes the pending entries of a group as "id:consumer:deliveries",
+// in ID order, "" when there is no such group.
+func pel(t *testing.T, srv *serverState, key, name string) string {
+	t.Helper()
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	s := srv.streams[key]
+	if s == nil || s.groups[name] == nil {
+		return ""
+	}
+	group := s.groups[name]
+	var entries []string
+	for _, id := range sortedPendingIDs(group.pending) {
+		pending := group.pending[id]
+		if pending.consumer.pending[id] != pending {
+			t.Errorf("entry %s is missing from the PEL of %s", formatStreamID(id), pending.consumer.name)
+		}
+		entries = append(entries, fmt.Sprintf("%s:%s:%d", formatStreamID(id), pending.consumer.name, pending.deliveryCount))
+	}
+	return strings.Join(entries, " ")
+}
+
+// entryIDs returns the IDs of the entries of an XRANGE or XCLAIM reply, or
+// the IDs themselves of a JUSTID reply.
+func entryIDs(reply any) string {
+	var ids []string
+	entries, _ := reply.([]any)
+	for _, entry := range entries {
+		if fields, ok := entry.([]any); ok {
+			entry = fields[0]
+		}
+		ids = append(ids, fmt.Sprint(entry))
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestStreamGroupCreate(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, cmd := range [][]string{
+		{"XGROUP", "CREATE", "s1", "g", "$", "MKSTREAM", "ENTRIESREAD", "3"},
+		{"XGROUP", "CREATE", "s2", "g", "$", "ENTRIESREAD", "3", "MKSTREAM"},
+	} {
+		if reply := call(t, srv, c, cmd...); reply != "OK" {
+			t.Errorf("%q = %v", cmd, reply)
+		}
+	}
+	for _, key := range []string{"s1", "s2"} {
+		if group := srv.streams[key].groups["g"]; group == nil || group.entriesRead != 3 {
+			t.Errorf("group g of %s = %+v, want 3 entries read", key, group)
+		}
+	}
+
+	for _, check := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XGROUP", "CREATE", "s1", "g", "$"}, "BUSYGROUP"},
+		{[]string{"XGROUP", "CREATE", "s3", "g", "$", "MKSTREAM", "ENTRIESREAD"}, "ERR syntax error"},
+		{[]string{"XGROUP", "CREATE", "s3", "g", "$", "NOSUCHOPTION"}, "ERR syntax error"},
+		{[]string{"XGROUP", "CREATE", "missing", "g", "$"}, "ERR The XGROUP subcommand requires the key to exist"},
+		{[]string{"XGROUP", "DESTROY", "missing", "g"}, "ERR The XGROUP subcommand requires the key to exist"},
+		{[]string{"XGROUP", "SETID", "missing", "g", "$"}, "ERR The XGROUP subcommand requires the key to exist"},
+		{[]string{"XGROUP", "CREATECONSUMER", "s1", "nosuchgroup", "alice"}, "NOGROUP"},
+	} {
+		if reply, _ := call(t, srv, c, check.cmd...).(error); reply == nil || !strings.HasPrefix(reply.Error(), check.want) {
+			t.Errorf("%q = %v, want %s", check.cmd, reply, check.want)
+		}
+	}
+	if reply := call(t, srv, c, "XGROUP", "DESTROY", "s1", "nosuchgroup"); reply != 0 {
+		t.Errorf("XGROUP DESTROY of a missing group = %v", reply)
+	}
+	if reply := call(t, srv, c, "XGROUP", "DESTROY", "s1", "g"); reply != 1 {
+		t.Errorf("XGROUP DESTROY = %v", reply)
+	}
+}
+
+// TestStreamGroupPEL follows entries through the PEL of a group: delivered,
+// read again from the history of the consumer, acknowledged.
+func TestStreamGroupPEL(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, id := range []string{"1-1", "1-2", "1-3"} {
+		call(t, srv, c, "XADD", "s", id, "f", id)
+	}
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+
+	read := func(consumer string, options ...string) any {
+		cmd := append([]string{"XREADGROUP", "GROUP", "g", consumer}, options...)
+		return call(t, srv, c, cmd...)
+	}
+	streamIDs := func(reply any) string {
+		streams, ok := reply.([]any)
+		if !ok || len(streams) != 1 {
+			return fmt.Sprint(reply)
+		}
+		return entryIDs(streams[0].([]any)[1])
+	}
+
+	if got := streamIDs(read("alice", "COUNT", "2", "STREAMS", "s", ">")); got != "1-1 1-2" {
+		t.Errorf("alice read %s", got)
+	}
+	if got := streamIDs(read("bob", "STREAMS", "s", ">")); got != "1-3" {
+		t.Errorf("bob read %s", got)
+	}
+	if got := read("bob", "STREAMS", "s", ">"); got != nil {
+		t.Errorf("bob read %v once the stream was consumed", got)
+	}
+	if got := pel(t, srv, "s", "g"); got != "1-1:alice:1 1-2:alice:1 1-3:bob:1" {
+		t.Errorf("PEL after reading = %s", got)
+	}
+
+	// the history of alice after 1-1, a delivery more for 1-2
+	if got := streamIDs(read("alice", "STREAMS", "s", "1-1")); got != "1-2" {
+		t.Errorf("alice read %s from her history", got)
+	}
+	if reply := call(t, srv, c, "XACK", "s", "g", "1-1", "1-3", "9-9"); reply != 2 {
+		t.Errorf("XACK = %v", reply)
+	}
+	if got := pel(t, srv, "s", "g"); got != "1-2:alice:2" {
+		t.Errorf("PEL after XACK = %s", got)
+	}
+	summary := call(t, srv, c, "XPENDING", "s", "g").([]any)
+	if summary[0] != 1 || summary[1] != "1-2" || summary[2] != "1-2" || fmtReply(summary[3]) != "alice 1 " {
+		t.Errorf("XPENDING = %v", summary)
+	}
+
+	// NOACK delivers without adding to the PEL
+	call(t, srv, c, "XADD", "s", "1-4", "f", "1-4")
+	if got := streamIDs(read("carol", "NOACK", "STREAMS", "s", ">")); got != "1-4" {
+		t.Errorf("carol read %s", got)
+	}
+	if got := pel(t, srv, "s", "g"); got != "1-2:alice:2" {
+		t.Errorf("PEL after a NOACK read = %s", got)
+	}
+	if reply := call(t, srv, c, "XGROUP", "DELCONSUMER", "s", "g", "alice"); reply != 1 {
+		t.Errorf("XGROUP DELCONSUMER = %v", reply)
+	}
+	if got := pel(t, srv, "s", "g"); got != "" {
+		t.Errorf("PEL after deleting its consumer = %s", got)
+	}
+}
+
+func TestStreamClaim(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, id := range []string{"1-1", "1-2", "1-3", "1-4"} {
+		call(t, srv, c, "XADD", "s", id, "f", id)
+	}
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+
+	// not idle for long enough
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "bob", "60000", "1-1")); got != "" {
+		t.Errorf("XCLAIM of an entry just delivered claimed %s", got)
+	}
+	// IDLE backdates the new delivery
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "bob", "0", "1-1", "1-2", "IDLE", "120000")); got != "1-1 1-2" {
+		t.Errorf("XCLAIM IDLE claimed %s", got)
+	}
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "carol", "60000", "1-2", "1-3")); got != "1-2" {
+		t.Errorf("XCLAIM of entries idle for a minute claimed %s", got)
+	}
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "bob", "0", "1-3", "RETRYCOUNT", "7", "JUSTID")); got != "1-3" {
+		t.Errorf("XCLAIM JUSTID claimed %s", got)
+	}
+	if got := pel(t, srv, "s", "g"); got != "1-1:bob:2 1-2:carol:3 1-3:bob:7 1-4:alice:1" {
+		t.Errorf("PEL after XCLAIM = %s", got)
+	}
+
+	// an entry deleted while pending is dropped from the PEL
+	call(t, srv, c, "XDEL", "s", "1-2")
+	reply := call(t, srv, c, "XAUTOCLAIM", "s", "g", "carol", "0", "0", "COUNT", "2").([]any)
+	if reply[0] != "1-4" || entryIDs(reply[1]) != "1-1 1-3" || fmtReply(reply[2]) != "1-2 " {
+		t.Errorf("XAUTOCLAIM = %v", reply)
+	}
+	reply = call(t, srv, c, "XAUTOCLAIM", "s", "g", "carol", "0", reply[0].(string), "JUSTID").([]any)
+	if reply[0] != "0-0" || entryIDs(reply[1]) != "1-4" {
+		t.Errorf("XAUTOCLAIM from 1-4 = %v", reply)
+	}
+	// JUSTID doesn't count as a delivery
+	if got := pel(t, srv, "s", "g"); got != "1-1:carol:3 1-3:carol:8 1-4:carol:1" {
+		t.Errorf("PEL after XAUTOCLAIM = %s", got)
+	}
+}
+
+// TestStreamDeadLetter checks that an entry claimed after
+// stream-max-deliveries deliveries goes to the dead-letter stream.
+func TestStreamDeadLetter(t *testing.T) {
+	srv := newTestServer(t)
+	srv.config.streamMaxDeliveries = 2
+	c := &client{id: 1}
+	call(t, srv, c, "XADD", "s", "1-1", "f", "v")
+	call(t, srv, c, "XADD", "s", "1-2", "f", "w")
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+
+	// the second delivery
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "bob", "0", "1-1")); got != "1-1" {
+		t.Errorf("XCLAIM claimed %s", got)
+	}
+	reply := call(t, srv, c, "XAUTOCLAIM", "s", "g", "carol", "0", "0").([]any)
+	if got := entryIDs(reply[1]); got != "1-2" {
+		t.Errorf("XAUTOCLAIM claimed %s, want 1-1 dead-lettered", got)
+	}
+	if got := pel(t, srv, "s", "g"); got != "1-2:carol:2" {
+		t.Errorf("PEL after dead-lettering = %s", got)
+	}
+
+	entries := call(t, srv, c, "XRANGE", deadLetterKey("s"), "-", "+").([]any)
+	if len(entries) != 1 {
+		t.Fatalf("dead-letter stream = %v", entries)
+	}
+	want := "stream s group g consumer bob id 1-1 deliveries 2 f v "
+	if got := fmtReply(entries[0].([]any)[1]); got != want {
+		t.Errorf("dead-lettered entry = %q, want %q", got, want)
+	}
+	// an explicit RETRYCOUNT still claims it
+	if got := entryIDs(call(t, srv, c, "XCLAIM", "s", "g", "bob", "0", "1-2", "RETRYCOUNT", "5")); got != "1-2" {
+		t.Errorf("XCLAIM RETRYCOUNT claimed %s", got)
+	}
+}
+
+// TestStreamReadGroupPropagation replays on a second server what a master
+// propagated while consumers read, claimed and acknowledged entries, and
+// checks that the groups end up the same on both.
+func TestStreamReadGroupPropagation(t *testing.T) {
+	master := newTestServer(t)
+	master.backlog = newReplicationBacklog(master.config.replBacklogSize)
+	master.config.streamMaxDeliveries = 3
+	c := &client{id: 1}
+	for _, cmd := range [][]string{
+		{"XADD", "s", "1-1", "f", "a"},
+		{"XADD", "s", "1-2", "f", "b"},
+		{"XADD", "s", "1-3", "f", "c"},
+		{"XGROUP", "CREATE", "s", "g", "0"},
+		{"XGROUP", "CREATE", "s", "other", "$"},
+		{"XREADGROUP", "GROUP", "g", "alice", "COUNT", "1", "STREAMS", "s", ">"},
+		{"XREADGROUP", "GROUP", "g", "bob", "NOACK", "COUNT", "1", "STREAMS", "s", ">"},
+		{"XREADGROUP", "GROUP", "g", "carol", "BLOCK", "100", "STREAMS", "s", ">"},
+		{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0"},
+		{"XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", "0"},
+		{"XCLAIM", "s", "g", "dave", "0", "1-3"},
+		{"XAUTOCLAIM", "s", "g", "erin", "0", "0"},
+		{"XADD", "s", "1-4", "f", "d"},
+		{"XREADGROUP", "GROUP", "other", "alice", "STREAMS", "s", ">"},
+	} {
+		if reply, ok := call(t, master, c, cmd...).(error); ok {
+			t.Fatalf("%q: %v", cmd, reply)
+		}
+	}
+
+	replica := newTestServer(t)
+	master.mu.Lock()
+	stream := master.backlog.tail(master.config.replOffset)
+	master.mu.Unlock()
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	fromMaster := &client{master: true}
+	for {
+		cmd, _, err := decodeStringArray(reader)
+		if err != nil {
+			break
+		}
+		if strings.EqualFold(cmd[0], "XREADGROUP") {
+			t.Errorf("propagated %q", cmd)
+		}
+		replica.handleCommand(fromMaster, cmd)
+	}
+
+	if got := pel(t, master, "s", "g"); got != "1-3:erin:3" {
+		t.Errorf("PEL on the master = %s", got)
+	}
+	for _, key := range []string{"s", deadLetterKey("s")} {
+		for _, name := range []string{"g", "other"} {
+			if got, want := pel(t, replica, key, name), pel(t, master, key, name); got != want {
+				t.Errorf("PEL of group %s of %s on the replica = %s, want %s", name, key, got, want)
+			}
+		}
+		if got, want := call(t, replica, c, "XRANGE", key, "-", "+"), call(t, master, c, "XRANGE", key, "-", "+"); fmtReply(got) != fmtReply(want) {
+			t.Errorf("XRANGE %s on the replica = %v, want %v", key, got, want)
+		}
+	}
+	for _, name := range []string{"g", "other"} {
+		got, want := replica.streams["s"].groups[name], master.streams["s"].groups[name]
+		if got == nil || got.lastID != want.lastID || got.entriesRead != want.entriesRead {
+			t.Errorf("group %s on the replica = %+v, want last ID %v and %d entries read", name, got, want.lastID, want.entriesRead)
+			continue
+		}
+		for id, pending := range want.pending {
+			if !got.pending[id].deliveryTime.Equal(pending.deliveryTime.Truncate(time.Millisecond)) {
+				t.Errorf("entry %s of group %s delivered at %v on the replica, want %v", formatStreamID(id), name,
+					got.pending[id].deliveryTime, pending.deliveryTime)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hasTombstones reports whether entries after id may have been removed by
+// XDEL, in which case counting entries from id is unreliable.
+func (s *stream) hasTombstones(id [2]uint64) bool {
+	if len(s.entries) == 0 || s.maxDeletedID == [2]uint64{} {
+		return false
+	}
+	return compareStreamIDs(s.first, s.maxDeletedID) <= 0 && compareStreamIDs(id, s.maxDeletedID) <= 0
+}
+
+// estimateEntriesRead returns how many entries were added to the stream up
+// to id, or -1 if that cannot be told, as Redis estimates it.
+func (s *stream) estimateEntriesRead(id [2]uint64) int {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	switch c := compareStreamIDs(id, s.last); {
+	case len(s.entries) == 0 && c <= 0, c == 0:
+		return s.entriesAdded
+	case c > 0:
+		return -1
+	}
+	if s.maxDeletedID == [2]uint64{} || compareStreamIDs(s.maxDeletedID, s.first) < 0 {
+		// only trimmed: the entries before the first one were all added
+		switch compareStreamIDs(id, s.first) {
+		case -1:
+			return s.entriesAdded - len(s.entries)
+		case 0:
+			return s.entriesAdded - len(s.entries) + 1
+		}
+	}
+	return -1
+}
+
+// lag returns how many entries are left for the group to read, -1 when
+// unknown.
+func (s *stream) lag(group *streamGroup) int {
+	if s.entriesAdded == 0 {
+		return 0
+	}
+	if group.entriesRead >= 0 && !s.hasTombstones(group.lastID) {
+		return s.entriesAdded - group.entriesRead
+	}
+	if entriesRead := s.estimateEntriesRead(group.lastID); entriesRead >= 0 {
+		return s.entriesAdded - entriesRead
+	}
+	return -1
+}
+
+// encodeOptionalInteger encodes n, or null when it is negative (unknown).
+func encodeOptionalInteger(n int) string {
+	if n < 0 {
+		return encodeNullBulkString()
+	}
+	return encodeInteger(n)
+}
+
+// encodeIdle encodes the milliseconds elapsed since t, -1 if t is zero.
+func encodeIdle(t, now time.Time) string {
+	if t.IsZero() {
+		return encodeInteger(-1)
+	}
+	return encodeInteger(int(now.Sub(t).Milliseconds()))
+}
+
+func encodeUnixMilli(t time.Time) string {
+	if t.IsZero() {
+		return encodeInteger(-1)
+	}
+	return encodeInteger(int(t.UnixMilli()))
+}
+
+// handleStreamInfo implements XINFO STREAM key [FULL [COUNT count]], XINFO
+// GROUPS key and XINFO CONSUMERS key group.
+func (srv *serverState) handleStreamInfo(c *client, cmd []string) string {
+	sub := strings.ToUpper(cmd[1])
+	arities := map[string]int{"STREAM": -3, "GROUPS": 3, "CONSUMERS": 4}
+	arity, ok := arities[sub]
+	if !ok {
+		return encodeError(fmt.Errorf("unknown subcommand '%s'. Try XINFO HELP.", cmd[1]))
+	}
+	if arity > 0 && len(cmd) != arity || arity < 0 && len(cmd) < -arity {
+		return encodeError(errWrongArgs("xinfo|" + strings.ToLower(sub)))
+	}
+
+	full, count := false, 10
+	if sub == "STREAM" && len(cmd) > 3 {
+		if strings.ToUpper(cmd[3]) != "FULL" {
+			return encodeError(errSyntax)
+		}
+		full = true
+		switch {
+		case len(cmd) == 6 && strings.ToUpper(cmd[4]) == "COUNT":
+			n, err := strconv.Atoi(cmd[5])
+			if err != nil {
+				return encodeError(errNotInteger)
+			}
+			count = max(n, 0)
+		case len(cmd) != 4:
+			return encodeError(errSyntax)
+		}
+	}
+
+	s, err := srv.lookupStream(cmd[2])
+	if err != nil {
+		return encodeError(err)
+	}
+	if s == nil {
+		return encodeError(errNoSuchKey)
+	}
+	now := time.Now()
+	switch sub {
+	case "GROUPS":
+		var groups []string
+		for _, name := range sortedKeys(s.groups) {
+			group := s.groups[name]
+			groups = append(groups, encodeArray([]string{
+				encodeBulkString("name"), encodeBulkString(name),
+				encodeBulkString("consumers"), encodeInteger(len(group.consumers)),
+				encodeBulkString("pending"), encodeInteger(len(group.pending)),
+				encodeBulkString("last-delivered-id"), encodeBulkString(formatStreamID(group.lastID)),
+				encodeBulkString("entries-read"), encodeOptionalInteger(group.entriesRead),
+				encodeBulkString("lag"), encodeOptionalInteger(s.lag(group)),
+			}))
+		}
+		return encodeArray(groups)
+
+	case "CONSUMERS":
+		group := s.groups[cmd[3]]
+		if group == nil {
+			return encodeError(errNoGroup(cmd[2], cmd[3]))
+		}
+		var consumers []string
+		for _, name := range sortedKeys(group.consumers) {
+			consumer := group.consumers[name]
+			consumers = append(consumers, encodeArray([]string{
+				encodeBulkString("name"), encodeBulkString(name),
+				encodeBulkString("pending"), encodeInteger(len(consumer.pending)),
+				encodeBulkString("idle"), encodeIdle(consumer.seenTime, now),
+				encodeBulkString("inactive"), encodeIdle(consumer.activeTime, now),
+			}))
+		}
+		return encodeArray(consumers)
+	}
+
+	reply := []string{
+		encodeBulkString("length"), encodeInteger(len(s.entries)),
+		encodeBulkString("last-generated-id"), encodeBulkString(formatStreamID(s.last)),
+		encodeBulkString("max-deleted-entry-id"), encodeBulkString(formatStreamID(s.maxDeletedID)),
+		encodeBulkString("entries-added"), encodeInteger(s.entriesAdded),
+		encodeBulkString("recorded-first-entry-id"), encodeBulkString(formatStreamID(s.first)),
+	}
+	if !full {
+		firstEntry, lastEntry := encodeNullBulkString(), encodeNullBulkString()
+		if len(s.entries) > 0 {
+			firstEntry, lastEntry = encodeStreamEntry(s.entries[0]), encodeStreamEntry(s.entries[len(s.entries)-1])
+		}
+		return encodeArray(append(reply,
+			encodeBulkString("groups"), encodeInteger(len(s.groups)),
+			encodeBulkString("first-entry"), firstEntry,
+			encodeBulkString("last-entry"), lastEntry,
+		))
+	}
+
+	// FULL lists up to count entries, and pending entries per group and
+	// per consumer, all of them when count is 0
+	limit := func(n int) int {
+		if count == 0 {
+			return n
+		}
+		return min(n, count)
+	}
+	var entries []string
+	for _, entry := range s.entries[:limit(len(s.entries))] {
+		entries = append(entries, encodeStreamEntry(entry))
+	}
+	var groups []string
+	for _, name := range sortedKeys(s.groups) {
+		group := s.groups[name]
+		ids := sortedPendingIDs(group.pending)
+		var pel []string
+		for _, id := range ids[:limit(len(ids))] {
+			pending := group.pending[id]
+			pel = append(pel, encodeArray([]string{
+				encodeBulkString(formatStreamID(id)),
+				encodeBulkString(pending.consumer.name),
+				encodeUnixMilli(pending.deliveryTime),
+				encodeInteger(pending.deliveryCount),
+			}))
+		}
+		var consumers []string
+		for _, consumerName := range sortedKeys(group.consumers) {
+			consumer := group.consumers[consumerName]
+			ids := sortedPendingIDs(consumer.pending)
+			var consumerPEL []string
+			for _, id := range ids[:limit(len(ids))] {
+				pending := consumer.pending[id]
+				consumerPEL = append(consumerPEL, encodeArray([]string{
+					encodeBulkString(formatStreamID(id)),
+					encodeUnixMilli(pending.deliveryTime),
+					encodeInteger(pending.deliveryCount),
+				}))
+			}
+			consumers = append(consumers, encodeArray([]string{
+				encodeBulkString("name"), encodeBulkString(consumerName),
+				encodeBulkString("seen-time"), encodeUnixMilli(consumer.seenTime),
+				encodeBulkString("active-time"), encodeUnixMilli(consumer.activeTime),
+				encodeBulkString("pel-count"), encodeInteger(len(consumer.pending)),
+				encodeBulkString("pending"), encodeArray(consumerPEL),
+			}))
+		}
+		groups = append(groups, encodeArray([]string{
+			encodeBulkString("name"), encodeBulkString(name),
+			encodeBulkString("last-delivered-id"), encodeBulkString(formatStreamID(group.lastID)),
+			encodeBulkString("entries-read"), encodeOptionalInteger(group.entriesRead),
+			encodeBulkString("lag"), encodeOptionalInteger(s.lag(group)),
+			encodeBulkString("pel-count"), encodeInteger(len(group.pending)),
+			encodeBulkString("pending"), encodeArray(pel),
+			encodeBulkString("consumers"), encodeArray(consumers),
+		}))
+	}
+	return encodeArray(append(reply,
+		encodeBulkString("entries"), encodeArray(entries),
+		encodeBulkString("groups"), encodeArray(groups),
+	))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// infoFields turns a reply of field names and values into a map.
+func infoFields(reply any) map[string]any {
+	fields := map[string]any{}
+	elements, _ := reply.([]any)
+	for i := 0; i+1 < len(elements); i += 2 {
+		if name, ok := elements[i].(string); ok {
+			fields[name] = elements[i+1]
+		}
+	}
+	return fields
+}
+
+// xinfoGroups returns the XINFO GROUPS fields of each group by name.
+func xinfoGroups(t *testing.T, srv *serverState, key string) map[string]map[string]any {
+	t.Helper()
+	groups := map[string]map[string]any{}
+	reply, _ := call(t, srv, &client{id: 1}, "XINFO", "GROUPS", key).([]any)
+	for _, group := range reply {
+		fields := infoFields(group)
+		groups[fields["name"].(string)] = fields
+	}
+	return groups
+}
+
+// TestStreamInfoGroups checks the entries read and lag XINFO GROUPS reports
+// as a group reads, and once XDEL makes the lag impossible to tell.
+func TestStreamInfoGroups(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, id := range []string{"1-1", "1-2", "1-3", "1-4", "1-5"} {
+		call(t, srv, c, "XADD", "s", id, "f", "v")
+	}
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+	call(t, srv, c, "XGROUP", "CREATE", "s", "late", "$")
+	call(t, srv, c, "XGROUP", "CREATE", "s", "given", "1-2", "ENTRIESREAD", "2")
+
+	check := func(when string, want map[string][]any) {
+		t.Helper()
+		groups := xinfoGroups(t, srv, "s")
+		if len(groups) != len(want) {
+			t.Errorf("%s: groups %v", when, groups)
+		}
+		for name, w := range want {
+			got := groups[name]
+			if got["last-delivered-id"] != w[0] || got["entries-read"] != w[1] || got["lag"] != w[2] || got["pending"] != w[3] {
+				t.Errorf("%s: group %s has last ID %v, entries read %v, lag %v, %v pending; want %v",
+					when, name, got["last-delivered-id"], got["entries-read"], got["lag"], got["pending"], w)
+			}
+		}
+	}
+	// last delivered ID, entries read, lag, pending entries
+	check("before reading", map[string][]any{
+		"g":     {"0-0", 0, 5, 0},
+		"late":  {"1-5", 5, 0, 0},
+		"given": {"1-2", 2, 3, 0},
+	})
+
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	check("after reading two entries", map[string][]any{
+		"g":     {"1-2", 2, 3, 2},
+		"late":  {"1-5", 5, 0, 0},
+		"given": {"1-2", 2, 3, 0},
+	})
+
+	// an entry deleted after the last one read: the lag can't be told
+	call(t, srv, c, "XDEL", "s", "1-4")
+	check("after XDEL", map[string][]any{
+		"g":     {"1-2", 2, nil, 2},
+		"late":  {"1-5", 5, 0, 0},
+		"given": {"1-2", 2, nil, 0},
+	})
+
+	// reading up to the last entry tells it again
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+	call(t, srv, c, "XADD", "s", "1-6", "f", "v")
+	check("after reading the rest", map[string][]any{
+		"g":     {"1-5", 5, 1, 4},
+		"late":  {"1-5", 5, 1, 0},
+		"given": {"1-2", 2, nil, 0},
+	})
+
+	if reply, _ := call(t, srv, c, "XINFO", "GROUPS", "missing").(error); reply == nil || reply.Error() != "ERR no such key" {
+		t.Errorf("XINFO GROUPS of a missing key = %v", reply)
+	}
+}
+
+// TestStreamInfo checks XINFO STREAM, with and without FULL.
+func TestStreamInfo(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, id := range []string{"1-1", "1-2", "1-3", "1-4"} {
+		call(t, srv, c, "XADD", "s", id, "f", "v")
+	}
+	call(t, srv, c, "XDEL", "s", "1-2")
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "COUNT", "2", "STREAMS", "s", ">")
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+
+	info := infoFields(call(t, srv, c, "XINFO", "STREAM", "s"))
+	for field, want := range map[string]any{
+		"length": 3, "last-generated-id": "1-4", "max-deleted-entry-id": "1-2",
+		"entries-added": 4, "recorded-first-entry-id": "1-1", "groups": 1,
+	} {
+		if info[field] != want {
+			t.Errorf("XINFO STREAM %s = %v, want %v", field, info[field], want)
+		}
+	}
+	if first, last := entryIDs([]any{info["first-entry"]}), entryIDs([]any{info["last-entry"]}); first != "1-1" || last != "1-4" {
+		t.Errorf("XINFO STREAM first and last entries = %s, %s", first, last)
+	}
+
+	full := infoFields(call(t, srv, c, "XINFO", "STREAM", "s", "FULL", "COUNT", "2"))
+	if got := entryIDs(full["entries"]); got != "1-1 1-3" {
+		t.Errorf("XINFO STREAM FULL COUNT 2 entries = %s", got)
+	}
+	groups, _ := full["groups"].([]any)
+	if len(groups) != 1 {
+		t.Fatalf("XINFO STREAM FULL groups = %v", full["groups"])
+	}
+	group := infoFields(groups[0])
+	if group["pel-count"] != 3 || group["entries-read"] != 4 || group["lag"] != 0 || entryIDs(group["pending"]) != "1-1 1-3" {
+		t.Errorf("XINFO STREAM FULL group = %v", group)
+	}
+	consumers := map[string]map[string]any{}
+	for _, consumer := range group["consumers"].([]any) {
+		fields := infoFields(consumer)
+		consumers[fields["name"].(string)] = fields
+	}
+	if consumers["alice"]["pel-count"] != 2 || consumers["bob"]["pel-count"] != 1 || entryIDs(consumers["bob"]["pending"]) != "1-4" {
+		t.Errorf("XINFO STREAM FULL consumers = %v", consumers)
+	}
+
+	for _, test := range []struct {
+		cmd []string
+		err string
+	}{
+		{[]string{"XINFO", "STREAM", "missing"}, "ERR no such key"},
+		{[]string{"XINFO", "STREAM", "s", "PARTIAL"}, "ERR syntax error"},
+		{[]string{"XINFO", "STREAM", "s", "FULL", "COUNT"}, "ERR syntax error"},
+		{[]string{"XINFO", "GROUPS", "s", "g"}, "ERR wrong number of arguments for 'xinfo|groups' command"},
+		{[]string{"XINFO", "NOPE", "s"}, "ERR unknown subcommand 'NOPE'. Try XINFO HELP."},
+	} {
+		if reply, _ := call(t, srv, c, test.cmd...).(error); reply == nil || reply.Error() != test.err {
+			t.Errorf("%q = %v, want %s", test.cmd, reply, test.err)
+		}
+	}
+}
+
+// TestStreamInfoConsumers checks the pending entries, idle and inactive
+// times XINFO CONSUMERS reports.
+func TestStreamInfoConsumers(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "XADD", "s", "1-1", "f", "v")
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "0")
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "alice", "STREAMS", "s", ">")
+	call(t, srv, c, "XGROUP", "CREATECONSUMER", "s", "g", "bob")
+
+	// alice was last seen and active an hour ago
+	srv.mu.Lock()
+	alice := srv.streams["s"].groups["g"].consumers["alice"]
+	alice.seenTime = alice.seenTime.Add(-time.Hour)
+	alice.activeTime = alice.activeTime.Add(-time.Hour)
+	srv.mu.Unlock()
+	// bob only looks: seen now, never active
+	call(t, srv, c, "XREADGROUP", "GROUP", "g", "bob", "STREAMS", "s", ">")
+
+	consumers := map[string]map[string]any{}
+	reply, _ := call(t, srv, c, "XINFO", "CONSUMERS", "s", "g").([]any)
+	for _, consumer := range reply {
+		fields := infoFields(consumer)
+		consumers[fields["name"].(string)] = fields
+	}
+	hour := int(time.Hour.Milliseconds())
+	if a := consumers["alice"]; a["pending"] != 1 || a["idle"].(int) < hour || a["inactive"].(int) < hour {
+		t.Errorf("XINFO CONSUMERS alice = %v", a)
+	}
+	if b := consumers["bob"]; b["pending"] != 0 || b["idle"].(int) >= hour || b["inactive"] != -1 {
+		t.Errorf("XINFO CONSUMERS bob = %v", b)
+	}
+
+	if reply, _ := call(t, srv, c, "XINFO", "CONSUMERS", "s", "missing").(error); reply == nil || reply.Error() != "NOGROUP No such consumer group 'missing' for key name 's'" {
+		t.Errorf("XINFO CONSUMERS of a missing group = %v", reply)
+	}
+}
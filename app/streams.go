@@ -1,6 +1,8 @@
 package main
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"math"
 	"slices"
@@ -10,10 +12,12 @@ import (
 )
 
 type stream struct {
-	first   [2]uint64
-	last    [2]uint64
-	entries []*streamEntry
-	blocked []*chan bool
+	first        [2]uint64
+	last         [2]uint64
+	maxDeletedID [2]uint64 // the highest ID removed by XDEL
+	entriesAdded int       // entries ever added, including removed ones
+	entries      []*streamEntry
+	groups       map[string]*streamGroup // consumer groups by name
 }
 
 type streamEntry struct {
@@ -26,10 +30,82 @@ func newStream() *stream {
 		first:   [2]uint64{0, 0},
 		last:    [2]uint64{0, 0},
 		entries: make([]*streamEntry, 0),
-		blocked: make([]*chan bool, 0),
+		groups:  make(map[string]*streamGroup),
 	}
 }
 
+var errInvalidStreamID = errors.New("Invalid stream ID specified as stream command argument")
+
+// parseStreamID parses an ID given as "ms-seq" or just "ms", the sequence
+// number then being missingSeq.
+func parseStreamID(id string, missingSeq uint64) ([2]uint64, error) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return [2]uint64{}, errInvalidStreamID
+	}
+	seq := missingSeq
+	if hasSeq {
+		if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+			return [2]uint64{}, errInvalidStreamID
+		}
+	}
+	return [2]uint64{ms, seq}, nil
+}
+
+func formatStreamID(id [2]uint64) string {
+	return fmt.Sprintf("%d-%d", id[0], id[1])
+}
+
+func compareStreamIDs(a, b [2]uint64) int {
+	if c := cmp.Compare(a[0], b[0]); c != 0 {
+		return c
+	}
+	return cmp.Compare(a[1], b[1])
+}
+
+// entryIndex returns the index of the first entry with an ID not lower than
+// id, and whether its ID is id.
+func (s *stream) entryIndex(id [2]uint64) (int, bool) {
+	return slices.BinarySearchFunc(s.entries, id, func(entry *streamEntry, id [2]uint64) int {
+		return compareStreamIDs(entry.id, id)
+	})
+}
+
+func (s *stream) lookupEntry(id [2]uint64) *streamEntry {
+	if i, found := s.entryIndex(id); found {
+		return s.entries[i]
+	}
+	return nil
+}
+
+// entriesAfter returns up to count entries with an ID greater than id, all of
+// them when count is not positive.
+func (s *stream) entriesAfter(id [2]uint64, count int) []*streamEntry {
+	i, found := s.entryIndex(id)
+	if found {
+		i++
+	}
+	entries := s.entries[i:]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
+
+func wakeAll(channels []chan bool) {
+	for _, ch := range channels {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+func encodeStreamEntry(entry *streamEntry) string {
+	return encodeArray([]string{encodeBulkString(formatStreamID(entry.id)), encodeStringArray(entry.store)})
+}
+
 func (s *stream) addStreamEntry(id string) (*streamEntry, error) {
 	millisecondsTime, sequenceNumber, err := s.getNextID(id)
 	if err != nil {
@@ -46,259 +122,522 @@ func (s *stream) addStreamEntry(id string) (*streamEntry, error) {
 	entry.id[1] = sequenceNumber
 	entry.store = make([]string, 0)
 	s.entries = append(s.entries, entry)
+	s.entriesAdded++
 	return entry, nil
 }
 
+// deleteEntries removes the entries from index i to j (excluded). The last
+// ID is kept, so that XADD still refuses the IDs of removed entries. Entries
+// removed from the head, as trimming does, are resliced away rather than
+// shifting every other entry: the array is compacted by the first append
+// that outgrows it.
+func (s *stream) deleteEntries(i, j int) {
+	if i == 0 {
+		clear(s.entries[:j])
+		s.entries = s.entries[j:]
+	} else {
+		s.entries = slices.Delete(s.entries, i, j)
+	}
+	s.first = [2]uint64{}
+	if len(s.entries) > 0 {
+		s.first = s.entries[0].id
+	}
+}
+
+// streamTrimOptions are the trimming options of XADD and XTRIM:
+// MAXLEN|MINID [=|~] threshold [LIMIT count], and NOMKSTREAM for XADD.
+type streamTrimOptions struct {
+	strategy   string // MAXLEN or MINID, empty when not trimming
+	approx     bool
+	maxLen     int
+	minID      [2]uint64
+	limit      int // -1 when not given
+	noMkStream bool
+}
+
+// parseStreamTrimOptions parses the options starting at cmd[i]. For XADD it
+// stops at the first argument that is not an option, the ID, and returns its
+// index.
+func parseStreamTrimOptions(cmd []string, i int, xadd bool) (opts streamTrimOptions, next int, err error) {
+	opts.limit = -1
+	for ; i < len(cmd); i++ {
+		switch option := strings.ToUpper(cmd[i]); {
+		case xadd && option == "NOMKSTREAM":
+			opts.noMkStream = true
+		case option == "MAXLEN" || option == "MINID":
+			if opts.strategy != "" && opts.strategy != option {
+				return opts, 0, errors.New("syntax error, MAXLEN and MINID options at the same time are not compatible")
+			}
+			opts.strategy = option
+			if i+1 < len(cmd) && (cmd[i+1] == "~" || cmd[i+1] == "=") {
+				opts.approx = cmd[i+1] == "~"
+				i++
+			}
+			if i+1 == len(cmd) {
+				return opts, 0, errSyntax
+			}
+			i++
+			if option == "MINID" {
+				if opts.minID, err = parseStreamID(cmd[i], 0); err != nil {
+					return opts, 0, err
+				}
+				continue
+			}
+			if opts.maxLen, err = strconv.Atoi(cmd[i]); err != nil {
+				return opts, 0, errNotInteger
+			}
+			if opts.maxLen < 0 {
+				return opts, 0, errors.New("The MAXLEN argument must be >= 0.")
+			}
+		case option == "LIMIT":
+			if i+1 == len(cmd) {
+				return opts, 0, errSyntax
+			}
+			i++
+			if opts.limit, err = strconv.Atoi(cmd[i]); err != nil {
+				return opts, 0, errNotInteger
+			}
+			if opts.limit < 0 {
+				return opts, 0, errors.New("The LIMIT argument must be >= 0.")
+			}
+		case xadd:
+			return opts, i, nil
+		default:
+			return opts, 0, errSyntax
+		}
+	}
+	if opts.limit >= 0 && !opts.approx {
+		return opts, 0, errors.New("syntax error, LIMIT cannot be used without the special ~ option")
+	}
+	return opts, i, nil
+}
+
+// trim removes entries from the head of the stream as opts ask and returns
+// how many. Like Redis with its listpack nodes, an approximate trim only
+// removes whole nodes of streamNodeMaxEntries entries, at most limit entries
+// (100 nodes by default, 0 for no limit).
+func (s *stream) trim(opts streamTrimOptions) int {
+	var n int
+	switch opts.strategy {
+	case "MAXLEN":
+		n = max(len(s.entries)-opts.maxLen, 0)
+	case "MINID":
+		n, _ = s.entryIndex(opts.minID)
+	default:
+		return 0
+	}
+	if opts.approx {
+		limit := opts.limit
+		if limit < 0 {
+			limit = 100 * streamNodeMaxEntries
+		}
+		if limit > 0 {
+			n = min(n, limit)
+		}
+		n -= n % streamNodeMaxEntries
+	}
+	if n > 0 {
+		s.deleteEntries(0, n)
+	}
+	return n
+}
+
+// getNextID returns the ID of the next entry: id itself, or an ID generated
+// after the last one for "*" and for "ms-*".
 func (s *stream) getNextID(id string) (millisecondsTime, sequenceNumber uint64, err error) {
-	parts := strings.Split(id, "-")
+	errNotGreater := errors.New("The ID specified in XADD is equal or smaller than the target stream top item")
 
-	if len(parts) == 1 && parts[0] == "*" {
-		millisecondsTime = uint64(time.Now().UnixMilli())
-		if millisecondsTime == s.last[0] {
-			sequenceNumber = s.last[1] + 1
+	if msPart, seqPart, _ := strings.Cut(id, "-"); id == "*" || seqPart == "*" {
+		if id == "*" {
+			millisecondsTime = max(uint64(time.Now().UnixMilli()), s.last[0])
+		} else if millisecondsTime, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+			return 0, 0, errInvalidStreamID
 		}
-	} else if len(parts) == 2 && parts[1] == "*" {
-		millisecondsTime, _ = strconv.ParseUint(parts[0], 10, 64)
-		if millisecondsTime == s.last[0] {
+		switch {
+		case millisecondsTime < s.last[0], millisecondsTime == s.last[0] && s.last[1] == math.MaxUint64:
+			return 0, 0, errNotGreater
+		case millisecondsTime == s.last[0]:
 			sequenceNumber = s.last[1] + 1
-		} else if millisecondsTime > s.last[0] {
-			sequenceNumber = 0
-		} else {
-			return 0, 0, fmt.Errorf("the ID specified in XADD is equal or smaller than the target stream top item")
 		}
-	} else {
-		millisecondsTime, _ = strconv.ParseUint(parts[0], 10, 64)
-		sequenceNumber, _ = strconv.ParseUint(parts[1], 10, 64)
+		return millisecondsTime, sequenceNumber, nil
 	}
 
-	if millisecondsTime == 0 && sequenceNumber == 0 {
-		return 0, 0, fmt.Errorf("The ID specified in XADD must be greater than 0-0")
+	parsed, err := parseStreamID(id, 0)
+	if err != nil {
+		return 0, 0, err
 	}
-
-	if millisecondsTime < s.last[0] || millisecondsTime == s.last[0] && sequenceNumber <= s.last[1] {
-		return 0, 0, fmt.Errorf("The ID specified in XADD is equal or smaller than the target stream top item")
+	if parsed == [2]uint64{} {
+		return 0, 0, errors.New("The ID specified in XADD must be greater than 0-0")
 	}
-
-	return
+	if compareStreamIDs(parsed, s.last) <= 0 {
+		return 0, 0, errNotGreater
+	}
+	return parsed[0], parsed[1], nil
 }
 
-func (s *stream) splitID(id string) (millisecondsTime, sequenceNumber uint64, hasSequence bool, err error) {
-	parts := strings.Split(id, "-")
-	millisecondsTime, err = strconv.ParseUint(parts[0], 10, 64)
+// handleStreamAdd implements XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~]
+// threshold [LIMIT count]] id|* field value [field value ...].
+func (srv *serverState) handleStreamAdd(c *client, cmd []string) (response string) {
+	opts, idIndex, err := parseStreamTrimOptions(cmd, 2, true)
 	if err != nil {
-		return
+		return encodeError(err)
 	}
-	if len(parts) > 1 {
-		sequenceNumber, err = strconv.ParseUint(parts[1], 10, 64)
-		hasSequence = true
+	streamKey, id, kvpairs := cmd[1], cmd[idIndex], cmd[idIndex+1:]
+	if len(kvpairs) == 0 || len(kvpairs)%2 != 0 {
+		return encodeError(errWrongArgs("xadd"))
 	}
-	return
-}
 
-func (srv *serverState) handleStreamAdd(streamKey, id string, kvpairs []string) (response string) {
-	stream, exists := srv.streams[streamKey]
+	stream, err := srv.lookupStream(streamKey)
+	if err != nil {
+		return encodeError(err)
+	}
+	exists := stream != nil
 	if !exists {
+		if opts.noMkStream {
+			return encodeNullBulkString()
+		}
+		// only stored once the entry is added: an invalid ID leaves no key
 		stream = newStream()
-		srv.streams[streamKey] = stream
 	}
 
 	entry, err := stream.addStreamEntry(id)
 	if err != nil {
-		response = encodeError(err)
-	} else {
-		for i := 0; i < len(kvpairs); i += 2 {
-			key, value := kvpairs[i], kvpairs[i+1]
-			entry.store = append(entry.store, key, value)
-		}
-		response = encodeBulkString(fmt.Sprintf("%d-%d", entry.id[0], entry.id[1]))
+		return encodeError(err)
 	}
-
-	for _, ch := range stream.blocked {
-		*ch <- true
+	for i := 0; i < len(kvpairs); i += 2 {
+		key, value := kvpairs[i], kvpairs[i+1]
+		entry.store = append(entry.store, key, value)
 	}
-
-	return
+	stream.trim(opts)
+	if !exists {
+		srv.storeNewStream(streamKey, stream)
+	}
+	srv.dirty++
+	srv.wakeStreamWaiters(streamKey)
+	return encodeBulkString(formatStreamID(entry.id))
 }
 
-func searchStreamEntries(entries []*streamEntry, targetMs, targetSeq uint64, lo, hi int) int {
-	for lo <= hi {
-		mid := (lo + hi) / 2
-		entry := entries[mid]
-		if targetMs == entry.id[0] && targetSeq == entry.id[1] {
-			lo = mid
-			break
-		} else if targetMs == entry.id[0] && entry.id[1] > targetSeq {
-			hi = mid - 1
-		} else if targetMs == entry.id[0] && entry.id[1] < targetSeq {
-			lo = mid + 1
-		} else if targetMs < entry.id[0] {
-			hi = mid - 1
+// streamRange returns the entries of s from start to end included, at most
+// count of them when count is not negative, from the end when rev is set.
+func (s *stream) streamRange(start, end [2]uint64, count int, rev bool) []*streamEntry {
+	i, _ := s.entryIndex(start)
+	j, found := s.entryIndex(end)
+	if found {
+		j++
+	}
+	if j <= i {
+		return nil
+	}
+	entries := s.entries[i:j]
+	if count >= 0 && len(entries) > count {
+		if rev {
+			entries = entries[len(entries)-count:]
 		} else {
-			lo = mid + 1
+			entries = entries[:count]
 		}
 	}
-	return lo
+	if rev {
+		entries = slices.Clone(entries)
+		slices.Reverse(entries)
+	}
+	return entries
 }
 
-func (srv *serverState) handleStreamRange(streamKey, start, end string) (response string) {
-
-	stream, exists := srv.streams[streamKey]
-	if !exists || len(stream.entries) == 0 {
-		response = "*0\r\n"
-		return
+// handleStreamRange implements XRANGE key start end [COUNT count] and, with
+// the bounds the other way round, XREVRANGE key end start [COUNT count].
+func (srv *serverState) handleStreamRange(c *client, cmd []string) string {
+	rev := strings.ToLower(cmd[0]) == "xrevrange"
+	startArg, endArg := cmd[2], cmd[3]
+	if rev {
+		startArg, endArg = endArg, startArg
 	}
-
-	var startIndex, endIndex int
-
-	if start == "-" {
-		startIndex = 0
-	} else {
-		startMs, startSeq, startHasSeq, _ := stream.splitID(start)
-		if !startHasSeq {
-			startSeq = 0
+	start, err := parseStreamRangeID(startArg, 0)
+	if err != nil {
+		return encodeError(err)
+	}
+	end, err := parseStreamRangeID(endArg, math.MaxUint64)
+	if err != nil {
+		return encodeError(err)
+	}
+	count := -1
+	switch {
+	case len(cmd) == 6 && strings.ToUpper(cmd[4]) == "COUNT":
+		if count, err = strconv.Atoi(cmd[5]); err != nil {
+			return encodeError(errNotInteger)
 		}
-		startIndex = searchStreamEntries(stream.entries, startMs, startSeq, 0, len(stream.entries)-1)
+		count = max(count, 0)
+	case len(cmd) != 4:
+		return encodeError(errSyntax)
 	}
 
-	if end == "+" {
-		endIndex = len(stream.entries) - 1
-	} else {
-		endMs, endSeq, endHasSeq, _ := stream.splitID(end)
-		if !endHasSeq {
-			endSeq = math.MaxUint64
-		}
-		endIndex = searchStreamEntries(stream.entries, endMs, endSeq, startIndex, len(stream.entries)-1)
-		if endIndex >= len(stream.entries) {
-			endIndex = len(stream.entries) - 1
-		}
+	s, err := srv.lookupStream(cmd[1])
+	if err != nil {
+		return encodeError(err)
 	}
+	if s == nil {
+		return encodeArray(nil)
+	}
+	var entries []string
+	for _, entry := range s.streamRange(start, end, count, rev) {
+		entries = append(entries, encodeStreamEntry(entry))
+	}
+	return encodeArray(entries)
+}
 
-	entriesCount := endIndex - startIndex + 1
-	response = fmt.Sprintf("*%d\r\n", entriesCount)
-	for index := startIndex; index <= endIndex; index++ {
-		entry := stream.entries[index]
-		id := fmt.Sprintf("%d-%d", entry.id[0], entry.id[1])
-		response += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(id), id)
-		response += fmt.Sprintf("*%d\r\n", len(entry.store))
-		for _, kv := range entry.store {
-			response += encodeBulkString(kv)
+// streamReadKeys returns the stream keys of an XREAD, the first half of the
+// arguments following STREAMS.
+func streamReadKeys(cmd []string) []string {
+	for i, arg := range cmd {
+		if strings.ToUpper(arg) == "STREAMS" {
+			args := cmd[i+1:]
+			return args[:len(args)/2]
 		}
 	}
-
-	return
+	return nil
 }
 
-func (srv *serverState) handleStreamRead(cmd []string) (response string) {
-	readKeyIndex := 2
+// wakeStreamWaiters wakes the readers blocked on key so that they look at
+// it again: whenever an entry is added, or the stream is created, replaced
+// or deleted. Waiters are registered by key, not on the stream, so that they
+// follow the key when its stream is replaced. Readers wait without holding
+// srv.mu, so never block on them. Called with srv.mu held.
+func (srv *serverState) wakeStreamWaiters(key string) {
+	wakeAll(srv.streamWaiters[key])
+}
 
-	isBlocking := false
-	blockTimeout := 0
-	if cmd[1] == "block" {
-		isBlocking = true
-		blockTimeout, _ = strconv.Atoi(cmd[2])
-		readKeyIndex += 2
+// addStreamWaiter registers wakeup for the streams at keys. Called with
+// srv.mu held.
+func (srv *serverState) addStreamWaiter(keys []string, wakeup chan bool) {
+	if srv.streamWaiters == nil {
+		srv.streamWaiters = make(map[string][]chan bool)
 	}
-	_ = blockTimeout
-
-	readCount := (len(cmd) - readKeyIndex) / 2
-	readStartIndex := readKeyIndex + readCount
-
-	readParams := []struct{ key, start string }{}
-	for i := 0; i < readCount; i++ {
-		streamKey := cmd[i+readKeyIndex]
-		start := cmd[i+readStartIndex]
+	for _, key := range keys {
+		srv.streamWaiters[key] = append(srv.streamWaiters[key], wakeup)
+	}
+}
 
-		_, exists := srv.streams[streamKey]
-		if exists {
-			readParams = append(readParams, struct{ key, start string }{streamKey, start})
+// removeStreamWaiter must be called with srv.mu held.
+func (srv *serverState) removeStreamWaiter(keys []string, wakeup chan bool) {
+	isWakeup := func(ch chan bool) bool { return ch == wakeup }
+	for _, key := range keys {
+		if waiters := slices.DeleteFunc(srv.streamWaiters[key], isWakeup); len(waiters) > 0 {
+			srv.streamWaiters[key] = waiters
+		} else {
+			delete(srv.streamWaiters, key)
 		}
 	}
+}
 
-	response = fmt.Sprintf("*%d\r\n", len(readParams))
-
-	for _, readParam := range readParams {
-
-		streamKey, start := readParam.key, readParam.start
-
-		// stream key + entry (below)
-		response += fmt.Sprintf("*%d\r\n", 2)
-		response += encodeBulkString(streamKey)
-
-		stream := srv.streams[streamKey]
-
-		var startMs, startSeq uint64
-		var startHasSeq bool
+// storeNewStream stores s at key, where there was no stream.
+func (srv *serverState) storeNewStream(key string, s *stream) {
+	srv.streams[key] = s
+	srv.wakeStreamWaiters(key)
+}
 
-		if start == "$" {
-			startMs, startSeq = stream.last[0], stream.last[1]
-		} else {
-			startMs, startSeq, startHasSeq, _ = stream.splitID(start)
-			if !startHasSeq {
-				startSeq = 0
+// handleStreamRead implements XREAD [COUNT count] [BLOCK milliseconds]
+// STREAMS key... id..., returning the entries after each ID of the streams
+// that have some. "$" stands for the last ID of the stream when the command
+// is received, "+" for its last entry.
+func (srv *serverState) handleStreamRead(c *client, cmd []string) string {
+	count, block := 0, -1
+	i := 1
+	for ; i < len(cmd) && strings.ToUpper(cmd[i]) != "STREAMS"; i++ {
+		switch option := strings.ToUpper(cmd[i]); option {
+		case "COUNT", "BLOCK":
+			if i+1 == len(cmd) {
+				return encodeError(errSyntax)
+			}
+			i++
+			n, err := strconv.Atoi(cmd[i])
+			if err != nil {
+				return encodeError(errNotInteger)
+			}
+			if option == "COUNT" {
+				count = max(n, 0)
+			} else if n < 0 {
+				return encodeError(errors.New("timeout is negative"))
+			} else {
+				block = n
 			}
+		default:
+			return encodeError(errSyntax)
 		}
+	}
+	if i == len(cmd) {
+		return encodeError(errSyntax)
+	}
+	streams := cmd[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		return encodeError(errors.New("Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified."))
+	}
+	keys, ids := streams[:len(streams)/2], streams[len(streams)/2:]
 
-		var entry *streamEntry
-		var startIndex int
-
-		for entry == nil {
-			startIndex = searchStreamEntries(stream.entries, startMs, startSeq, startIndex, len(stream.entries)-1)
-
-			if startIndex < len(stream.entries) {
-				entry = stream.entries[startIndex]
+	startIDs := make([][2]uint64, len(keys))
+	for i, key := range keys {
+		s, err := srv.lookupStream(key)
+		if err != nil {
+			return encodeError(err)
+		}
+		switch ids[i] {
+		case "$":
+			if s != nil {
+				startIDs[i] = s.last
 			}
-
-			// if found exact match, need to get the next one (xread bound is exclusive)
-			if entry != nil && entry.id[0] == startMs && entry.id[1] == startSeq {
-				if startIndex+1 < len(stream.entries) {
-					entry = stream.entries[startIndex+1]
-				} else {
-					entry = nil
-				}
+		case "+":
+		default:
+			if startIDs[i], err = parseStreamID(ids[i], 0); err != nil {
+				return encodeError(err)
 			}
+		}
+	}
 
-			if entry == nil {
-				if isBlocking {
-					waitForAdd := make(chan bool)
-					stream.blocked = append(stream.blocked, &waitForAdd)
-					timedOut := false
-					if blockTimeout > 0 {
-						fmt.Printf("Waiting for a write on stream %s (timeout = %d ms)...\n", streamKey, blockTimeout)
-						timer := time.After(time.Duration(blockTimeout) * time.Millisecond)
-						select {
-						case <-waitForAdd:
-							timedOut = false
-						case <-timer:
-							timedOut = true
-						}
-					} else {
-						fmt.Printf("Waiting for a write on stream %s (no timeout!)...\n", streamKey)
-						<-waitForAdd
-					}
-					stream.blocked = slices.DeleteFunc(stream.blocked, func(ch *chan bool) bool { return ch == &waitForAdd })
-					if timedOut {
-						response = "$-1\r\n"
-						return
-					}
-				} else {
-					break
+	var deadline <-chan time.Time
+	if block > 0 {
+		deadline = time.After(time.Duration(block) * time.Millisecond)
+	}
+	for {
+		var replies []string
+		for i, key := range keys {
+			s, err := srv.lookupStream(key)
+			if err != nil {
+				return encodeError(err)
+			}
+			if s == nil {
+				continue
+			}
+			var entries []*streamEntry
+			if ids[i] == "+" {
+				if len(s.entries) > 0 {
+					entries = s.entries[len(s.entries)-1:]
 				}
+			} else {
+				entries = s.entriesAfter(startIDs[i], count)
+			}
+			if len(entries) == 0 {
+				continue
 			}
+			encoded := make([]string, len(entries))
+			for j, entry := range entries {
+				encoded[j] = encodeStreamEntry(entry)
+			}
+			replies = append(replies, encodeArray([]string{encodeBulkString(key), encodeArray(encoded)}))
 		}
 
-		if entry == nil {
-			response = "*0\r\n"
-			return
+		if len(replies) > 0 {
+			return encodeArray(replies)
+		}
+		if block < 0 {
+			return encodeNullArray()
+		}
+
+		// wait for an entry to be added to any of the streams, or for the
+		// missing ones to be created
+		wakeup := make(chan bool, 1)
+		srv.addStreamWaiter(keys, wakeup)
+		srv.mu.Unlock()
+		timedOut := false
+		select {
+		case <-wakeup:
+		case <-deadline:
+			timedOut = true
+		}
+		srv.mu.Lock()
+		srv.removeStreamWaiter(keys, wakeup)
+		if timedOut {
+			return encodeNullArray()
 		}
+	}
+}
+
+// handleStreamTrim implements XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT
+// count].
+func (srv *serverState) handleStreamTrim(c *client, cmd []string) string {
+	opts, _, err := parseStreamTrimOptions(cmd, 2, false)
+	if err != nil {
+		return encodeError(err)
+	}
+	if opts.strategy == "" {
+		return encodeError(errSyntax)
+	}
+	s, err := srv.lookupStream(cmd[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	if s == nil {
+		return encodeInteger(0)
+	}
+	removed := s.trim(opts)
+	if removed > 0 {
+		srv.dirty++
+	}
+	return encodeInteger(removed)
+}
 
-		// single entry
-		response += "*1\r\n"
-		id := fmt.Sprintf("%d-%d", entry.id[0], entry.id[1])
-		response += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(id), id)
-		response += fmt.Sprintf("*%d\r\n", len(entry.store))
-		for _, kv := range entry.store {
-			response += encodeBulkString(kv)
+// handleStreamDelete implements XDEL key id [id ...]. Pending entries of
+// consumer groups are left alone: XREADGROUP and XAUTOCLAIM report them as
+// deleted.
+func (srv *serverState) handleStreamDelete(c *client, cmd []string) string {
+	ids := make([][2]uint64, 0, len(cmd)-2)
+	for _, arg := range cmd[2:] {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return encodeError(err)
+		}
+		ids = append(ids, id)
+	}
+	s, err := srv.lookupStream(cmd[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	if s == nil {
+		return encodeInteger(0)
+	}
+	deleted := 0
+	for _, id := range ids {
+		i, found := s.entryIndex(id)
+		if !found {
+			continue
+		}
+		s.deleteEntries(i, i+1)
+		if compareStreamIDs(id, s.maxDeletedID) > 0 {
+			s.maxDeletedID = id
 		}
+		deleted++
+	}
+	if deleted > 0 {
+		srv.dirty++
+	}
+	return encodeInteger(deleted)
+}
+
+func (srv *serverState) handleStreamLen(c *client, cmd []string) string {
+	s, err := srv.lookupStream(cmd[1])
+	if err != nil {
+		return encodeError(err)
+	}
+	if s == nil {
+		return encodeInteger(0)
+	}
+	return encodeInteger(len(s.entries))
+}
+
+// rewriteStreamTrim replaces the trimming options of an XADD or XTRIM that
+// ran by an exact MAXLEN to the length the stream was left with, so that
+// replicas trim the same entries whatever the options were.
+func (srv *serverState) rewriteStreamTrim(cmd []string) []string {
+	xadd := strings.ToLower(cmd[0]) == "xadd"
+	opts, idIndex, _ := parseStreamTrimOptions(cmd, 2, xadd)
+	s, ok := srv.streams[cmd[1]]
+	if !ok {
+		return cmd
+	}
+	rewritten := []string{cmd[0], cmd[1]}
+	if opts.strategy != "" {
+		rewritten = append(rewritten, "MAXLEN", "=", strconv.Itoa(len(s.entries)))
+	}
+	if xadd {
+		rewritten = append(rewritten, formatStreamID(s.last))
+		rewritten = append(rewritten, cmd[idIndex+1:]...)
 	}
-	return
+	return rewritten
 }
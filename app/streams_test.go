@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestStreamReadRecreatedKey checks that a blocked XREAD follows its key:
+// once the stream it waits on is deleted and XADD creates another one, the
+// reader gets the new entry.
+func TestStreamReadRecreatedKey(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "XADD", "s", "1-1", "f", "old")
+
+	for _, block := range []string{"0", "5000"} {
+		replies := make(chan any, 1)
+		go func() {
+			replies <- call(t, srv, &client{id: 2}, "XREAD", "BLOCK", block, "STREAMS", "s", "$")
+		}()
+		waitFor(t, 5*time.Second, "XREAD to block", func() bool {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			return len(srv.streamWaiters["s"]) == 1
+		})
+		call(t, srv, c, "DEL", "s")
+		call(t, srv, c, "XADD", "s", "2-1", "f", "new")
+
+		select {
+		case reply := <-replies:
+			entries, ok := reply.([]any)
+			if !ok || len(entries) != 1 || entries[0].([]any)[1].([]any)[0].([]any)[0] != "2-1" {
+				t.Errorf("XREAD BLOCK %s = %v, want entry 2-1", block, reply)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("XREAD BLOCK %s still blocked after the stream was recreated", block)
+		}
+		call(t, srv, c, "DEL", "s")
+		call(t, srv, c, "XADD", "s", "1-1", "f", "old")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.streamWaiters) != 0 {
+		t.Errorf("waiters left behind: %v", srv.streamWaiters)
+	}
+}
+
+// TestStreamReadGroupDeletedKey checks that deleting the stream a blocked
+// XREADGROUP waits on ends it with an error.
+func TestStreamReadGroupDeletedKey(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	call(t, srv, c, "XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+
+	replies := make(chan any, 1)
+	go func() {
+		replies <- call(t, srv, &client{id: 2}, "XREADGROUP", "GROUP", "g", "alice", "BLOCK", "0", "STREAMS", "s", ">")
+	}()
+	waitFor(t, 5*time.Second, "XREADGROUP to block", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.streamWaiters["s"]) == 1
+	})
+	call(t, srv, c, "DEL", "s")
+	select {
+	case reply := <-replies:
+		if _, ok := reply.(error); !ok {
+			t.Errorf("XREADGROUP = %v after the stream was deleted, want an error", reply)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("XREADGROUP still blocked after the stream was deleted")
+	}
+}
+
+// fillStream replaces the stream at key by one of n entries, with IDs 1-0 to
+// n-0.
+func fillStream(t *testing.T, srv *serverState, key string, n int) {
+	t.Helper()
+	c := &client{id: 1}
+	call(t, srv, c, "DEL", key)
+	for i := 1; i <= n; i++ {
+		call(t, srv, c, "XADD", key, strconv.Itoa(i)+"-0", "f", "v")
+	}
+}
+
+// TestStreamTrim checks how many entries XTRIM removes, approximate trims
+// removing whole nodes of streamNodeMaxEntries entries only.
+func TestStreamTrim(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, test := range []struct {
+		args    []string
+		removed int
+	}{
+		{[]string{"MAXLEN", "240"}, 10},
+		{[]string{"MAXLEN", "=", "240"}, 10},
+		{[]string{"MAXLEN", "300"}, 0},
+		{[]string{"MAXLEN", "~", "100"}, 100},
+		{[]string{"MAXLEN", "~", "200"}, 0},
+		{[]string{"MAXLEN", "~", "0", "LIMIT", "150"}, 100},
+		{[]string{"MAXLEN", "~", "0", "LIMIT", "50"}, 0},
+		{[]string{"MAXLEN", "~", "0", "LIMIT", "0"}, 200},
+		{[]string{"MINID", "100"}, 99},
+		{[]string{"MINID", "=", "100-0"}, 99},
+		{[]string{"MINID", "~", "210"}, 200},
+	} {
+		fillStream(t, srv, "s", 250)
+		cmd := append([]string{"XTRIM", "s"}, test.args...)
+		if reply := call(t, srv, c, cmd...); reply != test.removed {
+			t.Errorf("%q = %v, want %d", cmd, reply, test.removed)
+			continue
+		}
+		s := srv.streams["s"]
+		if first := [2]uint64{uint64(test.removed) + 1, 0}; len(s.entries) != 250-test.removed || s.first != first || s.entries[0].id != first {
+			t.Errorf("%q left %d entries from %v", cmd, len(s.entries), s.first)
+		}
+	}
+
+	for _, test := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"MAXLEN", "10", "LIMIT", "5"}, "ERR syntax error, LIMIT cannot be used without the special ~ option"},
+		{[]string{"MAXLEN", "10", "MINID", "5"}, "ERR syntax error, MAXLEN and MINID options at the same time are not compatible"},
+		{[]string{"MAXLEN", "-1"}, "ERR The MAXLEN argument must be >= 0."},
+		{[]string{"MAXLEN", "~", "10", "LIMIT", "-1"}, "ERR The LIMIT argument must be >= 0."},
+	} {
+		cmd := append([]string{"XTRIM", "s"}, test.args...)
+		if reply, _ := call(t, srv, c, cmd...).(error); reply == nil || reply.Error() != test.err {
+			t.Errorf("%q = %v, want %s", cmd, reply, test.err)
+		}
+	}
+
+	// the last ID outlives the entries
+	call(t, srv, c, "XTRIM", "s", "MAXLEN", "0")
+	if reply, _ := call(t, srv, c, "XADD", "s", "250-0", "f", "v").(error); reply == nil {
+		t.Error("XADD of the ID of a trimmed entry succeeded")
+	}
+	if reply := call(t, srv, c, "XADD", "s", "251-0", "f", "v"); reply != "251-0" {
+		t.Errorf("XADD after the last ID = %v", reply)
+	}
+}
+
+// TestStreamDelete checks XDEL and the maximal deleted ID it records.
+func TestStreamDelete(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	fillStream(t, srv, "s", 5)
+
+	for _, test := range []struct {
+		ids        []string
+		deleted    int
+		maxDeleted [2]uint64
+		entries    string
+	}{
+		{[]string{"2-0", "4-0", "9-0"}, 2, [2]uint64{4, 0}, "1-0 3-0 5-0"},
+		{[]string{"1-0", "4-0"}, 1, [2]uint64{4, 0}, "3-0 5-0"},
+		{[]string{"5"}, 1, [2]uint64{5, 0}, "3-0"},
+	} {
+		cmd := append([]string{"XDEL", "s"}, test.ids...)
+		if reply := call(t, srv, c, cmd...); reply != test.deleted {
+			t.Errorf("%q = %v, want %d", cmd, reply, test.deleted)
+		}
+		s := srv.streams["s"]
+		if s.maxDeletedID != test.maxDeleted || s.entriesAdded != 5 {
+			t.Errorf("after %q: max deleted ID %v, entries added %d; want %v, 5", cmd, s.maxDeletedID, s.entriesAdded, test.maxDeleted)
+		}
+		if got := entryIDs(call(t, srv, c, "XRANGE", "s", "-", "+")); got != test.entries {
+			t.Errorf("after %q: entries %s, want %s", cmd, got, test.entries)
+		}
+	}
+	if first := srv.streams["s"].first; first != [2]uint64{3, 0} {
+		t.Errorf("first ID = %v, want 3-0", first)
+	}
+
+	if reply := call(t, srv, c, "XDEL", "missing", "1-0"); reply != 0 {
+		t.Errorf("XDEL of a missing key = %v", reply)
+	}
+	if reply, _ := call(t, srv, c, "XDEL", "s", "3-0", "invalid").(error); reply == nil {
+		t.Error("XDEL of an invalid ID succeeded")
+	}
+	if got := entryIDs(call(t, srv, c, "XRANGE", "s", "-", "+")); got != "3-0" {
+		t.Errorf("an XDEL with an invalid ID deleted entries: %s left", got)
+	}
+}
+
+// TestStreamTrimPropagation checks that trims are propagated as an exact
+// MAXLEN, the length the stream was left with.
+func TestStreamTrimPropagation(t *testing.T) {
+	master := newTestServer(t)
+	master.backlog = newReplicationBacklog(master.config.replBacklogSize)
+	c := &client{id: 1}
+	fillStream(t, master, "s", 250)
+
+	for _, test := range []struct {
+		cmd, want []string
+	}{
+		{[]string{"XTRIM", "s", "MAXLEN", "~", "100"}, []string{"XTRIM", "s", "MAXLEN", "=", "150"}},
+		// nothing removed, nothing propagated
+		{[]string{"XTRIM", "s", "MINID", "~", "160", "LIMIT", "200"}, nil},
+		{[]string{"XTRIM", "s", "MINID", "160"}, []string{"XTRIM", "s", "MAXLEN", "=", "91"}},
+		{[]string{"XADD", "s", "MAXLEN", "~", "0", "LIMIT", "0", "300-*", "f", "v"}, []string{"XADD", "s", "MAXLEN", "=", "92", "300-0", "f", "v"}},
+		{[]string{"XADD", "s", "NOMKSTREAM", "MAXLEN", "50", "400-*", "f", "v"}, []string{"XADD", "s", "MAXLEN", "=", "50", "400-0", "f", "v"}},
+	} {
+		master.mu.Lock()
+		offset := master.config.replOffset
+		master.mu.Unlock()
+		if reply, ok := call(t, master, c, test.cmd...).(error); ok {
+			t.Fatalf("%q: %v", test.cmd, reply)
+		}
+		master.mu.Lock()
+		propagated, _, err := decodeStringArray(bufio.NewReader(bytes.NewReader(master.backlog.tail(master.config.replOffset - offset))))
+		master.mu.Unlock()
+		if (err == nil) != (test.want != nil) || err == nil && !slices.Equal(propagated, test.want) {
+			t.Errorf("%q propagated as %q, want %q", test.cmd, propagated, test.want)
+		}
+	}
+}
+
+// TestStreamRange checks XRANGE and XREVRANGE with COUNT and exclusive
+// bounds, including bounds with the highest sequence number of a time.
+func TestStreamRange(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	const maxSeq = "18446744073709551615"
+	for _, id := range []string{"5-1", "5-" + maxSeq, "6-0", "6-1", "7-0"} {
+		call(t, srv, c, "XADD", "s", id, "f", "v")
+	}
+
+	for _, test := range []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"XRANGE", "s", "-", "+"}, "5-1 5-" + maxSeq + " 6-0 6-1 7-0"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "2"}, "5-1 5-" + maxSeq},
+		{[]string{"XRANGE", "s", "-", "+", "count", "9"}, "5-1 5-" + maxSeq + " 6-0 6-1 7-0"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "0"}, ""},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "-1"}, ""},
+		{[]string{"XRANGE", "s", "6", "6"}, "6-0 6-1"},
+		{[]string{"XRANGE", "s", "7", "5"}, ""},
+		{[]string{"XRANGE", "missing", "-", "+"}, ""},
+		{[]string{"XREVRANGE", "s", "+", "-"}, "7-0 6-1 6-0 5-" + maxSeq + " 5-1"},
+		{[]string{"XREVRANGE", "s", "+", "-", "COUNT", "2"}, "7-0 6-1"},
+		{[]string{"XREVRANGE", "s", "6", "5"}, "6-1 6-0 5-" + maxSeq + " 5-1"},
+		{[]string{"XREVRANGE", "s", "5", "6"}, ""},
+
+		// exclusive bounds
+		{[]string{"XRANGE", "s", "(5-1", "+"}, "5-" + maxSeq + " 6-0 6-1 7-0"},
+		{[]string{"XRANGE", "s", "(5", "+"}, "5-1 5-" + maxSeq + " 6-0 6-1 7-0"},
+		{[]string{"XRANGE", "s", "-", "(6"}, "5-1 5-" + maxSeq + " 6-0 6-1"},
+		{[]string{"XRANGE", "s", "(6-0", "(7-0"}, "6-1"},
+		{[]string{"XRANGE", "s", "(5-" + maxSeq, "+", "COUNT", "1"}, "6-0"},
+		{[]string{"XRANGE", "s", "-", "(6-0"}, "5-1 5-" + maxSeq},
+		{[]string{"XREVRANGE", "s", "(6-0", "-"}, "5-" + maxSeq + " 5-1"},
+		{[]string{"XREVRANGE", "s", "+", "(5-" + maxSeq}, "7-0 6-1 6-0"},
+		{[]string{"XREVRANGE", "s", "(6-1", "(5-1", "COUNT", "2"}, "6-0 5-" + maxSeq},
+	} {
+		if got := entryIDs(call(t, srv, c, test.cmd...)); got != test.want {
+			t.Errorf("%q = %s, want %s", test.cmd, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		cmd []string
+		err string
+	}{
+		{[]string{"XRANGE", "s", "(" + maxSeq + "-" + maxSeq, "+"}, "ERR invalid start ID for the interval"},
+		{[]string{"XRANGE", "s", "-", "(0-0"}, "ERR invalid end ID for the interval"},
+		{[]string{"XREVRANGE", "s", "(0-0", "-"}, "ERR invalid end ID for the interval"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT"}, "ERR syntax error"},
+		{[]string{"XRANGE", "s", "-", "+", "LIMIT", "1"}, "ERR syntax error"},
+		{[]string{"XRANGE", "s", "-", "+", "COUNT", "x"}, "ERR value is not an integer or out of range"},
+	} {
+		if reply, _ := call(t, srv, c, test.cmd...).(error); reply == nil || reply.Error() != test.err {
+			t.Errorf("%q = %v, want %s", test.cmd, reply, test.err)
+		}
+	}
+}
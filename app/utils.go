@@ -2,12 +2,28 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
+// codedError is an error reply carrying its own code instead of the generic
+// ERR prefix, e.g. WRONGTYPE.
+type codedError struct {
+	code    string
+	message string
+}
+
+func (e codedError) Error() string {
+	return e.code + " " + e.message
+}
+
 func encodeError(e error) string {
+	if _, ok := e.(codedError); ok {
+		return fmt.Sprintf("-%s\r\n", e.Error())
+	}
 	return fmt.Sprintf("-ERR %s\r\n", e.Error())
 }
 
@@ -16,16 +32,26 @@ func encodeSimpleString(s string) string {
 }
 
 func encodeBulkString(s string) string {
-	if len(s) == 0 {
-		return "$-1\r\n"
-	}
 	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
 }
 
+func encodeNullBulkString() string {
+	return "$-1\r\n"
+}
+
 func encodeInteger(s int) string {
 	return fmt.Sprintf(":%d\r\n", s)
 }
 
+// encodeArray wraps elements that are already RESP encoded.
+func encodeArray(elements []string) string {
+	return fmt.Sprintf("*%d\r\n", len(elements)) + strings.Join(elements, "")
+}
+
+func encodeNullArray() string {
+	return "*-1\r\n"
+}
+
 func encodeStringArray(arr []string) string {
 	result := fmt.Sprintf("*%d\r\n", len(arr))
 	for _, s := range arr {
@@ -34,39 +60,275 @@ func encodeStringArray(arr []string) string {
 	return result
 }
 
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// protocolError is returned by decodeStringArray for malformed requests; the
+// connection can't be resynchronized after one, so callers reply and close.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+const (
+	maxMultibulkLength = 1024 * 1024
+	maxBulkLength      = 512 * 1024 * 1024
+)
+
+// decodeStringArray reads one command, either as a RESP array of bulk strings
+// or as an inline command (space separated words on a single line).
 func decodeStringArray(reader *bufio.Reader) (arr []string, bytesRead int, err error) {
-	var arrSize, strSize int
-	for {
-		var token string
-		token, err = reader.ReadString('\n')
+	for len(arr) == 0 {
+		var line string
+		line, err = readLine(reader, &bytesRead)
 		if err != nil {
 			return
 		}
-		bytesRead += len(token)
-		token = strings.TrimRight(token, "\r\n")
-		switch {
-		case arrSize == 0 && token[0] == '*':
-			arrSize, err = strconv.Atoi(token[1:])
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '*' {
+			arr, err = splitInlineArgs(line)
 			if err != nil {
 				return
 			}
-		case strSize == 0 && token[0] == '$':
-			strSize, err = strconv.Atoi(token[1:])
+			continue
+		}
+
+		var arrSize int
+		arrSize, err = strconv.Atoi(line[1:])
+		if err != nil || arrSize > maxMultibulkLength {
+			return nil, bytesRead, protocolError("invalid multibulk length")
+		}
+		arr = make([]string, 0, max(arrSize, 0))
+		for ; arrSize > 0; arrSize-- {
+			line, err = readLine(reader, &bytesRead)
 			if err != nil {
+				// the array was cut short, not the stream between commands
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
 				return
 			}
-		default:
-			if len(token) != strSize {
-				fmt.Printf("[from master] Wrong string size - got: %d, want: %d\n", len(token), strSize)
-				break
+			if len(line) == 0 || line[0] != '$' {
+				got := byte(' ')
+				if len(line) > 0 {
+					got = line[0]
+				}
+				return nil, bytesRead, protocolError(fmt.Sprintf("expected '$', got '%c'", got))
+			}
+			var strSize int
+			strSize, err = strconv.Atoi(line[1:])
+			if err != nil || strSize < 0 || strSize > maxBulkLength {
+				return nil, bytesRead, protocolError("invalid bulk length")
+			}
+			data := make([]byte, strSize+2)
+			if _, err = io.ReadFull(reader, data); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+			bytesRead += len(data)
+			if data[strSize] != '\r' || data[strSize+1] != '\n' {
+				return nil, bytesRead, protocolError("bulk string not terminated by CRLF")
+			}
+			arr = append(arr, string(data[:strSize]))
+		}
+	}
+	return
+}
+
+// decodeReply reads one reply sent back by a server: simple and bulk strings
+// become strings, integers ints, arrays []any and nulls nil. Error replies
+// are returned as values of type error, err is only set when reading fails.
+func decodeReply(reader *bufio.Reader) (reply any, err error) {
+	var bytesRead int
+	line, err := readLine(reader, &bytesRead)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, protocolError("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New(line[1:]), nil
+	case ':':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, protocolError("invalid integer reply")
+		}
+		return n, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > maxBulkLength {
+			return nil, protocolError("invalid bulk length")
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count > maxMultibulkLength {
+			return nil, protocolError("invalid multibulk length")
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		elements := make([]any, count)
+		for i := range elements {
+			if elements[i], err = decodeReply(reader); err != nil {
+				return nil, err
 			}
-			arrSize--
-			strSize = 0
-			arr = append(arr, token)
 		}
-		if arrSize == 0 {
+		return elements, nil
+	}
+	return nil, protocolError(fmt.Sprintf("unexpected reply type '%c'", line[0]))
+}
+
+func readLine(reader *bufio.Reader, bytesRead *int) (string, error) {
+	line, err := reader.ReadString('\n')
+	*bytesRead += len(line)
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// splitInlineArgs splits an inline command into words, honouring single and
+// double quotes the same way redis-cli and telnet users expect.
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
 			break
 		}
+
+		var arg strings.Builder
+		switch quote := line[i]; quote {
+		case '"', '\'':
+			i++
+			for ; i < len(line) && line[i] != quote; i++ {
+				if quote == '"' && line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					default:
+						arg.WriteByte(line[i])
+					}
+				} else {
+					arg.WriteByte(line[i])
+				}
+			}
+			if i == len(line) || i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+				return nil, protocolError("unbalanced quotes in request")
+			}
+			i++
+		default:
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				arg.WriteByte(line[i])
+			}
+		}
+		args = append(args, arg.String())
 	}
-	return
+	return args, nil
+}
+
+// matchPattern reports whether str matches the glob-style pattern used by
+// KEYS: '*', '?', '[...]' character classes (with '^' negation and ranges)
+// and '\\' escapes.
+func matchPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if matchPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					matched = matched || pattern[0] == str[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || str[0] >= lo && str[0] <= hi
+					pattern = pattern[2:]
+				default:
+					matched = matched || pattern[0] == str[0]
+				}
+				pattern = pattern[1:]
+			}
+			if matched == negate {
+				return false
+			}
+			str = str[1:]
+			if len(pattern) == 0 {
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
 }
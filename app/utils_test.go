@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeBulkString(t *testing.T) {
+	for _, test := range []struct {
+		got, want string
+	}{
+		{encodeBulkString(""), "$0\r\n\r\n"},
+		{encodeBulkString("a"), "$1\r\na\r\n"},
+		{encodeBulkString("a\r\nb"), "$4\r\na\r\nb\r\n"},
+		{encodeNullBulkString(), "$-1\r\n"},
+		{encodeStringArray([]string{"", "x", ""}), "*3\r\n$0\r\n\r\n$1\r\nx\r\n$0\r\n\r\n"},
+		{encodeStringArray(nil), "*0\r\n"},
+		{encodeNullArray(), "*-1\r\n"},
+		{encodeArray([]string{encodeBulkString(""), encodeNullBulkString()}), "*2\r\n$0\r\n\r\n$-1\r\n"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+}
+
+func TestDecodeStringArrayRoundTrip(t *testing.T) {
+	for _, cmd := range [][]string{
+		{"SET", "", ""},
+		{"XADD", "s", "*", "", ""},
+		{"RPUSH", "list", "", "a", ""},
+	} {
+		encoded := encodeStringArray(cmd)
+		decoded, n, err := decodeStringArray(bufio.NewReader(strings.NewReader(encoded)))
+		if err != nil || !slices.Equal(decoded, cmd) || n != len(encoded) {
+			t.Errorf("decoding %q = %q, %d bytes, %v", encoded, decoded, n, err)
+		}
+	}
+
+	// inline commands can't carry empty arguments but for quoted ones
+	decoded, _, err := decodeStringArray(bufio.NewReader(strings.NewReader("SET \"\" ''\r\n")))
+	if err != nil || !slices.Equal(decoded, []string{"SET", "", ""}) {
+		t.Errorf("decoding an inline command = %q, %v", decoded, err)
+	}
+}
+
+// TestDecodeStringArrayErrors checks the protocol errors of malformed
+// requests, and that a server replies with the error and closes the
+// connection, which can't be resynchronized.
+func TestDecodeStringArrayErrors(t *testing.T) {
+	for _, test := range []struct {
+		input, err string
+	}{
+		{"*x\r\n", "invalid multibulk length"},
+		{"*2000000\r\n", "invalid multibulk length"},
+		{"*1\r\n$x\r\n", "invalid bulk length"},
+		{"*1\r\n$-1\r\n", "invalid bulk length"},
+		{"*1\r\n$600000000\r\n", "invalid bulk length"},
+		{"*1\r\n$3\r\nfooXY", "bulk string not terminated by CRLF"},
+		{"*1\r\n$3\r\nfoo\n\r", "bulk string not terminated by CRLF"},
+		{"*1\r\n:1\r\n", "expected '$', got ':'"},
+		{"*2\r\n$1\r\na\r\n\r\n", "expected '$', got ' '"},
+		{"SET \"a b\r\n", "unbalanced quotes in request"},
+		{"SET 'a\r\n", "unbalanced quotes in request"},
+		{"SET \"a\"b\r\n", "unbalanced quotes in request"},
+	} {
+		cmd, _, err := decodeStringArray(bufio.NewReader(strings.NewReader(test.input)))
+		if _, ok := err.(protocolError); !ok || err.Error() != "Protocol error: "+test.err {
+			t.Errorf("decoding %q = %q, %v, want the protocol error %q", test.input, cmd, err, test.err)
+		}
+	}
+
+	srv := newTestServer(t)
+	port, _ := serveTestServer(t, srv)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the command following the malformed one is never run
+	conn.Write([]byte("PING\r\n*1\r\n$x\r\n" + encodeStringArray([]string{"SET", "key", "value"})))
+	replies, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading the replies: %v", err)
+	}
+	if want := "+PONG\r\n-ERR Protocol error: invalid bulk length\r\n"; string(replies) != want {
+		t.Errorf("replies %q, want %q", replies, want)
+	}
+	if reply := call(t, srv, &client{id: 1}, "GET", "key"); reply != nil {
+		t.Errorf("GET key = %v, the command after the protocol error was run", reply)
+	}
+}
+
+// TestEmptyStrings checks that empty keys, values and stream fields are
+// replied as empty bulk strings, never as nulls, both as written and after a
+// round trip through an RDB file.
+func TestEmptyStrings(t *testing.T) {
+	srv := newTestServer(t)
+	c := &client{id: 1}
+	for _, cmd := range [][]string{
+		{"SET", "", ""},
+		{"SET", "empty", ""},
+		{"RPUSH", "list", "", "a"},
+		{"XADD", "stream", "1-1", "", ""},
+		{"XADD", "stream", "1-2", "field", ""},
+	} {
+		if reply := srv.handleCommand(c, cmd); strings.HasPrefix(reply, "-") {
+			t.Fatalf("%q: %s", cmd, reply)
+		}
+	}
+
+	check := func(srv *serverState) {
+		t.Helper()
+		for _, test := range []struct {
+			cmd  []string
+			want string
+		}{
+			{[]string{"GET", ""}, "$0\r\n\r\n"},
+			{[]string{"GET", "empty"}, "$0\r\n\r\n"},
+			{[]string{"GET", "missing"}, "$-1\r\n"},
+			{[]string{"LRANGE", "list", "0", "-1"}, "*2\r\n$0\r\n\r\n$1\r\na\r\n"},
+			{[]string{"LRANGE", "missing", "0", "-1"}, "*0\r\n"},
+			{[]string{"XRANGE", "stream", "-", "+"},
+				"*2\r\n" +
+					"*2\r\n$3\r\n1-1\r\n*2\r\n$0\r\n\r\n$0\r\n\r\n" +
+					"*2\r\n$3\r\n1-2\r\n*2\r\n$5\r\nfield\r\n$0\r\n\r\n"},
+			{[]string{"XRANGE", "missing", "-", "+"}, "*0\r\n"},
+		} {
+			if got := srv.handleCommand(c, test.cmd); got != test.want {
+				t.Errorf("%q = %q, want %q", test.cmd, got, test.want)
+			}
+		}
+	}
+	check(srv)
+
+	var rdb bytes.Buffer
+	if err := writeRDB(&rdb, srv.takeSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newTestServer(t)
+	if err := loaded.readRDB(&rdb); err != nil {
+		t.Fatal(err)
+	}
+	check(loaded)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// Legacy compact encodings still found in RDB files written by older Redis
+// versions: ziplists (lists, hashes and sorted sets before 7.0), zipmaps
+// (hashes before 2.6) and intsets (sets of integers).
+
+var (
+	errInvalidZiplist = errors.New("invalid ziplist")
+	errInvalidZipmap  = errors.New("invalid zipmap")
+	errInvalidIntset  = errors.New("invalid intset")
+)
+
+// decodeZiplist returns every element as a string, integers included. The
+// layout is zlbytes, zltail, zllen, the entries and a 0xFF terminator; every
+// entry is the previous entry length, an encoding and the data.
+func decodeZiplist(data []byte) ([]string, error) {
+	if len(data) < 11 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errInvalidZiplist
+	}
+
+	var elements []string
+	for pos := 10; ; {
+		if pos >= len(data) {
+			return nil, errInvalidZiplist
+		}
+		if data[pos] == 0xFF {
+			break
+		}
+
+		// previous entry length: one byte, or 0xFE and four bytes
+		if data[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, errInvalidZiplist
+		}
+
+		b0 := data[pos]
+		var value string
+		var headerSize, dataSize, intSize int
+		switch {
+		case b0>>6 == 0b00:
+			headerSize, dataSize = 1, int(b0&0x3F)
+		case b0>>6 == 0b01:
+			if pos+2 > len(data) {
+				return nil, errInvalidZiplist
+			}
+			headerSize, dataSize = 2, int(b0&0x3F)<<8|int(data[pos+1])
+		case b0 == 0b10000000:
+			if pos+5 > len(data) {
+				return nil, errInvalidZiplist
+			}
+			headerSize, dataSize = 5, int(binary.BigEndian.Uint32(data[pos+1:]))
+		case b0 == 0b11000000:
+			headerSize, intSize = 1, 2
+		case b0 == 0b11010000:
+			headerSize, intSize = 1, 4
+		case b0 == 0b11100000:
+			headerSize, intSize = 1, 8
+		case b0 == 0b11110000:
+			headerSize, intSize = 1, 3
+		case b0 == 0b11111110:
+			headerSize, intSize = 1, 1
+		case b0 >= 0b11110001 && b0 <= 0b11111101:
+			// immediate 4 bit integer, stored off by one
+			headerSize, value = 1, strconv.Itoa(int(b0&0x0F)-1)
+		default:
+			return nil, errInvalidZiplist
+		}
+
+		start := pos + headerSize
+		if intSize > 0 {
+			if start+intSize > len(data) {
+				return nil, errInvalidZiplist
+			}
+			var u uint64
+			for i := intSize - 1; i >= 0; i-- {
+				u = u<<8 | uint64(data[start+i])
+			}
+			shift := 64 - 8*intSize
+			value = strconv.FormatInt(int64(u<<shift)>>shift, 10)
+			dataSize = intSize
+		} else if dataSize > 0 {
+			if start+dataSize > len(data) {
+				return nil, errInvalidZiplist
+			}
+			value = string(data[start : start+dataSize])
+		}
+
+		elements = append(elements, value)
+		pos = start + dataSize
+	}
+	return elements, nil
+}
+
+// decodeZipmap returns the field/value pairs of a zipmap: a count byte, then
+// for every pair the field length and field, the value length, a free byte
+// count, the value and the free bytes, and a 0xFF terminator.
+func decodeZipmap(data []byte) ([]string, error) {
+	pos := 1
+	readLen := func() (int, error) {
+		if pos >= len(data) {
+			return 0, errInvalidZipmap
+		}
+		if data[pos] < 254 {
+			pos++
+			return int(data[pos-1]), nil
+		}
+		if data[pos] == 255 || pos+5 > len(data) {
+			return 0, errInvalidZipmap
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos+1:]))
+		pos += 5
+		return size, nil
+	}
+	readBytes := func(size int) (string, error) {
+		if pos+size > len(data) {
+			return "", errInvalidZipmap
+		}
+		pos += size
+		return string(data[pos-size : pos]), nil
+	}
+
+	var fields []string
+	for {
+		if pos >= len(data) {
+			return nil, errInvalidZipmap
+		}
+		if data[pos] == 0xFF {
+			break
+		}
+		size, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		field, err := readBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		if size, err = readLen(); err != nil {
+			return nil, err
+		}
+		if pos >= len(data) {
+			return nil, errInvalidZipmap
+		}
+		free := int(data[pos])
+		pos++
+		value, err := readBytes(size)
+		if err != nil {
+			return nil, err
+		}
+		pos += free
+		fields = append(fields, field, value)
+	}
+	return fields, nil
+}
+
+// decodeIntset returns the members of an intset: the integer width, the
+// member count and the sorted little endian integers.
+func decodeIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errInvalidIntset
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(data) != 8+width*count {
+		return nil, errInvalidIntset
+	}
+
+	members := make([]string, 0, count)
+	for pos := 8; pos < len(data); pos += width {
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(data[pos:])))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(data[pos:])))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(data[pos:]))
+		}
+		members = append(members, strconv.FormatInt(v, 10))
+	}
+	return members, nil
+}